@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/unforker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func BlameCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "blame [release name]",
+		Short: "Show which revision of a release introduced each change in the fork",
+		Long: `Walk the history of a helm release, and for each field that the latest revision
+patches on top of the upstream chart, show the revision that introduced it and
+the chart version that revision was deployed with.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			_ = viper.BindPFlags(cmd.Flags())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v := viper.GetViper()
+
+			index, err := ensureIndex()
+			if err != nil {
+				return errors.Wrap(err, "failed to update index")
+			}
+
+			history, err := releaseHistory(args[0])
+			if err != nil {
+				return err
+			}
+			latest := history[len(history)-1]
+
+			repoConfigs, err := repoConfigsFromFlags()
+			if err != nil {
+				return errors.Wrap(err, "failed to read repositories")
+			}
+			unforkOptions := unforker.UnforkOptions{
+				Rerender:    v.GetBool("rerender"),
+				RepoConfigs: repoConfigs,
+			}
+
+			upstreamChart, err := findUpstream(index, latest, v.GetString("upstream"), v.GetBool("auto-select"), unforkOptions)
+			if err != nil {
+				return err
+			}
+
+			blameLines, err := unforker.Blame(history, index, upstreamChart, unforkOptions)
+			if err != nil {
+				return errors.Wrap(err, "failed to blame")
+			}
+
+			fmt.Printf("Comparing %d revisions of %s with %s/%s@%s\n\n", len(history), latest.HelmName, upstreamChart.Repo, upstreamChart.Name, upstreamChart.ChartVersion)
+
+			if len(blameLines) == 0 {
+				fmt.Println("The latest revision has no changes from the upstream chart")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "RESOURCE\tFIELD\tREVISION\tCHART VERSION")
+			for _, blameLine := range blameLines {
+				field := blameLine.Field
+				if field == "" {
+					field = "(added)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", blameLine.Resource, field, blameLine.Revision, blameLine.ChartVersion)
+			}
+
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().String("upstream", "", "the upstream chart to compare with when there is more than one candidate, as repo/chart or repo/chart@version")
+	cmd.Flags().Bool("auto-select", false, "when there is more than one candidate, compare the release with each and use the upstream that leaves the smallest patches")
+	cmd.Flags().Bool("rerender", false, "render each revision again instead of using the manifest helm stored for it")
+
+	return cmd
+}
@@ -1,11 +1,13 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
@@ -20,36 +22,58 @@ var (
 	responsiveBreakpoint = 300
 )
 
+// maxConcurrentScoring is the most releases whose upstreams are scored at the same time. Each
+// downloads and renders every upstream, so a user scrolling through releases can't start them all
+const maxConcurrentScoring = 2
+
 type Home struct {
 	chartsTable *widgets.Table
-	isListening bool
 
 	chartHeaderNarrow []string
 	chartHeaderWide   []string
 
-	uiCh chan unforker.UIEvent
+	uiCh          chan unforker.UIEvent
+	index         *chartindex.ChartIndex
+	mapping       *chartindex.Mapping
+	mappingFile   string
+	unforkOptions unforker.UnforkOptions
 
 	localCharts     []*unforker.LocalChart
 	upstreamMatches []chartindex.ChartMatch
 
+	// upstreamScores are keyed by release revision, and are found in the background. Scoring
+	// is cancelled when its release isn't selected anymore
+	upstreamScores map[string]*releaseScores
+	scoring        map[string]context.CancelFunc
+	scoringSlots   chan struct{}
+
 	selectedChartIndex       int
 	selectedUpstreamIndex    int
 	showUnfork               bool
 	isUnforking              bool
+	isEnteringUpstream       bool
+	customUpstream           string
 	needsOverwritePermission bool
 	dialogMessage            string
 
 	focusPane string
 }
 
-func createHome(uiCh chan unforker.UIEvent) *Home {
+func createHome(uiCh chan unforker.UIEvent, index *chartindex.ChartIndex, mapping *chartindex.Mapping, mappingFile string, unforkOptions unforker.UnforkOptions) *Home {
 	home := Home{}
 
 	home.chartHeaderNarrow = []string{"Helm Chart", "Chart Version"}
-	home.chartHeaderWide = []string{"Helm Chart", "Namespace", "Installed App Version", "Installed Chart Version"}
+	home.chartHeaderWide = []string{"Helm Chart", "Namespace", "Revision", "Status", "Installed App Version", "Installed Chart Version"}
 
 	home.uiCh = uiCh
+	home.index = index
+	home.mapping = mapping
+	home.mappingFile = mappingFile
+	home.unforkOptions = unforkOptions
 	home.localCharts = []*unforker.LocalChart{}
+	home.upstreamScores = map[string]*releaseScores{}
+	home.scoring = map[string]context.CancelFunc{}
+	home.scoringSlots = make(chan struct{}, maxConcurrentScoring)
 
 	home.focusPane = "charts"
 
@@ -107,34 +131,126 @@ func (h *Home) render() error {
 		ui.Render(overwritePrompt)
 	}
 
-	if !h.isListening {
-		h.isListening = true
+	return nil
+}
 
-		go func() {
-			for {
-				select {
-				case uiEvent := <-h.uiCh:
-					if uiEvent.EventName == "new_chart" {
-						chart := uiEvent.Payload.(*unforker.LocalChart)
-						h.localCharts = append(h.localCharts, chart)
+// handleUIEvent applies a release that discovery added, changed or removed, and the scores of
+// upstreams. It's called from the event loop, so that the ui is only drawn from one goroutine
+func (h *Home) handleUIEvent(uiEvent unforker.UIEvent) {
+	if scored, ok := uiEvent.Payload.(scoredRelease); ok && uiEvent.EventName == "scores_updated" {
+		h.upstreamScores[scored.releaseKey] = scored.scores
+		delete(h.scoring, scored.releaseKey)
 
-						if termWidth > responsiveBreakpoint {
-							h.chartsTable.Rows = h.wideCharts()
-						} else {
-							h.chartsTable.Rows = h.narrowCharts()
-						}
+		selected := h.selectedChart()
+		if !h.showUnfork && h.dialogMessage == "" && selected != nil && releaseRevisionKey(selected) == scored.releaseKey {
+			h.drawSelectedChart()
+		}
+		return
+	}
 
-						ui.Render(h.chartsTable)
-					}
-				}
+	chart, ok := uiEvent.Payload.(*unforker.LocalChart)
+	if !ok {
+		return
+	}
+
+	switch uiEvent.EventName {
+	case "new_chart":
+		h.localCharts = append(h.localCharts, chart)
+	case "updated_chart":
+		h.updateChart(chart)
+	case "removed_chart":
+		if h.removeChart(chart) {
+			// the selected release was removed, so its details and upstreams are stale
+			ui.Clear()
+			h.render()
+			return
+		}
+	default:
+		return
+	}
+
+	h.refreshCharts()
+}
+
+// updateChart replaces the row for the same release, keeping its position in the table
+func (h *Home) updateChart(chart *unforker.LocalChart) {
+	for i, localChart := range h.localCharts {
+		if localChart.ReleaseKey() == chart.ReleaseKey() {
+			h.localCharts[i] = chart
+			return
+		}
+	}
+
+	h.localCharts = append(h.localCharts, chart)
+}
+
+// removeChart removes the row for a deleted release. The selected release is kept while
+// it's being unforked, and is only marked as uninstalled. Returns true if the selection was cleared
+func (h *Home) removeChart(chart *unforker.LocalChart) bool {
+	for i, localChart := range h.localCharts {
+		if localChart.ReleaseKey() != chart.ReleaseKey() {
+			continue
+		}
+
+		rowIndex := i + 1
+		if rowIndex == h.selectedChartIndex {
+			if h.showUnfork || h.isUnforking {
+				localChart.Status = "uninstalled"
+				return false
 			}
-		}()
+
+			h.localCharts = append(h.localCharts[:i], h.localCharts[i+1:]...)
+			h.selectedChartIndex = 0
+			h.selectedUpstreamIndex = 0
+			h.upstreamMatches = nil
+			h.focusPane = "charts"
+			return true
+		}
+
+		if rowIndex < h.selectedChartIndex {
+			h.selectedChartIndex--
+		}
+		h.localCharts = append(h.localCharts[:i], h.localCharts[i+1:]...)
+		return false
 	}
 
-	return nil
+	return false
+}
+
+// refreshCharts redraws the charts table after releases were added, changed or removed
+func (h *Home) refreshCharts() {
+	termWidth, _ := ui.TerminalDimensions()
+	if termWidth > responsiveBreakpoint {
+		h.chartsTable.Rows = h.wideCharts()
+	} else {
+		h.chartsTable.Rows = h.narrowCharts()
+	}
+
+	h.chartsTable.RowStyles = map[int]ui.Style{
+		0: ui.NewStyle(ui.ColorWhite, ui.ColorClear, ui.ModifierBold),
+	}
+	if h.selectedChartIndex > 0 {
+		for i := range h.chartsTable.Rows {
+			if i == 0 {
+				continue
+			}
+
+			if i != h.selectedChartIndex {
+				h.chartsTable.RowStyles[i] = ui.NewStyle(ui.ColorBlue, ui.ColorClear)
+			} else {
+				h.chartsTable.RowStyles[i] = ui.NewStyle(ui.ColorBlack, ui.ColorWhite)
+			}
+		}
+	}
+
+	ui.Render(h.chartsTable)
 }
 
 func (h *Home) handleEvent(e ui.Event) (bool, error) {
+	if h.isEnteringUpstream {
+		return false, h.handleUpstreamInput(e)
+	}
+
 	switch e.ID {
 	case "<Escape>", "q", "<C-c>":
 		if h.showUnfork {
@@ -197,6 +313,14 @@ func (h *Home) handleEvent(e ui.Event) (bool, error) {
 				h.render()
 			}
 		}
+	case "c":
+		if !h.showUnfork && !h.isUnforking && h.focusPane == "upstreams" && h.selectedChartIndex > 0 {
+			h.isEnteringUpstream = true
+			h.customUpstream = ""
+			h.dialogMessage = h.customUpstreamPrompt("")
+			ui.Clear()
+			h.render()
+		}
 	case "<Left>", "a":
 		if !h.showUnfork && !h.isUnforking {
 			if h.focusPane == "upstreams" {
@@ -262,6 +386,84 @@ func (h *Home) handleEvent(e ui.Event) (bool, error) {
 	return false, nil
 }
 
+// handleUpstreamInput edits the custom upstream that's being typed, and saves it to the mapping file on enter
+func (h *Home) handleUpstreamInput(e ui.Event) error {
+	errorMessage := ""
+
+	switch e.ID {
+	case "<Escape>", "<C-c>":
+		h.isEnteringUpstream = false
+		h.dialogMessage = ""
+		ui.Clear()
+		return h.render()
+	case "<Enter>":
+		if err := h.saveCustomUpstream(); err != nil {
+			errorMessage = errors.Cause(err).Error()
+			break
+		}
+
+		h.isEnteringUpstream = false
+		h.dialogMessage = ""
+		h.selectedUpstreamIndex = 1
+		ui.Clear()
+		return h.render()
+	case "<Backspace>", "<C-<Backspace>>":
+		if runes := []rune(h.customUpstream); len(runes) > 0 {
+			h.customUpstream = string(runes[:len(runes)-1])
+		}
+	case "<Space>":
+		h.customUpstream += " "
+	default:
+		// other keys, such as arrows, have names in angle brackets
+		if utf8.RuneCountInString(e.ID) == 1 {
+			h.customUpstream += e.ID
+		}
+	}
+
+	h.dialogMessage = h.customUpstreamPrompt(errorMessage)
+	ui.Clear()
+	return h.render()
+}
+
+func (h *Home) customUpstreamPrompt(errorMessage string) string {
+	localChart := h.localCharts[h.selectedChartIndex-1]
+
+	prompt := fmt.Sprintf(` The upstream of %s, as a chart in a repo (https://charts.example.com/stable/redis@10.5.7), 
+ a chart in an oci registry (oci://registry.example.com/charts/redis:10.5.7) or a chart on disk: 
+ 
+ > %s_ 
+ 
+ Press enter to save it to %s, or esc to cancel. `, localChart.HelmName, h.customUpstream, h.mappingFile)
+	if errorMessage != "" {
+		prompt += fmt.Sprintf("\n \n %s ", errorMessage)
+	}
+
+	return prompt
+}
+
+// saveCustomUpstream adds the upstream that was typed to the mapping file, for the selected release
+func (h *Home) saveCustomUpstream() error {
+	localChart := h.localCharts[h.selectedChartIndex-1]
+
+	mappedUpstream, err := chartindex.ParseMappedUpstream(h.customUpstream)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse upstream")
+	}
+	mappedUpstream.Namespace = localChart.Namespace
+	mappedUpstream.Release = localChart.HelmName
+
+	if _, err := h.index.ResolveMappedUpstream(mappedUpstream, localChart.ChartName, localChart.ChartVersion, localChart.AppVersion); err != nil {
+		return errors.Wrap(err, "failed to resolve upstream")
+	}
+
+	h.mapping.Set(mappedUpstream)
+	if err := h.mapping.Save(h.mappingFile); err != nil {
+		return errors.Wrap(err, "failed to save mapping")
+	}
+
+	return nil
+}
+
 func (h *Home) doUnfork() error {
 
 	h.dialogMessage = "unforking..."
@@ -271,29 +473,102 @@ func (h *Home) doUnfork() error {
 	localChart := h.localCharts[h.selectedChartIndex-1]
 	upstreamChart := h.upstreamMatches[h.selectedUpstreamIndex-1]
 
-	unforkedDir, err := unforker.Unfork(localChart, upstreamChart)
+	unforkResult, err := unforker.Unfork(localChart, upstreamChart, h.unforkOptions)
 	if err != nil {
 		return err
 	}
 
 	h.isUnforking = false
 
-	unforkMessageTemplate := ` Your unforked Chart is available at %s. 
+	h.dialogMessage = unforkedMessage(unforkResult, localChart, upstreamChart) + `
+ 
+ Press 'q' to exit. `
+	ui.Clear()
+	h.render()
 
+	return nil
+}
+
+func unforkedMessage(unforkResult *unforker.UnforkResult, localChart *unforker.LocalChart, upstreamChart chartindex.ChartMatch) string {
+	unforkedDir := unforkResult.Dir
+
+	unforkMessageTemplate := ` Your unforked Chart is available at %s. 
+%s
  You can install the same version with: 
  kubectl apply -k %s 
 
  You can update to the latest version of %s with: 
  kots pull helm://%s/%s 
- from within %s. 
- 
- Press 'q' to exit. `
+ from within %s. `
 
-	h.dialogMessage = fmt.Sprintf(unforkMessageTemplate, unforkedDir, filepath.Join(unforkedDir, "overlays", "downstreams", "unforked"), localChart.ChartName, upstreamChart.Repo, upstreamChart.Name, unforkedDir)
-	ui.Clear()
-	h.render()
+	message := fmt.Sprintf(unforkMessageTemplate, unforkedDir, unforkedChanges(unforkResult), filepath.Join(unforkedDir, "overlays", "downstreams", "unforked"), localChart.ChartName, upstreamChart.Repo, upstreamChart.Name, unforkedDir)
 
-	return nil
+	if successor := upstreamChart.Successor; successor != nil {
+		message += fmt.Sprintf(`
+
+ %s/%s is deprecated, and is maintained as %s in %s now. `, upstreamChart.Repo, upstreamChart.Name, successor.Name, successor.URI)
+	} else if upstreamChart.Deprecated {
+		message += fmt.Sprintf(`
+
+ %s/%s@%s is deprecated. `, upstreamChart.Repo, upstreamChart.Name, upstreamChart.ChartVersion)
+	}
+
+	return message
+}
+
+// unforkedChanges summarizes which changes became values and which became patches
+func unforkedChanges(unforkResult *unforker.UnforkResult) string {
+	changes := ""
+
+	if len(unforkResult.ValuesKeys) > 0 {
+		changes += fmt.Sprintf(`
+ %d changes were expressible as values, and are in %s: 
+ %s 
+ The base was rendered with these values. kots pull renders the upstream with its default 
+ values, so render each new version with --values %s too, or these changes are lost. 
+`, len(unforkResult.ValuesKeys), unforkResult.ValuesFile, summarizeList(unforkResult.ValuesKeys), unforkResult.ValuesFile)
+	}
+
+	if len(unforkResult.Patches) > 0 {
+		changes += fmt.Sprintf(`
+ %d resources required kustomize patches: 
+ %s 
+`, len(unforkResult.Patches), summarizeList(unforkResult.Patches))
+	}
+
+	if len(unforkResult.Resources) > 0 {
+		changes += fmt.Sprintf(`
+ %d resources are only in your fork, and were added: 
+ %s 
+`, len(unforkResult.Resources), summarizeList(unforkResult.Resources))
+	}
+
+	if drift := unforkResult.Drift; drift != nil {
+		if len(drift.Patches) > 0 {
+			changes += fmt.Sprintf(`
+ %d resources were changed in the cluster after helm applied them. 
+ To keep those changes, apply %s instead: 
+ %s 
+`, len(drift.Patches), drift.Dir, summarizeList(drift.Patches))
+		}
+		if len(drift.Missing) > 0 {
+			changes += fmt.Sprintf(`
+ %d resources in the release are no longer in the cluster: 
+ %s 
+`, len(drift.Missing), summarizeList(drift.Missing))
+		}
+	}
+
+	return changes
+}
+
+func summarizeList(items []string) string {
+	maxItems := 5
+	if len(items) <= maxItems {
+		return strings.Join(items, ", ")
+	}
+
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:maxItems], ", "), len(items)-maxItems)
 }
 
 func (h *Home) findUnforkPath() string {
@@ -330,7 +605,9 @@ func (h *Home) wideCharts() [][]string {
 	for _, localChart := range h.localCharts {
 		rows = append(rows, []string{
 			localChart.ChartName,
-			"default",
+			localChart.Namespace,
+			revisionString(localChart.Revision),
+			releaseStatus(localChart),
 			localChart.AppVersion,
 			localChart.ChartVersion,
 		})
@@ -339,6 +616,28 @@ func (h *Home) wideCharts() [][]string {
 	return rows
 }
 
+// revisionString formats a release revision, charts that weren't installed by helm have no revision
+func revisionString(revision int32) string {
+	if revision == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", revision)
+}
+
+// releaseStatus includes the gitops controller that deploys a release
+func releaseStatus(localChart *unforker.LocalChart) string {
+	if localChart.FromLabels {
+		return "labels only"
+	}
+	if localChart.Controller == "" {
+		return localChart.Status
+	}
+	if localChart.Status == "" {
+		return localChart.Controller
+	}
+	return fmt.Sprintf("%s (%s)", localChart.Status, localChart.Controller)
+}
+
 func (h *Home) narrowCharts() [][]string {
 	rows := [][]string{h.chartHeaderNarrow}
 
@@ -370,8 +669,17 @@ func (h *Home) highlightPreviousUpstream() {
 	h.drawSelectedChart()
 }
 
-func (h *Home) drawSelectedChart() {
+// selectedChart returns the selected release, or nil if none is
+func (h *Home) selectedChart() *unforker.LocalChart {
 	if h.selectedChartIndex == 0 || h.selectedChartIndex > len(h.localCharts) {
+		return nil
+	}
+	return h.localCharts[h.selectedChartIndex-1]
+}
+
+func (h *Home) drawSelectedChart() {
+	if h.selectedChart() == nil {
+		h.cancelScoring("")
 		return
 	}
 
@@ -404,7 +712,7 @@ func (h *Home) drawSelectedChart() {
 	if h.focusPane == "charts" {
 		possibleUpstreams.Title = "Possible Upstream Helm Charts (press → to select)"
 	} else if h.focusPane == "upstreams" {
-		possibleUpstreams.Title = "Possible Upstream Helm Charts (↑ ↓ to select)"
+		possibleUpstreams.Title = "Possible Upstream Helm Charts (↑ ↓ to select, c to enter another)"
 	}
 	possibleUpstreams.SetRect(ourLeft, ourTop+4, ourRight, ourTop+5)
 	ui.Render(possibleUpstreams)
@@ -414,12 +722,14 @@ func (h *Home) drawSelectedChart() {
 	upstreamsTable.SetRect(ourLeft, ourTop+5, ourRight, ourBottom-2)
 	upstreamsTable.RowStyles[0] = ui.NewStyle(ui.ColorWhite, ui.ColorClear, ui.ModifierBold)
 	upstreamsTable.Rows = [][]string{
-		[]string{"Repo/Chart", "Closest Version", "Latest Chart/App Version"},
+		[]string{"Repo/Chart", "Closest Version", "Match", "Score", "Latest Chart/App Version"},
 	}
 
 	localChart := h.localCharts[h.selectedChartIndex-1]
-	upstreamMatches, err := chartindex.FindBestUpstreamMatches(localChart.ChartName, localChart.ChartVersion, localChart.AppVersion)
+	upstreamMatches, err := unforker.UpstreamMatches(h.index, h.mapping, localChart)
 	if err != nil {
+		upstreamsTable.Rows = append(upstreamsTable.Rows, []string{errors.Cause(err).Error(), "", "", "", ""})
+		ui.Render(upstreamsTable)
 		return
 	}
 	h.upstreamMatches = upstreamMatches
@@ -430,10 +740,13 @@ func (h *Home) drawSelectedChart() {
 		}
 	}
 
+	scores := h.scoreUpstreams(localChart, upstreamMatches)
 	for _, upstreamMatch := range upstreamMatches {
 		upstreamsTable.Rows = append(upstreamsTable.Rows, []string{
 			fmt.Sprintf("%s/%s", upstreamMatch.Repo, upstreamMatch.Name),
 			upstreamMatch.ChartVersion,
+			upstreamMatch.MatchDescription(),
+			scores.describe(upstreamMatch),
 			fmt.Sprintf("%s/%s", upstreamMatch.LatestChartVersion, upstreamMatch.LatestAppVersion),
 		})
 	}
@@ -454,6 +767,112 @@ func (h *Home) drawSelectedChart() {
 	ui.Render(upstreamsTable)
 }
 
+// releaseScores are the scores of the upstreams of a release revision
+type releaseScores struct {
+	done   bool
+	scores map[string]unforker.UpstreamScore
+	best   string
+}
+
+// scoredRelease is the payload of a scores_updated event
+type scoredRelease struct {
+	releaseKey string
+	scores     *releaseScores
+}
+
+func upstreamKey(upstreamMatch chartindex.ChartMatch) string {
+	return fmt.Sprintf("%s/%s/%s@%s", upstreamMatch.URI, upstreamMatch.Repo, upstreamMatch.Name, upstreamMatch.ChartVersion)
+}
+
+// releaseRevisionKey identifies a revision of a release, which is the same after discovery replaces its LocalChart
+func releaseRevisionKey(localChart *unforker.LocalChart) string {
+	return fmt.Sprintf("%s@%d", localChart.ReleaseKey(), localChart.Revision)
+}
+
+// describe shows the score of upstreamMatch, or that it's still being scored
+func (r *releaseScores) describe(upstreamMatch chartindex.ChartMatch) string {
+	if r == nil {
+		return ""
+	}
+	if !r.done {
+		return "scoring..."
+	}
+
+	key := upstreamKey(upstreamMatch)
+	score, ok := r.scores[key]
+	if !ok {
+		return ""
+	}
+	if key == r.best {
+		return score.String() + " (best)"
+	}
+	return score.String()
+}
+
+// scoreUpstreams returns the scores of the upstreams of localChart, and starts scoring them in the
+// background the first time the release is shown. The scores are sent in a scores_updated event, so
+// they're only read and written by the event loop. A release with only one possible upstream isn't scored
+func (h *Home) scoreUpstreams(localChart *unforker.LocalChart, upstreamMatches []chartindex.ChartMatch) *releaseScores {
+	releaseKey := releaseRevisionKey(localChart)
+	h.cancelScoring(releaseKey)
+
+	if len(upstreamMatches) < 2 {
+		return nil
+	}
+
+	if scores, ok := h.upstreamScores[releaseKey]; ok {
+		return scores
+	}
+	if _, ok := h.scoring[releaseKey]; ok {
+		return &releaseScores{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.scoring[releaseKey] = cancel
+
+	go func() {
+		select {
+		case h.scoringSlots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-h.scoringSlots }()
+
+		scores := releaseScores{
+			done:   true,
+			scores: map[string]unforker.UpstreamScore{},
+		}
+		upstreamScores, err := unforker.ScoreUpstreams(ctx, localChart, upstreamMatches, h.unforkOptions)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			for _, upstreamScore := range upstreamScores {
+				scores.scores[upstreamKey(upstreamScore.Match)] = upstreamScore
+			}
+			if len(upstreamScores) > 0 && upstreamScores[0].Err == nil {
+				scores.best = upstreamKey(upstreamScores[0].Match)
+			}
+		}
+
+		h.uiCh <- unforker.UIEvent{EventName: "scores_updated", Payload: scoredRelease{releaseKey: releaseKey, scores: &scores}}
+	}()
+
+	return &releaseScores{}
+}
+
+// cancelScoring cancels scoring the upstreams of every release revision except selectedKey, which
+// are started again when they're selected
+func (h *Home) cancelScoring(selectedKey string) {
+	for releaseKey, cancel := range h.scoring {
+		if releaseKey == selectedKey {
+			continue
+		}
+		cancel()
+		delete(h.scoring, releaseKey)
+	}
+}
+
 func (h *Home) drawUnfork() {
 	termWidth, termHeight := ui.TerminalDimensions()
 	ourLeft := 6
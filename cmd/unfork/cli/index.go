@@ -1,11 +1,8 @@
 package cli
 
 import (
-	"os"
-	"path/filepath"
+	"fmt"
 
-	"github.com/pkg/errors"
-	"github.com/replicatedhq/unfork/pkg/chartindex"
 	"github.com/spf13/cobra"
 )
 
@@ -16,20 +13,13 @@ func IndexCmd() *cobra.Command {
 		Long:   ``,
 		Hidden: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			index := chartindex.ChartIndex{}
-			if err := index.Build(); err != nil {
-				return errors.Cause(err)
-			}
-
-			dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+			index, err := buildIndex(indexFile())
 			if err != nil {
-				return errors.Cause(err)
+				return err
 			}
 
-			indexFile := filepath.Join(dir, "charts.json")
-
-			if err := index.Save(indexFile); err != nil {
-				return errors.Cause(err)
+			for _, failedRepo := range index.FailedRepos() {
+				fmt.Printf("failed to index %s (%s): %s\n", failedRepo.Name, failedRepo.URL, failedRepo.Error)
 			}
 
 			return nil
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/replicatedhq/unfork/pkg/unforker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func LocalCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "local [path to chart directory or .tgz]",
+		Short: "Unfork a chart on disk, without connecting to a cluster",
+		Long: `Compare a forked helm chart directory or packaged chart with its upstream,
+and create kustomize patches from the differences. No kubeconfig is needed.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			_ = viper.BindPFlags(cmd.Flags())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v := viper.GetViper()
+
+			index, err := ensureIndex()
+			if err != nil {
+				return errors.Wrap(err, "failed to update index")
+			}
+
+			namespace := v.GetString("namespace")
+			if namespace == "" {
+				namespace = "default"
+			}
+
+			localChart, err := unforker.LoadLocalChart(args[0], v.GetString("values"), v.GetString("name"), namespace)
+			if err != nil {
+				return errors.Wrap(err, "failed to load local chart")
+			}
+
+			repoConfigs, err := repoConfigsFromFlags()
+			if err != nil {
+				return errors.Wrap(err, "failed to read repositories")
+			}
+			unforkOptions := unforker.UnforkOptions{
+				RepoConfigs: repoConfigs,
+			}
+
+			upstreamChart, err := findUpstream(index, localChart, v.GetString("upstream"), v.GetBool("auto-select"), unforkOptions)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Unforking %s@%s from %s/%s@%s\n", localChart.ChartName, localChart.ChartVersion, upstreamChart.Repo, upstreamChart.Name, upstreamChart.ChartVersion)
+
+			unforkResult, err := unforker.Unfork(localChart, upstreamChart, unforkOptions)
+			if err != nil {
+				return errors.Wrap(err, "failed to unfork")
+			}
+
+			fmt.Printf("\n%s\n", unforkedMessage(unforkResult, localChart, upstreamChart))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("values", "f", "", "a values file with the overrides that the chart is deployed with")
+	cmd.Flags().String("name", "", "the release name to render the chart with (defaults to the chart name)")
+	cmd.Flags().String("upstream", "", "the upstream chart to use when there is more than one candidate, as repo/chart or repo/chart@version")
+	cmd.Flags().Bool("auto-select", false, "when there is more than one candidate, compare the chart with each and use the upstream that leaves the smallest patches")
+
+	return cmd
+}
+
+// chooseUpstream picks the upstream matching the "repo/chart" or "repo/chart@version" in selected,
+// or the only candidate, or the only exact match. Candidates are ordered best first.
+func chooseUpstream(upstreamMatches []chartindex.ChartMatch, selected string) (chartindex.ChartMatch, error) {
+	if selected != "" {
+		for _, upstreamMatch := range upstreamMatches {
+			repoChart := fmt.Sprintf("%s/%s", upstreamMatch.Repo, upstreamMatch.Name)
+			if repoChart == selected || fmt.Sprintf("%s@%s", repoChart, upstreamMatch.ChartVersion) == selected {
+				return upstreamMatch, nil
+			}
+		}
+
+		return chartindex.ChartMatch{}, errors.Errorf("%s is not one of the possible upstream helm charts", selected)
+	}
+
+	if len(upstreamMatches) == 0 {
+		return chartindex.ChartMatch{}, errors.New("Unable to find a possible upstream helm chart in the index")
+	}
+
+	exactMatches := []chartindex.ChartMatch{}
+	for _, upstreamMatch := range upstreamMatches {
+		if upstreamMatch.MatchQuality == chartindex.MatchExact {
+			exactMatches = append(exactMatches, upstreamMatch)
+		}
+	}
+	if len(exactMatches) == 1 {
+		return exactMatches[0], nil
+	}
+
+	if len(upstreamMatches) > 1 {
+		candidates := []string{}
+		for _, upstreamMatch := range upstreamMatches {
+			candidates = append(candidates, fmt.Sprintf("  %s/%s@%s (%s)", upstreamMatch.Repo, upstreamMatch.Name, upstreamMatch.ChartVersion, upstreamMatch.MatchDescription()))
+		}
+
+		return chartindex.ChartMatch{}, errors.Errorf("Found more than one possible upstream helm chart, choose one with --upstream:\n%s", strings.Join(candidates, "\n"))
+	}
+
+	return upstreamMatches[0], nil
+}
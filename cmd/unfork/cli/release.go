@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/replicatedhq/unfork/pkg/unforker"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func ReleaseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "release [release name]",
+		Short: "Unfork one revision of a release, without the interactive ui",
+		Long: `Unfork a single helm release from the cluster. The latest revision is used by default,
+including releases whose last upgrade failed or is still pending. Use --revision
+to unfork an older revision.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			_ = viper.BindPFlags(cmd.Flags())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			v := viper.GetViper()
+
+			index, err := ensureIndex()
+			if err != nil {
+				return errors.Wrap(err, "failed to update index")
+			}
+
+			history, err := releaseHistory(args[0])
+			if err != nil {
+				return err
+			}
+
+			localChart, err := unforker.FindRevision(history, int32(v.GetInt("revision")))
+			if err != nil {
+				return err
+			}
+
+			repoConfigs, err := repoConfigsFromFlags()
+			if err != nil {
+				return errors.Wrap(err, "failed to read repositories")
+			}
+			unforkOptions := unforker.UnforkOptions{
+				Rerender:     v.GetBool("rerender"),
+				CaptureDrift: v.GetBool("capture-drift"),
+				ConfigFlags:  kubernetesConfigFlags,
+				RepoConfigs:  repoConfigs,
+			}
+
+			upstreamChart, err := findUpstream(index, localChart, v.GetString("upstream"), v.GetBool("auto-select"), unforkOptions)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Unforking revision %d (%s) of %s from %s/%s@%s\n", localChart.Revision, localChart.Status, localChart.HelmName, upstreamChart.Repo, upstreamChart.Name, upstreamChart.ChartVersion)
+
+			unforkResult, err := unforker.Unfork(localChart, upstreamChart, unforkOptions)
+			if err != nil {
+				return errors.Wrap(err, "failed to unfork")
+			}
+
+			fmt.Printf("\n%s\n", unforkedMessage(unforkResult, localChart, upstreamChart))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Int("revision", 0, "the revision to unfork (defaults to the latest)")
+	cmd.Flags().String("upstream", "", "the upstream chart to use when there is more than one candidate, as repo/chart or repo/chart@version, or a chart in an oci registry as oci://registry/namespace/chart:version")
+	cmd.Flags().Bool("auto-select", false, "when there is more than one candidate, compare the release with each and use the upstream that leaves the smallest patches")
+	cmd.Flags().Bool("rerender", false, "render the forked chart again instead of using the manifest helm stored for the release")
+	cmd.Flags().Bool("capture-drift", false, "compare the release with the live cluster, and write changes made outside of helm to a separate drift downstream")
+
+	return cmd
+}
+
+// releaseHistory returns every revision of the release named helmName, oldest first
+func releaseHistory(helmName string) ([]*unforker.LocalChart, error) {
+	u, err := unforker.NewUnforker(kubernetesConfigFlags, tillerOptionsFromFlags(), unforker.DiscoveryOptions{}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create unforker")
+	}
+
+	namespace := ""
+	if kubernetesConfigFlags.Namespace != nil {
+		namespace = *kubernetesConfigFlags.Namespace
+	}
+
+	history, err := u.ReleaseHistory(helmName, namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read release history")
+	}
+	if len(history) == 0 {
+		return nil, errors.Errorf("release %s was not found", helmName)
+	}
+
+	return history, nil
+}
+
+// findUpstream finds the upstream for localChart in the index, using selected if there is more than one,
+// or the one with the smallest diff when autoSelect is set. selected can also be a chart in an oci
+// registry, which is used without searching the index
+func findUpstream(index *chartindex.ChartIndex, localChart *unforker.LocalChart, selected string, autoSelect bool, unforkOptions unforker.UnforkOptions) (chartindex.ChartMatch, error) {
+	if chartrepo.IsOCI(selected) {
+		repoURL, chartName, chartVersion, err := chartrepo.ParseOCIChart(selected)
+		if err != nil {
+			return chartindex.ChartMatch{}, errors.Wrap(err, "failed to parse upstream")
+		}
+
+		return chartindex.ChartMatch{
+			Repo:               path.Base(repoURL),
+			URI:                repoURL,
+			Name:               chartName,
+			ChartVersion:       chartVersion,
+			LatestChartVersion: chartVersion,
+			MatchQuality:       chartindex.MatchExact,
+		}, nil
+	}
+
+	mapping, err := chartindex.LoadMapping(viper.GetString("mapping-file"))
+	if err != nil {
+		return chartindex.ChartMatch{}, errors.Wrap(err, "failed to read mapping file")
+	}
+
+	upstreamMatches, err := unforker.UpstreamMatches(index, mapping, localChart)
+	if err != nil {
+		return chartindex.ChartMatch{}, errors.Wrap(err, "failed to find upstream")
+	}
+
+	if autoSelect && selected == "" && len(upstreamMatches) > 1 {
+		return autoSelectUpstream(localChart, upstreamMatches, unforkOptions)
+	}
+
+	return chooseUpstream(upstreamMatches, selected)
+}
+
+// autoSelectUpstream scores each of upstreamMatches, and returns the best
+func autoSelectUpstream(localChart *unforker.LocalChart, upstreamMatches []chartindex.ChartMatch, unforkOptions unforker.UnforkOptions) (chartindex.ChartMatch, error) {
+	fmt.Printf("Comparing %s with %d possible upstream helm charts\n", localChart.HelmName, len(upstreamMatches))
+
+	scores, err := unforker.ScoreUpstreams(context.Background(), localChart, upstreamMatches, unforkOptions)
+	if err != nil {
+		return chartindex.ChartMatch{}, errors.Wrap(err, "failed to score upstreams")
+	}
+
+	for _, score := range scores {
+		fmt.Printf("  %s/%s@%s (%s): %s\n", score.Match.Repo, score.Match.Name, score.Match.ChartVersion, score.Match.MatchDescription(), score.String())
+	}
+
+	if scores[0].Err != nil {
+		return chartindex.ChartMatch{}, errors.Wrap(scores[0].Err, "failed to compare with any of the possible upstreams")
+	}
+
+	return scores[0].Match, nil
+}
@@ -4,14 +4,15 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
 
 	ui "github.com/gizak/termui/v3"
 	"github.com/pkg/errors"
 	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
 	"github.com/replicatedhq/unfork/pkg/unforker"
+	"github.com/replicatedhq/unfork/pkg/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
@@ -42,43 +43,43 @@ them off of forks, back to upstream with kustomize patches.`,
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
-				dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+				index, err := ensureIndex()
 				if err != nil {
-					return errors.Cause(err)
-				}
-				indexFile := path.Join(dir, "charts.json")
-				fi, err := os.Stat(indexFile)
-				fetchIndex := false
-				if os.IsNotExist(err) {
-					fmt.Println("\nBuilding a local index of available Helm charts. This is needed to find the best upstream, and will only take a few seconds")
-					fetchIndex = true
-				} else if err != nil {
-					return err
-				} else {
-					isOld := time.Now().Sub(fi.ModTime())
-					if isOld > time.Hour*24*14 {
-						fmt.Println("\nYour local index of available Helm charts is out of date. Updating them, this will only take a few seconds")
-						fetchIndex = true
-					}
+					return errors.Wrap(err, "failed to update index")
 				}
 
-				if fetchIndex {
-					index := chartindex.ChartIndex{}
-					if err := index.Build(); err != nil {
-						return errors.Cause(err)
-					}
+				repoConfigs, err := repoConfigsFromFlags()
+				if err != nil {
+					return errors.Wrap(err, "failed to read repositories")
+				}
 
-					if err := index.Save(indexFile); err != nil {
-						return errors.Cause(err)
-					}
+				mapping, err := chartindex.LoadMapping(viper.GetString("mapping-file"))
+				if err != nil {
+					return errors.Wrap(err, "failed to read mapping file")
 				}
 
-				hasTiller, err := unforker.HasTiller(kubernetesConfigFlags)
+				tillerOptions := tillerOptionsFromFlags()
+				discoveryOptions := discoveryOptionsFromFlags()
+
+				hasTiller, err := unforker.HasTiller(kubernetesConfigFlags, tillerOptions)
 				if err != nil {
 					return errors.Wrap(err, "failed to connect to cluster looking for tiller")
 				}
-				if !hasTiller {
-					return errors.New("Unable to find a ready Tiller pod in the current cluster. Do you need to set a --kubeconfig?")
+				hasTillerStorage, err := unforker.HasTillerStorage(kubernetesConfigFlags, tillerOptions)
+				if err != nil {
+					return errors.Wrap(err, "failed to connect to cluster looking for tiller storage")
+				}
+				hasHelm3, err := unforker.HasHelm3Releases(kubernetesConfigFlags, discoveryOptions)
+				if err != nil {
+					return errors.Wrap(err, "failed to connect to cluster looking for helm 3 releases")
+				}
+				hasGitOps, err := unforker.HasGitOpsReleases(kubernetesConfigFlags)
+				if err != nil {
+					return errors.Wrap(err, "failed to connect to cluster looking for gitops releases")
+				}
+				// charts found from labels can't be checked for without listing everything
+				if !hasTiller && !hasTillerStorage && !hasHelm3 && !hasGitOps && !viper.GetBool("discover-labels") {
+					return errors.New("Unable to find a ready Tiller pod, any Helm 3 releases or any Flux or Argo CD releases in the current cluster. Do you need to set a --kubeconfig?")
 				}
 
 				if err := ui.Init(); err != nil {
@@ -88,7 +89,7 @@ them off of forks, back to upstream with kustomize patches.`,
 
 				uiCh := make(chan unforker.UIEvent)
 
-				u, err := unforker.NewUnforker(kubernetesConfigFlags, uiCh)
+				u, err := unforker.NewUnforker(kubernetesConfigFlags, tillerOptions, discoveryOptions, uiCh)
 				if err != nil {
 					return errors.Wrap(err, "failed to create unforker")
 				}
@@ -104,7 +105,12 @@ them off of forks, back to upstream with kustomize patches.`,
 				}()
 
 				unforkUI := UnforkUI{
-					home: createHome(uiCh),
+					home: createHome(uiCh, index, mapping, viper.GetString("mapping-file"), unforker.UnforkOptions{
+						Rerender:     viper.GetBool("rerender"),
+						CaptureDrift: viper.GetBool("capture-drift"),
+						ConfigFlags:  kubernetesConfigFlags,
+						RepoConfigs:  repoConfigs,
+					}),
 					uiCh: uiCh,
 				}
 
@@ -124,17 +130,356 @@ them off of forks, back to upstream with kustomize patches.`,
 	cobra.OnInitialize(initConfig)
 
 	kubernetesConfigFlags = genericclioptions.NewConfigFlags(false)
-	kubernetesConfigFlags.AddFlags(cmd.Flags())
+	kubernetesConfigFlags.AddFlags(cmd.PersistentFlags())
+
+	cmd.PersistentFlags().String("index-file", "", fmt.Sprintf("the chart index to use, and to update when it's older than --max-index-age ($UNFORK_INDEX) (default %q)", chartindex.DefaultIndexFile()))
+	cmd.PersistentFlags().Duration("max-index-age", 14*24*time.Hour, "rebuild the chart index when it's older than this, 0 never rebuilds it")
+	cmd.PersistentFlags().StringSlice("index-url", []string{}, "the url of a chart repository or its index.yaml to add to the chart index, can be a file:// path")
+	cmd.PersistentFlags().Int("index-workers", chartindex.DefaultBuildWorkers, "the number of chart repositories to index at the same time")
+	cmd.PersistentFlags().Int("fingerprint-versions", 0, "the number of the latest versions of each chart to download and fingerprint when indexing, to find the upstreams of renamed forks")
+	cmd.PersistentFlags().String("repository-config", chartindex.DefaultUnforkRepositoriesFile(), "the credentials, certificates and proxies for chart repositories, in the same format as the helm repositories file")
+	cmd.PersistentFlags().StringSlice("index-provider", []string{chartindex.SourceRepositories, chartindex.SourceArtifactHub}, "where to find the chart repositories to index, any of repositories, artifacthub and monocular")
+	cmd.PersistentFlags().String("mapping-file", chartindex.DefaultMappingFile, "the file that maps releases and charts to their upstreams, which is used before searching the index")
+	cmd.PersistentFlags().String("artifacthub-url", chartindex.DefaultArtifactHubURL, "the url of the artifact hub to index")
+	cmd.PersistentFlags().String("monocular-url", chartindex.DefaultMonocularURL, "the url of the monocular chartsvc api to index")
+
+	cmd.PersistentFlags().String("tiller-namespace", unforker.DefaultTillerNamespace, "the namespace tiller runs in ($TILLER_NAMESPACE)")
+	cmd.PersistentFlags().Bool("all-tiller-namespaces", false, "look for tillers in all namespaces")
+	cmd.PersistentFlags().String("tiller-selector", unforker.DefaultTillerSelector, "the label selector for tiller pods")
+	cmd.PersistentFlags().String("tiller-host", "", "the address of tiller, instead of port-forwarding to a tiller pod ($HELM_HOST)")
+	cmd.PersistentFlags().String("tiller-storage", unforker.TillerStorageConfigMap, "the storage driver tiller was started with (configmap or secret)")
+	cmd.PersistentFlags().Bool("read-tiller-storage", false, "read helm 2 releases directly from tiller's storage instead of connecting to tiller")
 
+	cmd.Flags().Bool("all-namespaces", false, "list releases in all namespaces, even if --namespace is set")
+	cmd.Flags().Bool("discover-labels", false, "also find charts that were installed without helm, such as with helm template, from the labels on their objects")
+	cmd.Flags().Duration("discovery-interval", unforker.DefaultDiscoveryInterval, "how often to look for new, upgraded and deleted releases")
+	cmd.Flags().Bool("rerender", false, "render forked charts again instead of using the manifest helm stored for the release")
+	cmd.Flags().Bool("capture-drift", false, "compare each release with the live cluster, and write changes made outside of helm to a separate drift downstream")
+
+	cmd.PersistentFlags().Bool("tls", false, "enable tls for the connection to tiller ($HELM_TLS_ENABLE)")
+	cmd.PersistentFlags().Bool("tls-verify", false, "enable tls for the connection to tiller and verify its certificate ($HELM_TLS_VERIFY)")
+	cmd.PersistentFlags().String("tls-ca-cert", "", "path to the ca certificate to verify tiller with (default \"$HELM_HOME/ca.pem\" if it exists)")
+	cmd.PersistentFlags().String("tls-cert", "", "path to the client certificate for tiller (default \"$HELM_HOME/cert.pem\" if it exists)")
+	cmd.PersistentFlags().String("tls-key", "", "path to the client key for tiller (default \"$HELM_HOME/key.pem\" if it exists)")
+	cmd.PersistentFlags().String("tls-hostname", "", "the server name used to verify the tiller certificate ($HELM_TLS_HOSTNAME)")
+
+	cmd.AddCommand(BlameCmd())
 	cmd.AddCommand(IndexCmd())
+	cmd.AddCommand(LocalCmd())
+	cmd.AddCommand(ReleaseCmd())
 	cmd.AddCommand(VersionCmd())
 
 	_ = viper.BindPFlags(cmd.Flags())
+	_ = viper.BindPFlags(cmd.PersistentFlags())
 
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+
+	_ = viper.BindEnv("index-file", "UNFORK_INDEX")
+
+	// honour the same environment as the helm 2 client
+	_ = viper.BindEnv("tiller-namespace", "TILLER_NAMESPACE")
+	_ = viper.BindEnv("tiller-host", "HELM_HOST")
+	_ = viper.BindEnv("tls", "HELM_TLS_ENABLE")
+	_ = viper.BindEnv("tls-verify", "HELM_TLS_VERIFY")
+	_ = viper.BindEnv("tls-ca-cert", "HELM_TLS_CA_CERT")
+	_ = viper.BindEnv("tls-cert", "HELM_TLS_CERT")
+	_ = viper.BindEnv("tls-key", "HELM_TLS_KEY")
+	_ = viper.BindEnv("tls-hostname", "HELM_TLS_HOSTNAME")
+
 	return cmd
 }
 
+func tillerOptionsFromFlags() unforker.TillerOptions {
+	v := viper.GetViper()
+
+	tillerOptions := unforker.TillerOptions{
+		Namespace:     v.GetString("tiller-namespace"),
+		AllNamespaces: v.GetBool("all-tiller-namespaces"),
+		Selector:      v.GetString("tiller-selector"),
+		Host:          v.GetString("tiller-host"),
+		Storage:       v.GetString("tiller-storage"),
+		ReadStorage:   v.GetBool("read-tiller-storage"),
+		TLSEnable:     v.GetBool("tls"),
+		TLSVerify:     v.GetBool("tls-verify"),
+		TLSCACert:     v.GetString("tls-ca-cert"),
+		TLSCert:       v.GetString("tls-cert"),
+		TLSKey:        v.GetString("tls-key"),
+		TLSHostname:   v.GetString("tls-hostname"),
+	}
+
+	// default to the certs that helm init --tiller-tls writes to the helm home, if they're there
+	helmHome := os.Getenv("HELM_HOME")
+	if helmHome == "" {
+		helmHome = path.Join(util.HomeDir(), ".helm")
+	}
+	tillerOptions.TLSCACert = helmHomeFile(tillerOptions.TLSCACert, helmHome, "ca.pem")
+	tillerOptions.TLSCert = helmHomeFile(tillerOptions.TLSCert, helmHome, "cert.pem")
+	tillerOptions.TLSKey = helmHomeFile(tillerOptions.TLSKey, helmHome, "key.pem")
+
+	return tillerOptions
+}
+
+// helmHomeFile returns filename if it's set, or the file with defaultName in the helm home if it exists
+func helmHomeFile(filename string, helmHome string, defaultName string) string {
+	if filename != "" {
+		return filename
+	}
+
+	defaultFilename := path.Join(helmHome, defaultName)
+	if _, err := os.Stat(defaultFilename); err != nil {
+		return ""
+	}
+	return defaultFilename
+}
+
+// discoveryOptionsFromFlags lists releases in the --namespace namespace, or in every namespace if it's not set
+func discoveryOptionsFromFlags() unforker.DiscoveryOptions {
+	discoveryOptions := unforker.DiscoveryOptions{
+		Interval:   viper.GetDuration("discovery-interval"),
+		FromLabels: viper.GetBool("discover-labels"),
+	}
+
+	if !viper.GetBool("all-namespaces") && kubernetesConfigFlags.Namespace != nil {
+		discoveryOptions.Namespace = *kubernetesConfigFlags.Namespace
+	}
+
+	return discoveryOptions
+}
+
+// indexFile is --index-file, or the default index in the user's cache dir
+func indexFile() string {
+	if indexFile := viper.GetString("index-file"); indexFile != "" {
+		return indexFile
+	}
+	return chartindex.DefaultIndexFile()
+}
+
+// ensureIndex builds the local chart index if it's missing, older than --max-index-age, or has fewer
+// fingerprinted versions than --fingerprint-versions, and loads it
+func ensureIndex() (*chartindex.ChartIndex, error) {
+	indexFile := indexFile()
+	maxIndexAge := viper.GetDuration("max-index-age")
+
+	fi, err := os.Stat(indexFile)
+	fetchIndex := false
+	if os.IsNotExist(err) {
+		fmt.Println("\nBuilding a local index of available Helm charts. This is needed to find the best upstream, and will only take a few seconds")
+		fetchIndex = true
+	} else if err != nil {
+		return nil, err
+	} else {
+		isOld := time.Now().Sub(fi.ModTime())
+		if maxIndexAge > 0 && isOld > maxIndexAge {
+			fmt.Println("\nYour local index of available Helm charts is out of date. Updating them, this will only take a few seconds")
+			fetchIndex = true
+		}
+	}
+
+	if !fetchIndex {
+		index, err := chartindex.LoadIndex(indexFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load index from %s", indexFile)
+		}
+
+		// the rebuild reuses the fingerprints that the index has, and only downloads the versions it's missing
+		if fingerprintVersions := viper.GetInt("fingerprint-versions"); fingerprintVersions > index.FingerprintVersions() {
+			fmt.Printf("\nFingerprinting the latest %d versions of each chart in your local index of available Helm charts\n", fingerprintVersions)
+			return buildIndex(indexFile)
+		}
+
+		// an --index-url that's new since the index was built can't wait for it to be rebuilt,
+		// so it's indexed on its own and added to the index
+		missingRepos, err := missingIndexURLs(index)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to check index urls")
+		}
+		if len(missingRepos) > 0 {
+			for _, missingRepo := range missingRepos {
+				fmt.Printf("\nAdding %s to your local index of available Helm charts, this will only take a few seconds\n", missingRepo.URL)
+			}
+			if err := addToIndex(indexFile, index, missingRepos, fi.ModTime()); err != nil {
+				return nil, err
+			}
+		}
+
+		// an --index-url that failed is reported instead of rebuilding the whole index to retry it
+		for _, failedRepo := range index.FailedRepos() {
+			if isIndexURL(failedRepo.URL) {
+				fmt.Printf("failed to index %s (%s): %s\n", failedRepo.Name, failedRepo.URL, failedRepo.Error)
+			}
+		}
+		return index, nil
+	}
+
+	return buildIndex(indexFile)
+}
+
+// buildIndex builds the chart index and saves it to indexFile. Repos that haven't changed since
+// the last index are reused from it. The build is saved to a partial index as it goes, and a
+// build that was interrupted is resumed from there
+func buildIndex(indexFile string) (*chartindex.ChartIndex, error) {
+	providers, err := indexProvidersFromFlags()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read index providers")
+	}
+
+	repoConfigs, err := repoConfigsFromFlags()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read repositories")
+	}
+
+	partialIndexFile := indexFile + ".partial"
+
+	var previous, resume *chartindex.ChartIndex
+	if lastIndex, err := chartindex.LoadIndex(indexFile); err == nil {
+		previous = lastIndex
+	}
+	if partialIndex, err := chartindex.LoadIndex(partialIndexFile); err == nil {
+		fmt.Println("Resuming the last build of your local index of available Helm charts")
+		resume = partialIndex
+	}
+
+	index := chartindex.ChartIndex{}
+	err = index.Build(chartindex.BuildOptions{
+		RepoConfigs:         repoConfigs,
+		Providers:           providers,
+		Previous:            previous,
+		Resume:              resume,
+		Workers:             viper.GetInt("index-workers"),
+		FingerprintVersions: viper.GetInt("fingerprint-versions"),
+		Checkpoint: func(partialIndex *chartindex.ChartIndex) error {
+			return partialIndex.Save(partialIndexFile)
+		},
+	})
+	if err != nil {
+		return nil, errors.Cause(err)
+	}
+	for _, providerErr := range index.ProviderErrors() {
+		fmt.Printf("%s\n", providerErr.Error())
+	}
+
+	if err := index.Save(indexFile); err != nil {
+		return nil, errors.Wrapf(err, "failed to save index to %s", indexFile)
+	}
+	if err := os.Remove(partialIndexFile); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove partial index")
+	}
+
+	return &index, nil
+}
+
+// addToIndex indexes repositories, adds them to index and saves it to indexFile. The index keeps
+// modTime, so that it's still rebuilt when the rest of it is out of date
+func addToIndex(indexFile string, index *chartindex.ChartIndex, repositories []chartindex.Repository, modTime time.Time) error {
+	repoConfigs, err := repoConfigsFromFlags()
+	if err != nil {
+		return errors.Wrap(err, "failed to read repositories")
+	}
+
+	err = index.AddRepositories(repositories, chartindex.BuildOptions{
+		RepoConfigs:         repoConfigs,
+		Workers:             viper.GetInt("index-workers"),
+		FingerprintVersions: viper.GetInt("fingerprint-versions"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to index repositories")
+	}
+
+	if err := index.Save(indexFile); err != nil {
+		return errors.Wrapf(err, "failed to save index to %s", indexFile)
+	}
+	if err := os.Chtimes(indexFile, time.Now(), modTime); err != nil {
+		return errors.Wrapf(err, "failed to keep the age of %s", indexFile)
+	}
+
+	return nil
+}
+
+// indexProvidersFromFlags returns the --index-provider providers, in order. --index-url
+// repositories are always indexed, even if the repositories provider isn't selected
+func indexProvidersFromFlags() ([]chartindex.Provider, error) {
+	repositoriesProvider := chartindex.RepositoriesProvider{
+		IndexURLs: viper.GetStringSlice("index-url"),
+	}
+
+	providers := []chartindex.Provider{}
+	hasRepositoriesProvider := false
+	for _, name := range viper.GetStringSlice("index-provider") {
+		switch name {
+		case chartindex.SourceRepositories:
+			repositoriesProvider.UnforkRepositoriesFile = viper.GetString("repository-config")
+			repositoriesProvider.Helm2RepositoriesFile = chartindex.DefaultHelm2RepositoriesFile()
+			repositoriesProvider.Helm3RepositoriesFile = chartindex.DefaultHelm3RepositoriesFile()
+			providers = append(providers, repositoriesProvider)
+			hasRepositoriesProvider = true
+		case chartindex.SourceArtifactHub:
+			providers = append(providers, chartindex.ArtifactHubProvider{URL: viper.GetString("artifacthub-url")})
+		case chartindex.SourceMonocular:
+			providers = append(providers, chartindex.MonocularProvider{URL: viper.GetString("monocular-url")})
+		default:
+			return nil, errors.Errorf("unknown index provider %q", name)
+		}
+	}
+
+	if !hasRepositoriesProvider && len(repositoriesProvider.IndexURLs) > 0 {
+		providers = append([]chartindex.Provider{repositoriesProvider}, providers...)
+	}
+
+	return providers, nil
+}
+
+// repoConfigsFromFlags reads how to connect to chart repositories from --repository-config,
+// and then from the repositories files of helm 3 and helm 2
+func repoConfigsFromFlags() (chartrepo.Configs, error) {
+	repoConfigs := chartrepo.Configs{}
+
+	for _, repositoriesFile := range []string{
+		viper.GetString("repository-config"),
+		chartindex.DefaultHelm3RepositoriesFile(),
+		chartindex.DefaultHelm2RepositoriesFile(),
+	} {
+		fileConfigs, err := chartrepo.LoadFile(repositoriesFile)
+		if err != nil {
+			return nil, err
+		}
+		repoConfigs = append(repoConfigs, fileConfigs...)
+	}
+
+	return repoConfigs, nil
+}
+
+// missingIndexURLs returns the --index-url repositories that aren't in the index
+func missingIndexURLs(index *chartindex.ChartIndex) ([]chartindex.Repository, error) {
+	repositories, err := chartindex.RepositoriesProvider{IndexURLs: viper.GetStringSlice("index-url")}.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []chartindex.Repository{}
+	for _, repository := range repositories {
+		if !index.HasRepo(repository.URL) {
+			missing = append(missing, repository)
+		}
+	}
+
+	return missing, nil
+}
+
+// isIndexURL returns true if repoURL is one of the --index-url repositories
+func isIndexURL(repoURL string) bool {
+	repositories, err := chartindex.RepositoriesProvider{IndexURLs: viper.GetStringSlice("index-url")}.Repositories()
+	if err != nil {
+		return false
+	}
+
+	for _, repository := range repositories {
+		if repository.URL == repoURL {
+			return true
+		}
+	}
+	return false
+}
+
 func InitAndExecute() {
 	if err := RootCmd().Execute(); err != nil {
 		fmt.Println(err)
@@ -157,19 +502,29 @@ func (u *UnforkUI) render() error {
 	return nil
 }
 
+// eventLoop handles key presses and the releases that discovery finds in one goroutine, so that
+// the ui state is never changed or drawn concurrently
 func (u *UnforkUI) eventLoop() error {
-	for e := range ui.PollEvents() {
-		if currentPage == "home" {
-			exit, err := u.home.handleEvent(e)
-			if err != nil {
-				return errors.Wrap(err, "failed to handle event")
-			}
-			if exit {
+	uiEvents := ui.PollEvents()
+	for {
+		select {
+		case e, ok := <-uiEvents:
+			if !ok {
 				return nil
 			}
-			continue
+			if currentPage == "home" {
+				exit, err := u.home.handleEvent(e)
+				if err != nil {
+					return errors.Wrap(err, "failed to handle event")
+				}
+				if exit {
+					return nil
+				}
+			}
+		case uiEvent := <-u.uiCh:
+			if currentPage == "home" {
+				u.home.handleUIEvent(uiEvent)
+			}
 		}
 	}
-
-	return nil
 }
@@ -10,6 +10,7 @@ require (
 	github.com/chzyer/logex v1.1.11-0.20160617073814-96a4d311aa9b // indirect
 	github.com/ghodss/yaml v1.0.0
 	github.com/gizak/termui/v3 v3.1.0
+	github.com/golang/protobuf v1.3.1
 	github.com/google/go-github/v28 v28.1.1
 	github.com/gregjones/httpcache v0.0.0-20190611155906-901d90724c79 // indirect
 	github.com/pkg/errors v0.8.1
@@ -18,6 +19,7 @@ require (
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.3.0
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	google.golang.org/grpc v1.21.0
 	gopkg.in/yaml.v2 v2.2.2
 	k8s.io/api v0.0.0-20190516230258-a675ac48af67
 	k8s.io/apimachinery v0.0.0-20190404173353-6a84e37a896d
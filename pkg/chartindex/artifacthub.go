@@ -0,0 +1,111 @@
+package chartindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultArtifactHubURL = "https://artifacthub.io"
+
+	// artifactHubHelmKind is the kind of the repositories that serve helm charts
+	artifactHubHelmKind = 0
+)
+
+var (
+	artifactHubPageSize = 60
+)
+
+type ArtifactHubRepository struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Kind int    `json:"kind"`
+}
+
+// ArtifactHubProvider lists the helm chart repositories in the Artifact Hub packages API
+type ArtifactHubProvider struct {
+	URL string
+}
+
+func (p ArtifactHubProvider) Name() string {
+	return SourceArtifactHub
+}
+
+func (p ArtifactHubProvider) Repositories() ([]Repository, error) {
+	baseURL := p.URL
+	if baseURL == "" {
+		baseURL = DefaultArtifactHubURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	repositories := []Repository{}
+
+	offset := 0
+
+	for {
+		artifactHubRepositories, totalCount, err := getArtifactHubPage(baseURL, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, artifactHubRepository := range artifactHubRepositories {
+			if artifactHubRepository.Kind != artifactHubHelmKind {
+				continue
+			}
+			// an oci repository on artifact hub is usually a single chart, which is indexed by its tags
+			repositories = append(repositories, Repository{
+				Name:   artifactHubRepository.Name,
+				URL:    strings.TrimSuffix(artifactHubRepository.URL, "/"),
+				Source: SourceArtifactHub,
+			})
+		}
+
+		offset += len(artifactHubRepositories)
+
+		if len(artifactHubRepositories) < artifactHubPageSize {
+			break
+		}
+		if totalCount >= 0 && offset >= totalCount {
+			break
+		}
+	}
+
+	return repositories, nil
+}
+
+// getArtifactHubPage returns a page of repositories, and the total number of repositories or -1
+// if the response didn't say
+func getArtifactHubPage(baseURL string, offset int) ([]ArtifactHubRepository, int, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/repositories/search?kind=%d&limit=%d&offset=%d", baseURL, artifactHubHelmKind, artifactHubPageSize, offset))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	artifactHubRepositories := []ArtifactHubRepository{}
+	if err := json.Unmarshal(body, &artifactHubRepositories); err != nil {
+		return nil, 0, err
+	}
+
+	totalCount, err := strconv.Atoi(resp.Header.Get("Pagination-Total-Count"))
+	if err != nil {
+		totalCount = -1
+	}
+
+	return artifactHubRepositories, totalCount, nil
+}
@@ -0,0 +1,281 @@
+package chartindex
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MovedChart is a chart in a deprecated repo, and the repo where it's maintained now
+type MovedChart struct {
+	RepoURL      string `json:"repoURL"`
+	Name         string `json:"name"`
+	MovedToURL   string `json:"movedToURL"`
+	MovedToChart string `json:"movedToChart,omitempty"` // defaults to the same name
+}
+
+var (
+	stableRepoURLs = []string{
+		"https://kubernetes-charts.storage.googleapis.com",
+		"https://charts.helm.sh/stable",
+	}
+	incubatorRepoURLs = []string{
+		"https://kubernetes-charts-incubator.storage.googleapis.com",
+		"https://charts.helm.sh/incubator",
+	}
+
+	// DeprecatedRepoURLs are repos that are no longer maintained, so none of their charts are
+	DeprecatedRepoURLs = append(append([]string{}, stableRepoURLs...), incubatorRepoURLs...)
+
+	// DefaultMovedCharts are where charts from the stable and incubator repos are maintained now
+	DefaultMovedCharts = movedCharts([]string{
+		"stable/consul https://helm.releases.hashicorp.com",
+		"stable/elasticsearch https://helm.elastic.co",
+		"stable/external-dns https://charts.bitnami.com/bitnami",
+		"stable/fluent-bit https://fluent.github.io/helm-charts",
+		"stable/grafana https://grafana.github.io/helm-charts",
+		"stable/jenkins https://charts.jenkins.io",
+		"stable/kibana https://helm.elastic.co",
+		"stable/kube-state-metrics https://prometheus-community.github.io/helm-charts",
+		"stable/mariadb https://charts.bitnami.com/bitnami",
+		"stable/memcached https://charts.bitnami.com/bitnami",
+		"stable/metrics-server https://kubernetes-sigs.github.io/metrics-server",
+		"stable/mongodb https://charts.bitnami.com/bitnami",
+		"stable/mysql https://charts.bitnami.com/bitnami",
+		"stable/nginx-ingress https://kubernetes.github.io/ingress-nginx ingress-nginx",
+		"stable/postgresql https://charts.bitnami.com/bitnami",
+		"stable/prometheus https://prometheus-community.github.io/helm-charts",
+		"stable/prometheus-operator https://prometheus-community.github.io/helm-charts kube-prometheus-stack",
+		"stable/rabbitmq https://charts.bitnami.com/bitnami",
+		"stable/redis https://charts.bitnami.com/bitnami",
+		"stable/traefik https://helm.traefik.io/traefik",
+		"stable/wordpress https://charts.bitnami.com/bitnami",
+		"incubator/kafka https://charts.bitnami.com/bitnami",
+		"incubator/zookeeper https://charts.bitnami.com/bitnami",
+	})
+)
+
+// movedCharts parses "repo/chart url [new-name]" lines, with the new name of charts that were
+// renamed. Each chart is listed for every url of its repo
+func movedCharts(lines []string) []MovedChart {
+	moved := []MovedChart{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		repoName, chartName := path.Split(fields[0])
+		movedToChart := ""
+		if len(fields) > 2 {
+			movedToChart = fields[2]
+		}
+
+		repoURLs := stableRepoURLs
+		if repoName == "incubator/" {
+			repoURLs = incubatorRepoURLs
+		}
+		for _, repoURL := range repoURLs {
+			moved = append(moved, MovedChart{
+				RepoURL:      repoURL,
+				Name:         chartName,
+				MovedToURL:   fields[1],
+				MovedToChart: movedToChart,
+			})
+		}
+	}
+	return moved
+}
+
+// Canonicalize collapses matches of the same chart archive in different repos, found by their digest,
+// into one match in a maintained repo with the others as its mirrors. Matches from deprecated repos,
+// or of deprecated versions, are flagged, and charts that have moved point to their successor. A
+// successor that's in the index is added to the matches after them, so that it can be chosen instead
+func (i *ChartIndex) Canonicalize(matches []ChartMatch, moved []MovedChart) []ChartMatch {
+	charts := i.chartsByRepo()
+
+	canonical := []ChartMatch{}
+	byDigest := map[string]int{}
+	for _, match := range matches {
+		digest, deprecated := charts.versionDigest(match)
+		match.Deprecated = match.Deprecated || deprecated
+
+		if n, ok := byDigest[digest]; ok && digest != "" {
+			// the first match keeps its place and quality, from the repo that's best to unfork from.
+			// Mirrors are copied, because matches share them with the caller
+			existing := canonical[n]
+			if charts.preferRepo(match, existing) {
+				match.MatchQuality, match.Similarity = existing.MatchQuality, existing.Similarity
+				match.Mirrors = append(append([]string{}, existing.Mirrors...), existing.URI)
+				match.Deprecated = existing.Deprecated && match.Deprecated
+				canonical[n] = match
+			} else {
+				existing.Mirrors = append(append([]string{}, existing.Mirrors...), match.URI)
+				existing.Deprecated = existing.Deprecated && match.Deprecated
+				canonical[n] = existing
+			}
+			continue
+		}
+
+		byDigest[digest] = len(canonical)
+		canonical = append(canonical, match)
+	}
+
+	found := map[string]bool{}
+	for _, match := range canonical {
+		found[match.URI+"/"+match.Name+"@"+match.ChartVersion] = true
+	}
+
+	successors := []ChartMatch{}
+	for n := range canonical {
+		canonical[n].Successor = charts.successor(canonical[n], moved)
+		if canonical[n].Successor == nil {
+			continue
+		}
+		canonical[n].Deprecated = true
+
+		successor := *canonical[n].Successor
+		key := successor.URI + "/" + successor.Name + "@" + successor.ChartVersion
+		if successor.ChartVersion != "" && !found[key] {
+			successors = append(successors, successor)
+			found[key] = true
+		}
+	}
+
+	return append(canonical, successors...)
+}
+
+// chartLookup is the charts in an index by repo url and name, so that matches are looked up
+// without scanning the index for each
+type chartLookup map[string]ChartAndVersions
+
+func (i *ChartIndex) chartsByRepo() chartLookup {
+	charts := chartLookup{}
+	if i == nil {
+		return charts
+	}
+	for _, indexChart := range i.charts {
+		key := indexChart.URI + "/" + indexChart.Name
+		if _, ok := charts[key]; !ok {
+			charts[key] = indexChart
+		}
+	}
+	return charts
+}
+
+func (c chartLookup) find(repoURL string, chartName string) (ChartAndVersions, bool) {
+	indexChart, ok := c[repoURL+"/"+chartName]
+	return indexChart, ok
+}
+
+// versionDigest returns the digest of the matched version, and if it or its repo is deprecated
+func (c chartLookup) versionDigest(match ChartMatch) (string, bool) {
+	deprecated := isDeprecatedRepo(match.URI)
+	if match.Path != "" {
+		return "", deprecated
+	}
+
+	indexChart, ok := c.find(match.URI, match.Name)
+	if !ok {
+		return "", deprecated
+	}
+	for _, version := range indexChart.Versions {
+		if version.ChartVersion == match.ChartVersion {
+			return version.Digest, deprecated || version.Deprecated
+		}
+	}
+
+	return "", deprecated
+}
+
+// preferRepo returns true if a is a better repo than b to unfork a mirrored chart from. Repos that
+// aren't deprecated are better, then those with more versions of the chart
+func (c chartLookup) preferRepo(a ChartMatch, b ChartMatch) bool {
+	if isDeprecatedRepo(a.URI) != isDeprecatedRepo(b.URI) {
+		return !isDeprecatedRepo(a.URI)
+	}
+	return c.countVersions(a.URI, a.Name) > c.countVersions(b.URI, b.Name)
+}
+
+func (c chartLookup) countVersions(repoURL string, chartName string) int {
+	indexChart, _ := c.find(repoURL, chartName)
+	return len(indexChart.Versions)
+}
+
+// successor returns the chart that the match, or one of its mirrors, moved to. Its version is the
+// latest with the same app version, or the latest version if there isn't one
+func (c chartLookup) successor(match ChartMatch, moved []MovedChart) *ChartMatch {
+	var movedChart *MovedChart
+	for _, repoURL := range append([]string{match.URI}, match.Mirrors...) {
+		for n := range moved {
+			if strings.TrimSuffix(moved[n].RepoURL, "/") == repoURL && moved[n].Name == match.Name {
+				movedChart = &moved[n]
+				break
+			}
+		}
+		if movedChart != nil {
+			break
+		}
+	}
+	if movedChart == nil {
+		return nil
+	}
+
+	successor := ChartMatch{
+		Repo:         path.Base(strings.TrimSuffix(movedChart.MovedToURL, "/")),
+		URI:          strings.TrimSuffix(movedChart.MovedToURL, "/"),
+		Name:         movedChart.MovedToChart,
+		MatchQuality: MatchSuccessor,
+	}
+	if successor.Name == "" {
+		successor.Name = match.Name
+	}
+
+	indexChart, ok := c.find(successor.URI, successor.Name)
+	if !ok {
+		return &successor
+	}
+
+	successor.Repo = indexChart.Repo
+	successor.LatestChartVersion, successor.LatestAppVersion = latestVersion(indexChart.Versions)
+	successor.ChartVersion, successor.AppVersion = successor.LatestChartVersion, successor.LatestAppVersion
+
+	sameAppVersion := []ChartVersion{}
+	for _, version := range indexChart.Versions {
+		if version.AppVersion == match.AppVersion {
+			sameAppVersion = append(sameAppVersion, version)
+		}
+	}
+	if chartVersion, appVersion := latestVersion(sameAppVersion); chartVersion != "" {
+		successor.ChartVersion, successor.AppVersion = chartVersion, appVersion
+	}
+	for _, version := range indexChart.Versions {
+		if version.ChartVersion == successor.ChartVersion {
+			successor.ChartURL = version.URL
+		}
+	}
+
+	return &successor
+}
+
+func isDeprecatedRepo(repoURL string) bool {
+	for _, deprecatedRepoURL := range DeprecatedRepoURLs {
+		if strings.TrimSuffix(repoURL, "/") == deprecatedRepoURL {
+			return true
+		}
+	}
+	return false
+}
+
+// notes describes the deprecation, successor and mirrors of a match, or is empty if it has none
+func (m ChartMatch) notes() string {
+	notes := []string{}
+	if m.Deprecated {
+		notes = append(notes, "deprecated")
+	}
+	if m.Successor != nil {
+		notes = append(notes, fmt.Sprintf("moved to %s/%s", m.Successor.Repo, m.Successor.Name))
+	}
+	if len(m.Mirrors) == 1 {
+		notes = append(notes, "1 mirror")
+	} else if len(m.Mirrors) > 1 {
+		notes = append(notes, fmt.Sprintf("%d mirrors", len(m.Mirrors)))
+	}
+	return strings.Join(notes, ", ")
+}
@@ -0,0 +1,163 @@
+package chartindex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Canonicalize(t *testing.T) {
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "stable",
+				Name: "redis",
+				URI:  "https://kubernetes-charts.storage.googleapis.com",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7", Digest: "aaa"},
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7", Digest: "bbb"},
+				},
+			},
+			{
+				Repo: "mirror",
+				Name: "redis",
+				URI:  "https://charts.example.com/mirror",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7", Digest: "aaa"},
+				},
+			},
+			{
+				Repo: "cache",
+				Name: "redis",
+				URI:  "https://charts.example.com/cache",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7", Digest: "aaa"},
+					{ChartVersion: "10.5.5", AppVersion: "5.0.6", Digest: "ccc"},
+				},
+			},
+			{
+				Repo: "bitnami",
+				Name: "redis",
+				URI:  "https://charts.bitnami.com/bitnami",
+				Versions: []ChartVersion{
+					{ChartVersion: "11.0.0", AppVersion: "6.0.0"},
+					{ChartVersion: "10.6.2", AppVersion: "5.0.7"},
+					{ChartVersion: "10.6.1", AppVersion: "5.0.7"},
+				},
+			},
+			{
+				Repo: "internal",
+				Name: "memcached",
+				URI:  "https://charts.example.com/internal",
+				Versions: []ChartVersion{
+					{ChartVersion: "3.2.3", AppVersion: "1.5.20", Deprecated: true},
+				},
+			},
+		},
+	}
+
+	bitnamiRedis := &ChartMatch{
+		Repo:               "bitnami",
+		URI:                "https://charts.bitnami.com/bitnami",
+		Name:               "redis",
+		ChartVersion:       "10.6.2",
+		AppVersion:         "5.0.7",
+		LatestChartVersion: "11.0.0",
+		LatestAppVersion:   "6.0.0",
+		MatchQuality:       MatchSuccessor,
+	}
+
+	tests := []struct {
+		name     string
+		matches  []ChartMatch
+		moved    []MovedChart
+		expected []ChartMatch
+	}{
+		{
+			name: "mirrors collapse into the repo with the most versions that isn't deprecated",
+			matches: []ChartMatch{
+				{Repo: "stable", URI: "https://kubernetes-charts.storage.googleapis.com", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", MatchQuality: MatchExact},
+				{Repo: "mirror", URI: "https://charts.example.com/mirror", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", MatchQuality: MatchExact},
+				{Repo: "stable", URI: "https://kubernetes-charts.storage.googleapis.com", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "cache", URI: "https://charts.example.com/cache", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", MatchQuality: MatchExact},
+			},
+			moved: DefaultMovedCharts,
+			expected: []ChartMatch{
+				{
+					Repo: "cache", URI: "https://charts.example.com/cache", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", MatchQuality: MatchExact,
+					Deprecated: true,
+					Successor:  bitnamiRedis,
+					Mirrors:    []string{"https://kubernetes-charts.storage.googleapis.com", "https://charts.example.com/mirror"},
+				},
+				{
+					Repo: "stable", URI: "https://kubernetes-charts.storage.googleapis.com", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.7", MatchQuality: MatchNearest,
+					Deprecated: true,
+					Successor:  bitnamiRedis,
+				},
+				// the successor can be chosen as the upstream
+				*bitnamiRedis,
+			},
+		},
+		{
+			name: "deprecated versions, and charts moved in the mapping file",
+			matches: []ChartMatch{
+				{Repo: "internal", URI: "https://charts.example.com/internal", Name: "memcached", ChartVersion: "3.2.3", MatchQuality: MatchChartVersion},
+				{Repo: "cache", URI: "https://charts.example.com/cache", Name: "redis", ChartVersion: "10.5.5", MatchQuality: MatchNearest},
+			},
+			moved: []MovedChart{
+				{RepoURL: "https://charts.example.com/cache/", Name: "redis", MovedToURL: "https://charts.example.com/redis", MovedToChart: "redis-ha"},
+			},
+			expected: []ChartMatch{
+				{Repo: "internal", URI: "https://charts.example.com/internal", Name: "memcached", ChartVersion: "3.2.3", MatchQuality: MatchChartVersion, Deprecated: true},
+				{
+					Repo: "cache", URI: "https://charts.example.com/cache", Name: "redis", ChartVersion: "10.5.5", MatchQuality: MatchNearest,
+					Deprecated: true,
+					Successor:  &ChartMatch{Repo: "redis", URI: "https://charts.example.com/redis", Name: "redis-ha", MatchQuality: MatchSuccessor},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := index.Canonicalize(test.matches, test.moved)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_CanonicalizeKeepsMatchMirrors(t *testing.T) {
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{Repo: "a", URI: "https://charts.example.com/a", Name: "redis", Versions: []ChartVersion{{ChartVersion: "1.0.0", Digest: "sha256:1"}}},
+			{Repo: "b", URI: "https://charts.example.com/b", Name: "redis", Versions: []ChartVersion{{ChartVersion: "1.0.0", Digest: "sha256:1"}}},
+		},
+	}
+
+	mirrors := make([]string, 1, 4)
+	mirrors[0] = "https://charts.example.com/c"
+	matches := []ChartMatch{
+		{Repo: "a", URI: "https://charts.example.com/a", Name: "redis", ChartVersion: "1.0.0", Mirrors: mirrors},
+		{Repo: "b", URI: "https://charts.example.com/b", Name: "redis", ChartVersion: "1.0.0"},
+	}
+
+	canonical := index.Canonicalize(matches, nil)
+	require.Len(t, canonical, 1)
+	assert.Equal(t, []string{"https://charts.example.com/c", "https://charts.example.com/b"}, canonical[0].Mirrors)
+	assert.Equal(t, []string{"https://charts.example.com/c"}, matches[0].Mirrors)
+	assert.Equal(t, "https://charts.example.com/c", mirrors[:2][0])
+	assert.Equal(t, "", mirrors[:2][1])
+}
+
+func Test_MatchDescription(t *testing.T) {
+	match := ChartMatch{
+		MatchQuality: MatchExact,
+		Deprecated:   true,
+		Successor:    &ChartMatch{Repo: "bitnami", Name: "redis"},
+		Mirrors:      []string{"https://charts.example.com/mirror", "https://charts.example.com/cache"},
+	}
+	assert.Equal(t, "exact, deprecated, moved to bitnami/redis, 2 mirrors", match.MatchDescription())
+
+	assert.Equal(t, "content 68%", ChartMatch{MatchQuality: MatchContent, Similarity: 0.68}.MatchDescription())
+}
@@ -1,47 +1,158 @@
 package chartindex
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/replicatedhq/unfork/pkg/util"
 )
 
 type ChartIndex struct {
-	charts []ChartAndVersions
+	charts        []ChartAndVersions
+	repos         []RepoRecord
+	startedAt     time.Time
+	complete      bool
+	formatVersion int
+
+	// fingerprintVersions is the number of the latest versions of each chart that were fingerprinted
+	fingerprintVersions int
+
+	// providerErrors are the providers that failed to list repositories in the last build. They
+	// aren't saved, because the build is only retried when the index is out of date
+	providerErrors []error
+}
+
+// indexFormatVersion is increased when more is saved for each chart version. Repos in an
+// index with an older format are downloaded again, even if they haven't changed
+const indexFormatVersion = 2
+
+// RepoRecord is the result of indexing a repo. The validators of its index.yaml are kept so
+// that it's only downloaded again if it's changed, and a repo that couldn't be indexed has an error
+type RepoRecord struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Source       string    `json:"source,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	IndexedAt    time.Time `json:"indexedAt"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// savedIndex is the format of the index file. An index that isn't complete was saved part way
+// through a build, and can be used to resume it
+type savedIndex struct {
+	Charts    []ChartAndVersions `json:"charts"`
+	Repos     []RepoRecord       `json:"repos"`
+	StartedAt time.Time          `json:"startedAt"`
+	Complete  bool               `json:"complete"`
+	Version   int                `json:"version,omitempty"`
+
+	FingerprintVersions int `json:"fingerprintVersions,omitempty"`
 }
 
 type ChartAndVersions struct {
 	Repo     string         `json:"repo"`
 	Name     string         `json:"name"`
 	URI      string         `json:"uri"`
+	Source   string         `json:"source,omitempty"` // the provider or repositories file that listed the repo
 	Versions []ChartVersion `json:"versions"`
-	Keywords []string       `json:"keywords"`
 }
 
 type ChartVersion struct {
-	ChartVersion string `json:"chartVersion"`
-	AppVersion   string `json:"appVersion"`
+	ChartVersion string       `json:"chartVersion"`
+	AppVersion   string       `json:"appVersion"`
+	Digest       string       `json:"digest,omitempty"` // the sha256 of the chart archive, which mirrors have the same
+	Deprecated   bool         `json:"deprecated,omitempty"`
+	URL          string       `json:"url,omitempty"`         // where to download charts in oci registries from
+	Fingerprint  *Fingerprint `json:"fingerprint,omitempty"` // only the latest versions are fingerprinted
+}
+
+// DefaultIndexFile is in the user's cache dir. The directory that unfork is installed
+// in is often read only, and shared by every user
+func DefaultIndexFile() string {
+	return filepath.Join(util.CacheDir(), "unfork", "charts.json")
 }
 
-func loadIndex() (*ChartIndex, error) {
+// LoadIndex reads an index that was written by Save
+func LoadIndex(indexFile string) (*ChartIndex, error) {
 	index := ChartIndex{}
 
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	b, err := ioutil.ReadFile(indexFile)
 	if err != nil {
 		return nil, err
 	}
 
-	indexFile := filepath.Join(dir, "charts.json")
-
-	b, err := ioutil.ReadFile(indexFile)
-	if err != nil {
-		return nil, err
+	// indexes were a list of charts before repos were recorded
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(b, &index.charts); err != nil {
+			return nil, err
+		}
+		index.complete = true
+		return &index, nil
 	}
 
-	if err := json.Unmarshal(b, &index.charts); err != nil {
+	saved := savedIndex{}
+	if err := json.Unmarshal(b, &saved); err != nil {
 		return nil, err
 	}
+	index.charts = saved.Charts
+	index.repos = saved.Repos
+	index.startedAt = saved.StartedAt
+	index.complete = saved.Complete
+	index.formatVersion = saved.Version
+	index.fingerprintVersions = saved.FingerprintVersions
 
 	return &index, nil
 }
+
+// Complete returns false if the index was saved part way through a build
+func (i *ChartIndex) Complete() bool {
+	return i.complete
+}
+
+// FingerprintVersions returns the number of the latest versions of each chart that were
+// fingerprinted when the index was built
+func (i *ChartIndex) FingerprintVersions() int {
+	return i.fingerprintVersions
+}
+
+// ProviderErrors returns the errors of the providers that couldn't list their repositories when
+// the index was built
+func (i *ChartIndex) ProviderErrors() []error {
+	return i.providerErrors
+}
+
+// FailedRepos returns the repos that couldn't be indexed
+func (i *ChartIndex) FailedRepos() []RepoRecord {
+	failedRepos := []RepoRecord{}
+	for _, repo := range i.repos {
+		if repo.Error != "" {
+			failedRepos = append(failedRepos, repo)
+		}
+	}
+	return failedRepos
+}
+
+// repo returns the record of the repo at repoURL and its charts, or nil if it's not in the index
+func (i *ChartIndex) repo(repoURL string) (*RepoRecord, []ChartAndVersions) {
+	for _, repo := range i.repos {
+		if repo.URL != repoURL {
+			continue
+		}
+
+		charts := []ChartAndVersions{}
+		for _, chart := range i.charts {
+			if chart.URI == repoURL {
+				charts = append(charts, chart)
+			}
+		}
+
+		repo := repo
+		return &repo, charts
+	}
+
+	return nil, nil
+}
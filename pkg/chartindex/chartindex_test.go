@@ -0,0 +1,44 @@
+package chartindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SaveAndLoadIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chartindex")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "stable",
+				Name: "redis",
+				URI:  "https://kubernetes-charts.storage.googleapis.com",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7"},
+				},
+			},
+		},
+		fingerprintVersions: 2,
+	}
+
+	// the directory doesn't exist yet
+	indexFile := filepath.Join(dir, "unfork", "charts.json")
+	require.NoError(t, index.Save(indexFile))
+
+	loaded, err := LoadIndex(indexFile)
+	require.NoError(t, err)
+	assert.Equal(t, index.charts, loaded.charts)
+	assert.Equal(t, 2, loaded.FingerprintVersions())
+
+	files, err := ioutil.ReadDir(filepath.Dir(indexFile))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -3,180 +3,490 @@ package chartindex
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ahmetalpbalkan/go-cursor"
-	"k8s.io/helm/cmd/helm/search"
-	"k8s.io/helm/pkg/getter"
-	"k8s.io/helm/pkg/helm/environment"
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/replicatedhq/unfork/pkg/util"
 	"k8s.io/helm/pkg/repo"
 )
 
-var (
-	kubeAppsPageSize = 100
-)
-
+// Save writes the index to filename, creating its directory. The index is replaced
+// in one step, so that other unfork processes never read a partial index
 func (i *ChartIndex) Save(filename string) error {
-	b, err := json.Marshal(i.charts)
+	b, err := json.Marshal(savedIndex{
+		Charts:    i.charts,
+		Repos:     i.repos,
+		StartedAt: i.startedAt,
+		Complete:  i.complete,
+		Version:   i.formatVersion,
+
+		FingerprintVersions: i.fingerprintVersions,
+	})
 	if err != nil {
 		return err
 	}
 
-	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
 		return err
 	}
 
-	return nil
+	return util.WriteFileAtomic(filename, b, 0644)
 }
 
-func (i *ChartIndex) Build() error {
-	charts := []MonocularChartData{}
+// BuildOptions are where to find the repositories to index, and how to index them
+type BuildOptions struct {
+	// RepoConfigs are the credentials and tls settings used to connect to repositories
+	RepoConfigs chartrepo.Configs
+	Providers   []Provider
 
-	currentPage := 1
+	// Previous is the last complete index. Repos whose index.yaml hasn't changed since
+	// are reused from it
+	Previous *ChartIndex
 
-	for {
-		resp, err := http.Get(fmt.Sprintf("https://hub.kubeapps.com/api/chartsvc/v1/charts?size=%d&page=%d", kubeAppsPageSize, currentPage))
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+	// Resume is the partial index of a build that was interrupted. The repos it indexed
+	// are reused as they are, and the rest are indexed with Previous
+	Resume *ChartIndex
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+	// Workers is the number of repos that are indexed at the same time
+	Workers int
 
-		monocularResponse := MonocularResponse{}
-		if err := json.Unmarshal(body, &monocularResponse); err != nil {
-			return err
-		}
+	// HostInterval is the least time between requests to the same host
+	HostInterval time.Duration
 
-		if currentPage > monocularResponse.Meta.TotalPages {
-			break
-		}
+	// FingerprintVersions is the number of the latest versions of each chart that are downloaded
+	// to fingerprint their templates. Fingerprints are reused from Previous
+	FingerprintVersions int
+
+	// Checkpoint is called with the repos that have been indexed so far, so that an
+	// interrupted build can be resumed
+	Checkpoint func(partial *ChartIndex) error
+}
 
-		charts = append(charts, monocularResponse.Data...)
+const (
+	DefaultBuildWorkers = 8
+	DefaultHostInterval = 100 * time.Millisecond
 
-		currentPage = currentPage + 1
-	}
+	checkpointInterval = 2 * time.Second
+)
+
+// repoResult is the result of indexing one repo
+type repoResult struct {
+	record RepoRecord
+	charts []ChartAndVersions
+}
 
+// Build indexes the repositories listed by each provider, in order. A repository that's listed
+// more than once is only indexed the first time. A provider that fails is skipped and recorded in
+// ProviderErrors, unless no provider found any repositories. A repo that fails is recorded with its error
+func (i *ChartIndex) Build(opts BuildOptions) error {
 	i.charts = []ChartAndVersions{}
+	i.repos = []RepoRecord{}
+	i.startedAt = time.Now()
+	i.complete = false
+	i.formatVersion = indexFormatVersion
+	i.fingerprintVersions = opts.FingerprintVersions
+	if opts.Resume != nil {
+		i.startedAt = opts.Resume.startedAt
+	}
 
+	i.providerErrors = []error{}
+	repositories := []Repository{}
 	searchedRepos := map[string]bool{}
-	for _, chart := range charts {
-		if _, ok := searchedRepos[chart.Attributes.Repo.URL]; ok {
-			continue
-		}
-
-		versions, err := queryRepoForChartAndAppVersions(chart.Attributes.Repo.Name, chart.Attributes.Repo.URL)
+	for _, provider := range opts.Providers {
+		providerRepositories, err := provider.Repositories()
 		if err != nil {
-			//			fmt.Printf("failed to fetch charts in repo %s, error was %#v\n", chart.Attributes.Repo.Name, err)
+			i.providerErrors = append(i.providerErrors, errors.Wrapf(err, "failed to list repositories from %s", provider.Name()))
 			continue
 		}
 
-		for chartAndRepoName, history := range versions {
-			chartAndVersion := ChartAndVersions{
-				Repo:     chart.Attributes.Repo.Name,
-				Name:     strings.Split(chartAndRepoName, "/")[1],
-				URI:      chart.Attributes.Repo.URL,
-				Versions: history,
-				Keywords: chart.Attributes.Keywords,
+		for _, repository := range providerRepositories {
+			if _, ok := searchedRepos[repository.URL]; ok {
+				continue
 			}
-
-			i.charts = append(i.charts, chartAndVersion)
+			repositories = append(repositories, repository)
+			searchedRepos[repository.URL] = true
 		}
+	}
 
-		searchedRepos[chart.Attributes.Repo.URL] = true
+	if len(repositories) == 0 && len(i.providerErrors) > 0 {
+		return i.providerErrors[len(i.providerErrors)-1]
 	}
 
+	results, err := i.indexRepos(repositories, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		i.repos = append(i.repos, result.record)
+		i.charts = append(i.charts, result.charts...)
+	}
+	i.complete = true
+
 	totalVersionCount := 0
 	for _, item := range i.charts {
 		totalVersionCount += len(item.Versions)
 	}
 
-	fmt.Printf("found %d total repos, and %d total versions\n", len(i.charts), totalVersionCount)
+	fmt.Printf("found %d total repos, and %d total versions\n", len(i.repos), totalVersionCount)
+	if failedRepos := i.FailedRepos(); len(failedRepos) > 0 {
+		fmt.Printf("%d repos could not be indexed\n", len(failedRepos))
+	}
 	return nil
 }
 
-func queryRepoForChartAndAppVersions(repoName string, repoURI string) (map[string][]ChartVersion, error) {
-	fmt.Printf("\r%s\r", cursor.ClearEntireLine())
-	fmt.Printf("getting version info for charts in repo %s (%s)", repoName, repoURI)
-	helmHome, err := ioutil.TempDir("", "unfork")
+// AddRepositories indexes repositories that aren't in the index, such as an --index-url that's new
+// since the index was built, and adds them to it. The rest of the index is kept as it is
+func (i *ChartIndex) AddRepositories(repositories []Repository, opts BuildOptions) error {
+	opts.Checkpoint = nil
+	opts.Resume = nil
+	results, err := i.indexRepos(repositories, opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer os.RemoveAll(helmHome)
-	if err := os.MkdirAll(filepath.Join(helmHome, "repository"), 0755); err != nil {
-		return nil, err
+
+	for _, result := range results {
+		i.removeRepo(result.record.URL)
+		i.repos = append(i.repos, result.record)
+		i.charts = append(i.charts, result.charts...)
 	}
-	reposFile := filepath.Join(helmHome, "repository", "repositories.yaml")
 
-	repoIndexFile, err := ioutil.TempFile("", "index")
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// removeRepo removes the record of the repo at repoURL and its charts
+func (i *ChartIndex) removeRepo(repoURL string) {
+	repos := []RepoRecord{}
+	for _, repo := range i.repos {
+		if repo.URL != repoURL {
+			repos = append(repos, repo)
+		}
 	}
-	defer os.Remove(repoIndexFile.Name())
+	i.repos = repos
 
-	cacheIndexFile, err := ioutil.TempFile("", "cache")
-	if err != nil {
-		return nil, err
+	charts := []ChartAndVersions{}
+	for _, chart := range i.charts {
+		if chart.URI != repoURL {
+			charts = append(charts, chart)
+		}
 	}
-	defer os.Remove(cacheIndexFile.Name())
+	i.charts = charts
+}
 
-	repoYAML := `apiVersion: v1
-generated: "2019-05-29T14:31:58.906598702Z"
-repositories: []`
-	if err := ioutil.WriteFile(reposFile, []byte(repoYAML), 0644); err != nil {
-		return nil, err
+// indexRepos indexes repositories with opts.Workers at a time, and returns their results in the same order
+func (i *ChartIndex) indexRepos(repositories []Repository, opts BuildOptions) ([]*repoResult, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultBuildWorkers
+	}
+	hostInterval := opts.HostInterval
+	if hostInterval <= 0 {
+		hostInterval = DefaultHostInterval
+	}
+	limiter := newHostLimiter(hostInterval)
+
+	results := make([]*repoResult, len(repositories))
+	indexed := 0
+	lastCheckpoint := time.Now()
+	var checkpointErr error
+	checkpointing := false
+	var mu sync.Mutex
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				repository := repositories[j]
+				result := indexRepo(repository, opts.RepoConfigs.ForURL(repository.URL), opts.Previous, opts.Resume, opts.FingerprintVersions, limiter)
+
+				// the partial index is copied under the lock, and saved outside it so
+				// that the other workers aren't held up by writing it
+				var partial *ChartIndex
+				mu.Lock()
+				results[j] = &result
+				indexed++
+				fmt.Printf("\r%s\r", cursor.ClearEntireLine())
+				fmt.Printf("indexed %d of %d repos (%s)", indexed, len(repositories), repository.URL)
+
+				if opts.Checkpoint != nil && !checkpointing && time.Since(lastCheckpoint) > checkpointInterval {
+					partial = i.partial(results)
+					checkpointing = true
+				}
+				mu.Unlock()
+
+				if partial == nil {
+					continue
+				}
+				err := opts.Checkpoint(partial)
+
+				mu.Lock()
+				if err != nil && checkpointErr == nil {
+					checkpointErr = err
+				}
+				lastCheckpoint = time.Now()
+				checkpointing = false
+				mu.Unlock()
+			}
+		}()
 	}
 
-	c := repo.Entry{
-		Name:  repoName,
-		Cache: repoIndexFile.Name(),
-		URL:   repoURI,
+	for j := range repositories {
+		jobs <- j
 	}
-	r, err := repo.NewChartRepository(&c, getter.All(environment.EnvSettings{}))
-	if err != nil {
-		return nil, err
+	close(jobs)
+	wg.Wait()
+	fmt.Printf("\r%s\r", cursor.ClearEntireLine())
+
+	if checkpointErr != nil {
+		return nil, errors.Wrap(checkpointErr, "failed to save partial index")
+	}
+
+	return results, nil
+}
+
+// partial returns an index of the repos that have been indexed so far
+func (i *ChartIndex) partial(results []*repoResult) *ChartIndex {
+	partial := ChartIndex{
+		charts:        []ChartAndVersions{},
+		repos:         []RepoRecord{},
+		startedAt:     i.startedAt,
+		formatVersion: i.formatVersion,
+
+		fingerprintVersions: i.fingerprintVersions,
 	}
-	if err := r.DownloadIndexFile(cacheIndexFile.Name()); err != nil {
-		return nil, err
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		partial.repos = append(partial.repos, result.record)
+		partial.charts = append(partial.charts, result.charts...)
 	}
+	return &partial
+}
 
-	rf, err := repo.LoadRepositoriesFile(reposFile)
-	if err != nil {
-		return nil, err
+// HasRepo returns true if the repository at repoURL has been indexed, including repos that failed
+// to index and repos without any charts
+func (i *ChartIndex) HasRepo(repoURL string) bool {
+	if record, _ := i.repo(repoURL); record != nil {
+		return true
 	}
-	rf.Update(&c)
+	for _, chart := range i.charts {
+		if chart.URI == repoURL {
+			return true
+		}
+	}
+	return false
+}
 
-	i := search.NewIndex()
-	for _, re := range rf.Repositories {
-		n := re.Name
-		ind, err := repo.LoadIndexFile(repoIndexFile.Name())
+// indexRepo lists the charts in a repository, and fingerprints the latest fingerprintVersions of each.
+// A repo that was indexed by the interrupted build in resume is reused as is. Otherwise a repo in
+// the previous index is reused if its index.yaml hasn't changed
+func indexRepo(repository Repository, repoConfig chartrepo.Config, previous *ChartIndex, resume *ChartIndex, fingerprintVersions int, limiter *hostLimiter) repoResult {
+	record := RepoRecord{
+		Name:      repository.Name,
+		URL:       repository.URL,
+		Source:    repository.Source,
+		IndexedAt: time.Now(),
+	}
+
+	if resume != nil && resume.formatVersion >= indexFormatVersion {
+		resumedRecord, resumedCharts := resume.repo(repository.URL)
+		if resumedRecord != nil && resumedRecord.Error == "" && !missingFingerprints(resumedCharts, fingerprintVersions) {
+			return repoResult{record: *resumedRecord, charts: resumedCharts}
+		}
+	}
+
+	var previousRecord *RepoRecord
+	var previousCharts []ChartAndVersions
+	upToDate := false
+	if previous != nil {
+		previousRecord, previousCharts = previous.repo(repository.URL)
+		if previousRecord != nil && previousRecord.Error != "" {
+			previousRecord = nil
+		}
+		upToDate = previous.formatVersion >= indexFormatVersion
+	}
+
+	limiter.wait(repository.URL)
+
+	var index *repo.IndexFile
+	if chartrepo.IsOCI(repository.URL) {
+		ociIndex, err := repoConfig.LoadIndex()
 		if err != nil {
-			return nil, err
+			record.Error = err.Error()
+			return repoResult{record: record}
+		}
+		index = ociIndex
+	} else {
+		validators := chartrepo.Validators{}
+		// an index that's missing fingerprints is downloaded again to find the charts to fingerprint
+		if previousRecord != nil && upToDate && !missingFingerprints(previousCharts, fingerprintVersions) {
+			validators.ETag = previousRecord.ETag
+			validators.LastModified = previousRecord.LastModified
+		}
+
+		b, newValidators, err := repoConfig.DownloadIndexIfModified(validators)
+		if err != nil {
+			record.Error = err.Error()
+			return repoResult{record: record}
+		}
+		record.ETag = newValidators.ETag
+		record.LastModified = newValidators.LastModified
+
+		if b == nil {
+			charts := []ChartAndVersions{}
+			for _, chart := range previousCharts {
+				chart.Repo = repository.Name
+				chart.Source = repository.Source
+				charts = append(charts, chart)
+			}
+			return repoResult{record: record, charts: charts}
 		}
 
-		i.AddRepo(n, ind, true)
+		parsedIndex, err := chartrepo.ParseIndex(b)
+		if err != nil {
+			record.Error = err.Error()
+			return repoResult{record: record}
+		}
+		index = parsedIndex
 	}
 
-	chartAppVersions := make(map[string][]ChartVersion)
-	for _, result := range i.All() {
-		key := fmt.Sprintf("%s/%s", repoName, result.Chart.GetName())
-		versions, ok := chartAppVersions[key]
-		if !ok {
-			versions = []ChartVersion{}
+	charts := chartsInIndex(repository, index)
+	fingerprintCharts(charts, index, previousCharts, repoConfig, fingerprintVersions, limiter)
+
+	return repoResult{record: record, charts: charts}
+}
+
+// fingerprintCharts fingerprints the latest fingerprintVersions of each chart, reusing the fingerprints
+// in previousCharts. A chart that can't be downloaded gets an empty fingerprint, so it's not tried again
+func fingerprintCharts(charts []ChartAndVersions, index *repo.IndexFile, previousCharts []ChartAndVersions, repoConfig chartrepo.Config, fingerprintVersions int, limiter *hostLimiter) {
+	previousFingerprints := map[string]*Fingerprint{}
+	for _, chart := range previousCharts {
+		for _, version := range chart.Versions {
+			if version.Fingerprint != nil {
+				previousFingerprints[chart.Name+"@"+version.ChartVersion] = version.Fingerprint
+			}
 		}
-		versions = append(versions, ChartVersion{
-			ChartVersion: result.Chart.GetVersion(),
-			AppVersion:   result.Chart.GetAppVersion(),
+	}
+
+	for _, chart := range charts {
+		for v := range chart.Versions {
+			if v >= fingerprintVersions {
+				break
+			}
+			version := &chart.Versions[v]
+
+			if fingerprint, ok := previousFingerprints[chart.Name+"@"+version.ChartVersion]; ok {
+				version.Fingerprint = fingerprint
+				continue
+			}
+
+			// the versions of a chart are in the same order as in the index, newest first
+			version.Fingerprint = &Fingerprint{}
+			limiter.wait(repoConfig.URL)
+			archive, err := repoConfig.DownloadChartVersion(index.Entries[chart.Name][v])
+			if err != nil {
+				continue
+			}
+			if fingerprint, err := fingerprintArchive(archive); err == nil {
+				version.Fingerprint = fingerprint
+			}
+		}
+	}
+}
+
+// missingFingerprints returns true if any of the latest fingerprintVersions of a chart aren't fingerprinted
+func missingFingerprints(charts []ChartAndVersions, fingerprintVersions int) bool {
+	for _, chart := range charts {
+		for v, version := range chart.Versions {
+			if v >= fingerprintVersions {
+				break
+			}
+			if version.Fingerprint == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chartsInIndex lists the versions of each chart in a repository's index, sorted by name
+func chartsInIndex(repository Repository, index *repo.IndexFile) []ChartAndVersions {
+	chartNames := []string{}
+	for chartName := range index.Entries {
+		chartNames = append(chartNames, chartName)
+	}
+	sort.Strings(chartNames)
+
+	charts := []ChartAndVersions{}
+	for _, chartName := range chartNames {
+		versions := []ChartVersion{}
+		for _, chartVersion := range index.Entries[chartName] {
+			version := ChartVersion{
+				ChartVersion: chartVersion.GetVersion(),
+				AppVersion:   chartVersion.GetAppVersion(),
+				Digest:       strings.TrimPrefix(chartVersion.Digest, "sha256:"),
+				Deprecated:   chartVersion.GetDeprecated(),
+			}
+			// the repository of a chart in an oci registry isn't always named for the chart
+			if len(chartVersion.URLs) > 0 && chartrepo.IsOCI(chartVersion.URLs[0]) {
+				version.URL = chartVersion.URLs[0]
+			}
+			versions = append(versions, version)
+		}
+
+		charts = append(charts, ChartAndVersions{
+			Repo:     repository.Name,
+			Name:     chartName,
+			URI:      repository.URL,
+			Source:   repository.Source,
+			Versions: versions,
 		})
-		chartAppVersions[key] = versions
 	}
 
-	return chartAppVersions, nil
+	return charts
+}
+
+// hostLimiter spaces out requests to the same host
+type hostLimiter struct {
+	interval time.Duration
+	next     map[string]time.Time
+	mu       sync.Mutex
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{
+		interval: interval,
+		next:     map[string]time.Time{},
+	}
+}
+
+// wait blocks until the next request can be sent to the host of requestURL
+func (l *hostLimiter) wait(requestURL string) {
+	host := requestURL
+	if u, err := url.Parse(requestURL); err == nil {
+		host = u.Host
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	next := l.next[host]
+	if next.Before(now) {
+		next = now
+	}
+	l.next[host] = next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(next.Sub(now))
 }
@@ -0,0 +1,185 @@
+package chartindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepoServer serves an index.yaml for each of repos, with an etag, and counts the
+// downloads of each
+type testRepoServer struct {
+	server    *httptest.Server
+	downloads map[string]int
+	mu        sync.Mutex
+}
+
+func newTestRepoServer(repos map[string]string) *testRepoServer {
+	s := &testRepoServer{
+		downloads: map[string]int{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repoName := filepath.Base(filepath.Dir(r.URL.Path))
+		chartName, ok := repos[repoName]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%s-1"`, repoName)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		s.mu.Lock()
+		s.downloads[repoName]++
+		s.mu.Unlock()
+
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `apiVersion: v1
+entries:
+  %s:
+  - apiVersion: v1
+    appVersion: 1.0.0
+    name: %s
+    version: 0.1.0
+generated: "2020-01-01T00:00:00Z"
+`, chartName, chartName)
+	}))
+	return s
+}
+
+func (s *testRepoServer) provider(repoNames ...string) Provider {
+	repositories := []Repository{}
+	for _, repoName := range repoNames {
+		repositories = append(repositories, Repository{Name: repoName, URL: s.server.URL + "/" + repoName, Source: SourceArtifactHub})
+	}
+	return fakeProvider{repositories: repositories}
+}
+
+func Test_BuildIncremental(t *testing.T) {
+	repoServer := newTestRepoServer(map[string]string{
+		"stable":    "redis",
+		"bitnami":   "mysql",
+		"incubator": "kafka",
+	})
+	defer repoServer.server.Close()
+
+	provider := repoServer.provider("stable", "bitnami", "missing", "incubator")
+
+	first := ChartIndex{}
+	require.NoError(t, first.Build(BuildOptions{Providers: []Provider{provider}, Workers: 2}))
+	assert.True(t, first.Complete())
+
+	// results are in the order the repos were listed, whatever order they finished in
+	chartNames := []string{}
+	for _, chart := range first.charts {
+		chartNames = append(chartNames, chart.Name)
+	}
+	assert.Equal(t, []string{"redis", "mysql", "kafka"}, chartNames)
+
+	failedRepos := first.FailedRepos()
+	require.Len(t, failedRepos, 1)
+	assert.Equal(t, repoServer.server.URL+"/missing", failedRepos[0].URL)
+	assert.Contains(t, failedRepos[0].Error, "404")
+
+	// a repo that failed is in the index, so it's reported instead of rebuilding to retry it
+	assert.True(t, first.HasRepo(repoServer.server.URL+"/missing"))
+	assert.True(t, first.HasRepo(repoServer.server.URL+"/stable"))
+	assert.False(t, first.HasRepo(repoServer.server.URL+"/other"))
+
+	// a rebuild reuses the repos that haven't changed
+	second := ChartIndex{}
+	require.NoError(t, second.Build(BuildOptions{Providers: []Provider{provider}, Previous: &first}))
+	assert.Equal(t, first.charts, second.charts)
+	assert.Equal(t, map[string]int{"stable": 1, "bitnami": 1, "incubator": 1}, repoServer.downloads)
+	assert.Len(t, second.FailedRepos(), 1)
+}
+
+func Test_BuildResume(t *testing.T) {
+	repoServer := newTestRepoServer(map[string]string{
+		"stable":  "redis",
+		"bitnami": "mysql",
+	})
+	defer repoServer.server.Close()
+
+	dir, err := ioutil.TempDir("", "chartindex")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	partialFile := filepath.Join(dir, "charts.json.partial")
+
+	// the last complete index, and a build that was interrupted after indexing stable
+	last := ChartIndex{}
+	require.NoError(t, last.Build(BuildOptions{Providers: []Provider{repoServer.provider("bitnami")}}))
+
+	interrupted := ChartIndex{}
+	require.NoError(t, interrupted.Build(BuildOptions{Providers: []Provider{repoServer.provider("stable")}}))
+	partial := interrupted.partial([]*repoResult{{record: interrupted.repos[0], charts: interrupted.charts}, nil})
+	require.NoError(t, partial.Save(partialFile))
+
+	loaded, err := LoadIndex(partialFile)
+	require.NoError(t, err)
+	assert.False(t, loaded.Complete())
+
+	resumed := ChartIndex{}
+	require.NoError(t, resumed.Build(BuildOptions{
+		Providers: []Provider{repoServer.provider("stable", "bitnami")},
+		Previous:  &last,
+		Resume:    loaded,
+		Checkpoint: func(partial *ChartIndex) error {
+			return partial.Save(partialFile)
+		},
+	}))
+	assert.True(t, resumed.Complete())
+	assert.Len(t, resumed.charts, 2)
+	assert.Equal(t, loaded.startedAt.Unix(), resumed.startedAt.Unix())
+
+	// stable was only downloaded by the interrupted build, and bitnami is unchanged since the last index
+	assert.Equal(t, map[string]int{"stable": 1, "bitnami": 1}, repoServer.downloads)
+}
+
+func Test_AddRepositories(t *testing.T) {
+	repoServer := newTestRepoServer(map[string]string{
+		"stable":  "redis",
+		"bitnami": "mysql",
+	})
+	defer repoServer.server.Close()
+
+	index := ChartIndex{}
+	require.NoError(t, index.Build(BuildOptions{Providers: []Provider{repoServer.provider("stable")}}))
+
+	added := repoServer.provider("bitnami").(fakeProvider).repositories
+	require.NoError(t, index.AddRepositories(added, BuildOptions{}))
+
+	assert.True(t, index.Complete())
+	assert.True(t, index.HasRepo(repoServer.server.URL+"/bitnami"))
+	assert.Len(t, index.charts, 2)
+
+	// only the new repo was downloaded
+	assert.Equal(t, map[string]int{"stable": 1, "bitnami": 1}, repoServer.downloads)
+}
+
+func Test_LoadIndexListOfCharts(t *testing.T) {
+	indexFile, err := ioutil.TempFile("", "charts")
+	require.NoError(t, err)
+	defer os.Remove(indexFile.Name())
+
+	_, err = indexFile.WriteString(`[{"repo":"stable","name":"redis","uri":"https://kubernetes-charts.storage.googleapis.com","versions":[{"chartVersion":"10.5.7","appVersion":"5.0.7"}],"keywords":null}]`)
+	require.NoError(t, err)
+	require.NoError(t, indexFile.Close())
+
+	index, err := LoadIndex(indexFile.Name())
+	require.NoError(t, err)
+	assert.True(t, index.Complete())
+	assert.True(t, index.HasRepo("https://kubernetes-charts.storage.googleapis.com"))
+	assert.Empty(t, index.FailedRepos())
+}
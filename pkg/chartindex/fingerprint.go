@@ -0,0 +1,133 @@
+package chartindex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// Fingerprint identifies a chart by the content of its templates, so that a fork can be
+// matched with its upstream after it's been renamed
+type Fingerprint struct {
+	Templates []string `json:"templates"` // hashes of the normalised templates, sorted
+	Kinds     []string `json:"kinds"`     // the kinds of object the templates produce, sorted
+}
+
+var (
+	templateCommentRegex = regexp.MustCompile(`(?s)\{\{-?\s*/\*.*?\*/\s*-?\}\}`)
+	// named templates are usually prefixed with the chart name, such as "redis.fullname"
+	namedTemplateRegex = regexp.MustCompile(`(define|template|include)\s+"[^".]+\.`)
+	whitespaceRegex    = regexp.MustCompile(`\s+`)
+	kindRegex          = regexp.MustCompile(`(?m)^kind:\s*["']?([A-Za-z0-9]+)["']?\s*$`)
+)
+
+// FingerprintTemplates fingerprints the templates of a chart. NOTES.txt is left out,
+// because it's usually just text about the chart
+func FingerprintTemplates(templates []*chart.Template) Fingerprint {
+	hashes := map[string]bool{}
+	kinds := map[string]bool{}
+
+	for _, template := range templates {
+		if path.Base(template.Name) == "NOTES.txt" {
+			continue
+		}
+
+		normalised := normaliseTemplate(string(template.Data))
+		if normalised == "" {
+			continue
+		}
+		hashes[fmt.Sprintf("%x", sha256.Sum256([]byte(normalised)))[:16]] = true
+
+		for _, match := range kindRegex.FindAllStringSubmatch(string(template.Data), -1) {
+			kinds[match[1]] = true
+		}
+	}
+
+	return Fingerprint{
+		Templates: sortedKeys(hashes),
+		Kinds:     sortedKeys(kinds),
+	}
+}
+
+// normaliseTemplate removes the differences between templates that don't change what they
+// render: comments, whitespace, whitespace trimming and the chart name prefix of named templates
+func normaliseTemplate(template string) string {
+	template = templateCommentRegex.ReplaceAllString(template, "")
+	template = strings.Replace(template, "{{-", "{{", -1)
+	template = strings.Replace(template, "-}}", "}}", -1)
+	template = namedTemplateRegex.ReplaceAllString(template, `$1 "chart.`)
+
+	lines := []string{}
+	for _, line := range strings.Split(template, "\n") {
+		line = strings.TrimSpace(whitespaceRegex.ReplaceAllString(line, " "))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// fingerprintArchive fingerprints the templates in a chart archive
+func fingerprintArchive(archive []byte) (*Fingerprint, error) {
+	c, err := chartutil.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load chart archive")
+	}
+
+	fingerprint := FingerprintTemplates(c.Templates)
+	return &fingerprint, nil
+}
+
+// Similarity scores how alike two fingerprints are, from 0 to 1. Most of the score is the
+// templates that they have in common, and the rest is the kinds of object they produce
+func (f Fingerprint) Similarity(other Fingerprint) float64 {
+	templates := jaccard(f.Templates, other.Templates)
+	if templates == 0 {
+		// many unrelated charts produce a deployment and a service
+		return 0
+	}
+
+	return 0.8*templates + 0.2*jaccard(f.Kinds, other.Kinds)
+}
+
+// jaccard is the size of the intersection of two sorted sets over the size of their union
+func jaccard(a []string, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+
+	intersection := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			intersection++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
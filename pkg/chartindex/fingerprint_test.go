@@ -0,0 +1,165 @@
+package chartindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/replicatedhq/unfork/pkg/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+const (
+	deploymentTemplate = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ template "redis.fullname" . }}
+  labels:
+{{ include "redis.labels" . | indent 4 }}
+spec:
+  replicas: {{ .Values.replicas }}
+`
+	serviceTemplate = `apiVersion: v1
+kind: Service
+metadata:
+  name: {{ template "redis.fullname" . }}
+`
+)
+
+func Test_normaliseTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{
+			name: "renamed named templates",
+			template: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ template "acme-redis.fullname" . }}
+  labels:
+{{ include "acme-redis.labels" . | indent 4 }}
+spec:
+  replicas: {{ .Values.replicas }}
+`,
+		},
+		{
+			name: "comments and whitespace",
+			template: `# the redis deployment
+{{/* the name is truncated to 63 characters */}}
+apiVersion:   apps/v1
+kind: Deployment
+
+metadata:
+  name: {{- template "redis.fullname" . -}}
+  labels:
+  {{ include "redis.labels" . | indent 4 }}
+spec:
+  replicas: {{ .Values.replicas }}
+`,
+		},
+	}
+
+	expected := normaliseTemplate(deploymentTemplate)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, expected, normaliseTemplate(test.template))
+		})
+	}
+
+	assert.NotEqual(t, expected, normaliseTemplate(serviceTemplate))
+}
+
+func Test_FingerprintSimilarity(t *testing.T) {
+	upstream := FingerprintTemplates([]*chart.Template{
+		{Name: "templates/deployment.yaml", Data: []byte(deploymentTemplate)},
+		{Name: "templates/service.yaml", Data: []byte(serviceTemplate)},
+		{Name: "templates/NOTES.txt", Data: []byte("redis is installed")},
+	})
+	assert.Equal(t, []string{"Deployment", "Service"}, upstream.Kinds)
+	assert.Len(t, upstream.Templates, 2)
+
+	// the fork renamed the chart, and changed the service
+	fork := FingerprintTemplates([]*chart.Template{
+		{Name: "templates/deployment.yaml", Data: []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ template "acme-redis.fullname" . }}
+  labels:
+{{ include "acme-redis.labels" . | indent 4 }}
+spec:
+  replicas: {{ .Values.replicas }}
+`)},
+		{Name: "templates/svc.yaml", Data: []byte(serviceTemplate + "spec:\n  type: LoadBalancer\n")},
+		{Name: "templates/NOTES.txt", Data: []byte("acme-redis is installed")},
+	})
+
+	// 1 of the 3 different templates, and both kinds, are the same
+	assert.InDelta(t, 0.8/3+0.2, fork.Similarity(upstream), 0.0001)
+	assert.Equal(t, 1.0, upstream.Similarity(upstream))
+
+	// charts that only have the same kinds of object aren't similar
+	unrelated := FingerprintTemplates([]*chart.Template{
+		{Name: "templates/deployment.yaml", Data: []byte("kind: Deployment\nmetadata:\n  name: mysql\n")},
+		{Name: "templates/service.yaml", Data: []byte("kind: Service\nmetadata:\n  name: mysql\n")},
+	})
+	assert.Equal(t, 0.0, unrelated.Similarity(upstream))
+}
+
+func Test_fingerprintCharts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	index := `apiVersion: v1
+entries:
+  redis:
+  - apiVersion: v1
+    name: redis
+    version: 10.5.7
+    urls:
+    - redis-10.5.7.tgz
+  - apiVersion: v1
+    name: redis
+    version: 10.5.6
+    urls:
+    - redis-10.5.6.tgz
+generated: "2020-01-01T00:00:00Z"
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.yaml"), []byte(index), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "redis-10.5.7.tgz"), testutil.ChartArchive(t, map[string]string{
+		"redis/Chart.yaml":                "apiVersion: v1\nname: redis\nversion: 10.5.7\n",
+		"redis/templates/deployment.yaml": deploymentTemplate,
+		"redis/templates/service.yaml":    serviceTemplate,
+	}), 0644))
+
+	repository := Repository{Name: "internal", URL: "file://" + dir, Source: SourceIndexURL}
+	repoConfig := chartrepo.Config{URL: repository.URL}
+
+	result := indexRepo(repository, repoConfig, nil, nil, 1, newHostLimiter(0))
+	require.Empty(t, result.record.Error)
+	require.Len(t, result.charts, 1)
+
+	versions := result.charts[0].Versions
+	require.NotNil(t, versions[0].Fingerprint)
+	assert.Equal(t, []string{"Deployment", "Service"}, versions[0].Fingerprint.Kinds)
+	assert.Len(t, versions[0].Fingerprint.Templates, 2)
+	// only the latest version is fingerprinted
+	assert.Nil(t, versions[1].Fingerprint)
+
+	// fingerprints are reused from the previous index, without downloading the chart again
+	require.NoError(t, os.Remove(filepath.Join(dir, "redis-10.5.7.tgz")))
+	previous := &ChartIndex{
+		charts: result.charts,
+		repos:  []RepoRecord{result.record},
+	}
+	result = indexRepo(repository, repoConfig, previous, nil, 2, newHostLimiter(0))
+	require.Len(t, result.charts, 1)
+	assert.Equal(t, versions[0].Fingerprint, result.charts[0].Versions[0].Fingerprint)
+	// a chart that can't be downloaded isn't tried again
+	assert.Equal(t, &Fingerprint{}, result.charts[0].Versions[1].Fingerprint)
+}
@@ -0,0 +1,317 @@
+package chartindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/replicatedhq/unfork/pkg/util"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// DefaultMappingFile is in the working directory, so that it can be kept with the releases it describes
+const DefaultMappingFile = "unfork.yaml"
+
+// Mapping is an unfork.yaml file, which maps releases and charts to upstreams that the index
+// can't find, such as internal charts, and lists charts that moved from deprecated repos.
+// Selected are the upstreams that were typed in unfork, which it saves in their own section
+type Mapping struct {
+	Upstreams []MappedUpstream `json:"upstreams"`
+	Moved     []MovedChart     `json:"moved,omitempty"`
+	Selected  []MappedUpstream `json:"selected,omitempty"`
+
+	dir string // relative paths are relative to the mapping file
+}
+
+// MappedUpstream is the upstream of the releases and charts that match its patterns. Patterns
+// are shell globs, such as "redis-*", and an empty pattern matches everything
+type MappedUpstream struct {
+	Namespace string `json:"namespace,omitempty"`
+	Release   string `json:"release,omitempty"`
+	Chart     string `json:"chart,omitempty"`
+
+	RepoURL string `json:"repoURL,omitempty"`
+	Name    string `json:"name,omitempty"`    // the upstream chart, when it's not named the same as the fork
+	Version string `json:"version,omitempty"` // defaults to the nearest version in the index
+	Path    string `json:"path,omitempty"`    // a chart directory or .tgz, relative to the mapping file, instead of a chart in a repo
+}
+
+// LoadMapping reads a mapping file. A file that doesn't exist has no upstreams
+func LoadMapping(filename string) (*Mapping, error) {
+	mapping := Mapping{dir: filepath.Dir(filename)}
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &mapping, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filename)
+	}
+
+	if err := yaml.Unmarshal(b, &mapping); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filename)
+	}
+
+	return &mapping, nil
+}
+
+// Save writes the selected upstreams to the selected section of filename. The rest of the file is
+// written by hand, so it's kept as it is, with its comments. The file is replaced in one step, so that
+// it's never left partly written
+func (m *Mapping) Save(filename string) error {
+	existing, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read %s", filename)
+	}
+
+	section := []byte{}
+	if len(m.Selected) > 0 {
+		section, err = yaml.Marshal(struct {
+			Selected []MappedUpstream `json:"selected"`
+		}{m.Selected})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal selected upstreams")
+		}
+	}
+
+	if err := util.WriteFileAtomic(filename, replaceSection(existing, "selected", section), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", filename)
+	}
+
+	return nil
+}
+
+// replaceSection replaces the top level key in a yaml document with section, or adds section to the
+// end if the key isn't there. The key's value ends at the next line that isn't indented, a list item or empty
+func replaceSection(doc []byte, key string, section []byte) []byte {
+	lines := strings.SplitAfter(string(doc), "\n")
+
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		if start < 0 {
+			if strings.HasPrefix(line, key+":") {
+				start = i
+			}
+			continue
+		}
+		if line != "" && !strings.ContainsAny(line[:1], " \t-\r\n") {
+			end = i
+			break
+		}
+	}
+
+	if start < 0 {
+		replaced := string(doc)
+		if len(section) > 0 && replaced != "" && !strings.HasSuffix(replaced, "\n") {
+			replaced += "\n"
+		}
+		return []byte(replaced + string(section))
+	}
+
+	return []byte(strings.Join(lines[:start], "") + string(section) + strings.Join(lines[end:], ""))
+}
+
+// Find returns the first upstream whose patterns match the namespace, release and chart, or nil if
+// there isn't one. Selected upstreams are found first. Its path is relative to the working directory
+func (m *Mapping) Find(namespace string, releaseName string, chartName string) *MappedUpstream {
+	if m == nil {
+		return nil
+	}
+
+	for _, upstream := range append(append([]MappedUpstream{}, m.Selected...), m.Upstreams...) {
+		if matchPattern(upstream.Namespace, namespace) && matchPattern(upstream.Release, releaseName) && matchPattern(upstream.Chart, chartName) {
+			upstream := upstream
+			if upstream.Path != "" && !filepath.IsAbs(upstream.Path) {
+				upstream.Path = filepath.Join(m.dir, upstream.Path)
+			}
+			return &upstream
+		}
+	}
+
+	return nil
+}
+
+// Set replaces the selected upstream with the same patterns, or adds it before the others so that it's
+// found first. A path relative to the working directory is saved relative to the mapping file
+func (m *Mapping) Set(upstream MappedUpstream) {
+	if upstream.Path != "" && !filepath.IsAbs(upstream.Path) && m.dir != "" {
+		absPath, pathErr := filepath.Abs(upstream.Path)
+		absDir, dirErr := filepath.Abs(m.dir)
+		if pathErr == nil && dirErr == nil {
+			if relPath, err := filepath.Rel(absDir, absPath); err == nil {
+				upstream.Path = relPath
+			}
+		}
+	}
+
+	for i, existing := range m.Selected {
+		if existing.Namespace == upstream.Namespace && existing.Release == upstream.Release && existing.Chart == upstream.Chart {
+			m.Selected[i] = upstream
+			return
+		}
+	}
+
+	m.Selected = append([]MappedUpstream{upstream}, m.Selected...)
+}
+
+// MovedCharts returns the moved charts in the mapping, followed by the defaults
+func (m *Mapping) MovedCharts() []MovedChart {
+	moved := []MovedChart{}
+	if m != nil {
+		moved = append(moved, m.Moved...)
+	}
+	return append(moved, DefaultMovedCharts...)
+}
+
+func matchPattern(pattern string, name string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// ParseMappedUpstream parses an upstream typed as a chart in a repo, such as
+// https://charts.example.com/stable/redis@10.5.7 or oci://registry.example.com/charts/redis:10.5.7,
+// or a chart directory or .tgz on disk. The version of a chart in a repo is optional
+func ParseMappedUpstream(upstream string) (MappedUpstream, error) {
+	upstream = strings.TrimSpace(upstream)
+
+	if chartrepo.IsOCI(upstream) {
+		repoURL, chartName, chartVersion, err := chartrepo.ParseOCIChart(upstream)
+		if err != nil {
+			return MappedUpstream{}, err
+		}
+		return MappedUpstream{RepoURL: repoURL, Name: chartName, Version: chartVersion}, nil
+	}
+
+	if strings.HasPrefix(upstream, "http://") || strings.HasPrefix(upstream, "https://") {
+		chartVersion := ""
+		if i := strings.LastIndex(upstream, "@"); i > strings.LastIndex(upstream, "/") {
+			chartVersion = upstream[i+1:]
+			upstream = upstream[:i]
+		}
+
+		i := strings.LastIndex(upstream, "/")
+		if i < len("https://") || i == len(upstream)-1 {
+			return MappedUpstream{}, errors.Errorf("%s is not a repo url followed by a chart name", upstream)
+		}
+		return MappedUpstream{RepoURL: upstream[:i], Name: upstream[i+1:], Version: chartVersion}, nil
+	}
+
+	if _, err := os.Stat(upstream); err != nil {
+		return MappedUpstream{}, errors.Errorf("%s is not a chart repo url or a chart on disk", upstream)
+	}
+	return MappedUpstream{Path: upstream}, nil
+}
+
+// ResolveMappedUpstream returns the chart that a mapped upstream refers to. The name of a chart in a
+// repo defaults to chartName, and its version to the one in the index that's nearest to chartVersion
+func (i *ChartIndex) ResolveMappedUpstream(upstream MappedUpstream, chartName string, chartVersion string, appVersion string) (*ChartMatch, error) {
+	if upstream.Path != "" {
+		metadata, err := loadChartMetadata(upstream.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load chart %s", upstream.Path)
+		}
+
+		return &ChartMatch{
+			Repo:               filepath.Dir(upstream.Path),
+			Path:               upstream.Path,
+			Name:               metadata.GetName(),
+			ChartVersion:       metadata.GetVersion(),
+			AppVersion:         metadata.GetAppVersion(),
+			LatestChartVersion: metadata.GetVersion(),
+			LatestAppVersion:   metadata.GetAppVersion(),
+			MatchQuality:       MatchMapped,
+		}, nil
+	}
+
+	if upstream.RepoURL == "" {
+		return nil, errors.New("mapped upstream has no repoURL or path")
+	}
+
+	repoURL := strings.TrimSuffix(upstream.RepoURL, "/")
+	match := ChartMatch{
+		Repo:         path.Base(repoURL),
+		URI:          repoURL,
+		Name:         upstream.Name,
+		ChartVersion: upstream.Version,
+		MatchQuality: MatchMapped,
+	}
+	if match.Name == "" {
+		match.Name = chartName
+	}
+
+	if i != nil {
+		for _, indexChart := range i.charts {
+			if indexChart.URI != repoURL || indexChart.Name != match.Name {
+				continue
+			}
+
+			match.LatestChartVersion, match.LatestAppVersion = latestVersion(indexChart.Versions)
+			if match.ChartVersion == "" {
+				nearest := ChartIndex{charts: []ChartAndVersions{indexChart}}
+				if matches, err := nearest.FindBestUpstreamMatches(match.Name, chartVersion, appVersion, 1); err == nil && len(matches) > 0 {
+					match.ChartVersion = matches[0].ChartVersion
+					match.AppVersion = matches[0].AppVersion
+					match.ChartURL = matches[0].ChartURL
+				}
+			}
+		}
+	}
+
+	if match.ChartVersion == "" {
+		return nil, errors.Errorf("%s is not in the index of %s, so its version must be set", match.Name, repoURL)
+	}
+
+	return &match, nil
+}
+
+type loadedChart struct {
+	modTime  time.Time
+	metadata *chart.Metadata
+}
+
+var (
+	loadedChartsMu sync.Mutex
+	loadedCharts   = map[string]loadedChart{}
+)
+
+// loadChartMetadata loads the metadata of a chart on disk. It's kept until the chart changes, because
+// mapped upstreams are resolved each time the upstreams are drawn
+func loadChartMetadata(chartPath string) (*chart.Metadata, error) {
+	fi, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	modTime := fi.ModTime()
+	if fi.IsDir() {
+		// editing Chart.yaml doesn't change the mod time of its directory
+		if chartFile, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); err == nil {
+			modTime = chartFile.ModTime()
+		}
+	}
+
+	loadedChartsMu.Lock()
+	defer loadedChartsMu.Unlock()
+
+	if loaded, ok := loadedCharts[chartPath]; ok && loaded.modTime.Equal(modTime) {
+		return loaded.metadata, nil
+	}
+
+	c, err := chartutil.Load(chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	loadedCharts[chartPath] = loadedChart{modTime: modTime, metadata: c.GetMetadata()}
+	return c.GetMetadata(), nil
+}
@@ -0,0 +1,222 @@
+package chartindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Mapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mappingFile := filepath.Join(dir, "unfork.yaml")
+
+	mapping, err := LoadMapping(mappingFile)
+	require.NoError(t, err)
+	assert.Nil(t, mapping.Find("default", "redis", "redis"))
+
+	handWritten := `# internal charts
+upstreams:
+- release: billing-*
+  chart: internal-api
+  path: ./charts/internal-api
+- chart: acme-*
+  repoURL: https://charts.example.com/stable
+  name: redis
+  version: 10.5.7 # pinned
+- namespace: staging
+  chart: acme-*
+  repoURL: https://charts.example.com/incubator
+  name: redis
+`
+	require.NoError(t, ioutil.WriteFile(mappingFile, []byte(handWritten), 0644))
+
+	mapping, err = LoadMapping(mappingFile)
+	require.NoError(t, err)
+
+	// paths are relative to the mapping file, not the working directory
+	assert.Equal(t, &MappedUpstream{Release: "billing-*", Chart: "internal-api", Path: filepath.Join(dir, "charts", "internal-api")}, mapping.Find("default", "billing-eu", "internal-api"))
+	assert.Nil(t, mapping.Find("default", "checkout", "internal-api"))
+	assert.Equal(t, "redis", mapping.Find("default", "cache", "acme-redis").Name)
+	assert.Nil(t, mapping.Find("default", "cache", "redis"))
+
+	// an upstream that's selected for a namespace is found before the hand written ones
+	mapping.Set(MappedUpstream{Namespace: "prod", Release: "cache", RepoURL: "https://charts.example.com/stable", Name: "memcached"})
+	mapping.Set(MappedUpstream{Namespace: "prod", Release: "cache", RepoURL: "https://charts.example.com/stable", Name: "memcached", Version: "1.0.0"})
+	require.NoError(t, mapping.Save(mappingFile))
+
+	// the hand written part of the file is kept as it is
+	b, err := ioutil.ReadFile(mappingFile)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), handWritten))
+
+	mapping, err = LoadMapping(mappingFile)
+	require.NoError(t, err)
+	require.Len(t, mapping.Upstreams, 3)
+	require.Len(t, mapping.Selected, 1)
+	assert.Equal(t, "1.0.0", mapping.Find("prod", "cache", "acme-redis").Version)
+	assert.Equal(t, "10.5.7", mapping.Find("test", "cache", "acme-redis").Version)
+	assert.Equal(t, "10.5.7", mapping.Find("prod", "web", "acme-redis").Version)
+
+	// the selected section is replaced, not added again
+	mapping.Set(MappedUpstream{Release: "web", RepoURL: "https://charts.example.com/stable", Name: "nginx"})
+	require.NoError(t, mapping.Save(mappingFile))
+
+	mapping, err = LoadMapping(mappingFile)
+	require.NoError(t, err)
+	require.Len(t, mapping.Selected, 2)
+	assert.Equal(t, "nginx", mapping.Find("default", "web", "acme-redis").Name)
+
+	var noMapping *Mapping
+	assert.Nil(t, noMapping.Find("default", "cache", "redis"))
+}
+
+func Test_replaceSection(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		section  string
+		expected string
+	}{
+		{
+			name:     "added to the end",
+			doc:      "upstreams: []",
+			section:  "selected:\n- release: a\n",
+			expected: "upstreams: []\nselected:\n- release: a\n",
+		},
+		{
+			name:     "replaced before another key",
+			doc:      "selected:\n- release: a\n  chart: b\n# moved charts\nmoved: []\n",
+			section:  "selected:\n- release: c\n",
+			expected: "selected:\n- release: c\n# moved charts\nmoved: []\n",
+		},
+		{
+			name:     "removed",
+			doc:      "upstreams: []\nselected:\n  - release: a\n",
+			section:  "",
+			expected: "upstreams: []\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, string(replaceSection([]byte(test.doc), "selected", []byte(test.section))))
+		})
+	}
+}
+
+func Test_ParseMappedUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		upstream    string
+		expected    MappedUpstream
+		expectError bool
+	}{
+		{
+			upstream: "https://charts.example.com/stable/redis@10.5.7",
+			expected: MappedUpstream{RepoURL: "https://charts.example.com/stable", Name: "redis", Version: "10.5.7"},
+		},
+		{
+			upstream: " https://user@charts.example.com/redis ",
+			expected: MappedUpstream{RepoURL: "https://user@charts.example.com", Name: "redis"},
+		},
+		{
+			upstream: "oci://registry.example.com/charts/redis:10.5.7",
+			expected: MappedUpstream{RepoURL: "oci://registry.example.com/charts", Name: "redis", Version: "10.5.7"},
+		},
+		{
+			upstream: dir,
+			expected: MappedUpstream{Path: dir},
+		},
+		{
+			upstream:    "https://charts.example.com/",
+			expectError: true,
+		},
+		{
+			upstream:    filepath.Join(dir, "does-not-exist"),
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.upstream, func(t *testing.T) {
+			actual, err := ParseMappedUpstream(test.upstream)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_ResolveMappedUpstream(t *testing.T) {
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "stable",
+				Name: "redis",
+				URI:  "https://charts.example.com/stable",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7"},
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7"},
+				},
+			},
+		},
+	}
+
+	// the version defaults to the nearest in the index
+	actual, err := index.ResolveMappedUpstream(MappedUpstream{RepoURL: "https://charts.example.com/stable/", Name: "redis"}, "acme-redis", "10.5.6-acme.1", "5.0.7")
+	require.NoError(t, err)
+	assert.Equal(t, &ChartMatch{
+		Repo:               "stable",
+		URI:                "https://charts.example.com/stable",
+		Name:               "redis",
+		ChartVersion:       "10.5.6",
+		AppVersion:         "5.0.7",
+		LatestChartVersion: "10.5.7",
+		LatestAppVersion:   "5.0.7",
+		MatchQuality:       MatchMapped,
+	}, actual)
+
+	// a chart that isn't in the index needs a version
+	actual, err = index.ResolveMappedUpstream(MappedUpstream{RepoURL: "https://charts.example.com/internal", Version: "1.0.0"}, "billing", "1.0.1", "")
+	require.NoError(t, err)
+	assert.Equal(t, "billing", actual.Name)
+	assert.Equal(t, "1.0.0", actual.ChartVersion)
+
+	_, err = index.ResolveMappedUpstream(MappedUpstream{RepoURL: "https://charts.example.com/internal"}, "billing", "1.0.1", "")
+	require.Error(t, err)
+
+	// charts on disk are loaded for their name and version
+	dir, err := ioutil.TempDir("", "mapping")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	chartDir := filepath.Join(dir, "internal-api")
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: internal-api\nversion: 2.1.0\nappVersion: 1.4.0\n"), 0644))
+
+	actual, err = index.ResolveMappedUpstream(MappedUpstream{Path: chartDir}, "billing", "2.1.1", "")
+	require.NoError(t, err)
+	assert.Equal(t, &ChartMatch{
+		Repo:               dir,
+		Path:               chartDir,
+		Name:               "internal-api",
+		ChartVersion:       "2.1.0",
+		AppVersion:         "1.4.0",
+		LatestChartVersion: "2.1.0",
+		LatestAppVersion:   "1.4.0",
+		MatchQuality:       MatchMapped,
+	}, actual)
+}
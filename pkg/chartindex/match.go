@@ -1,59 +1,295 @@
 package chartindex
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/Masterminds/semver"
 )
 
+// DefaultMatchesPerRepo is the number of candidate versions returned from each repo
+const DefaultMatchesPerRepo = 3
+
+// MatchQuality describes how close an upstream version is to the local chart
+type MatchQuality string
+
+const (
+	// MatchExact is the same chart version and app version
+	MatchExact MatchQuality = "exact"
+	// MatchChartVersion is the same chart version, with a different app version
+	MatchChartVersion MatchQuality = "chart-version"
+	// MatchNearest is the nearest chart version to the local chart
+	MatchNearest MatchQuality = "nearest"
+	// MatchContent is a chart with similar templates, found by its fingerprint
+	MatchContent MatchQuality = "content"
+	// MatchMapped is the upstream set in the mapping file
+	MatchMapped MatchQuality = "mapped"
+	// MatchSuccessor is the maintained chart that a deprecated chart moved to
+	MatchSuccessor MatchQuality = "successor"
+)
+
+const (
+	// DefaultMinSimilarity is the least similarity of a chart's templates to be an upstream candidate
+	DefaultMinSimilarity = 0.3
+	// DefaultContentMatches is the number of candidates found by their content
+	DefaultContentMatches = 5
+)
+
 type ChartMatch struct {
 	Repo               string
+	URI                string // the url of the repo, when it's not one that kots knows by name
+	Path               string // a chart directory or .tgz on disk, instead of a repo
+	ChartURL           string // where to download the chart from, when it's in an oci registry
 	Name               string
 	ChartVersion       string
 	AppVersion         string
 	LatestChartVersion string
 	LatestAppVersion   string
+	MatchQuality       MatchQuality
+	Similarity         float64 // how alike the templates are, from 0 to 1, for content matches
+
+	Deprecated bool        // the version or its repo is no longer maintained
+	Successor  *ChartMatch // where a deprecated chart is maintained now
+	Mirrors    []string    // the urls of other repos with the same chart archive
+}
+
+// MatchDescription describes the match quality, with the similarity of content matches, followed
+// by whether it's deprecated, its successor and its mirrors
+func (m ChartMatch) MatchDescription() string {
+	description := string(m.MatchQuality)
+	if m.MatchQuality == MatchContent {
+		description = fmt.Sprintf("%s %.0f%%", m.MatchQuality, m.Similarity*100)
+	}
+	if notes := m.notes(); notes != "" {
+		description += ", " + notes
+	}
+	return description
+}
+
+// versionDistance is how far an upstream chart version is from the local chart version.
+// Distances compare major, then minor, then patch, then prerelease
+type versionDistance struct {
+	major, minor, patch int64
+	prerelease          bool
+	newer               bool // the upstream version is greater than the local version
+	sameAppVersion      bool
+}
+
+func (d versionDistance) less(o versionDistance) bool {
+	if d.major != o.major {
+		return d.major < o.major
+	}
+	if d.minor != o.minor {
+		return d.minor < o.minor
+	}
+	if d.patch != o.patch {
+		return d.patch < o.patch
+	}
+	if d.prerelease != o.prerelease {
+		return !d.prerelease
+	}
+	if d.sameAppVersion != o.sameAppVersion {
+		return d.sameAppVersion
+	}
+	// forks bump the chart version, so the upstream is more likely to be older
+	return !d.newer && o.newer
+}
+
+func distance(local *semver.Version, upstream *semver.Version) versionDistance {
+	return versionDistance{
+		major:      abs(local.Major() - upstream.Major()),
+		minor:      abs(local.Minor() - upstream.Minor()),
+		patch:      abs(local.Patch() - upstream.Patch()),
+		prerelease: local.Prerelease() != upstream.Prerelease(),
+		newer:      upstream.GreaterThan(local),
+	}
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+type candidate struct {
+	match    ChartMatch
+	distance versionDistance
 }
 
-func FindBestUpstreamMatches(chartName string, chartVersion string, appVersion string) ([]ChartMatch, error) {
+// FindBestUpstreamMatches returns the versions of charts named chartName that are nearest to chartVersion,
+// at most maxPerRepo from each repo, with the best matches first. Versions that are not valid semver
+// only match when they are equal to chartVersion.
+func (i *ChartIndex) FindBestUpstreamMatches(chartName string, chartVersion string, appVersion string, maxPerRepo int) ([]ChartMatch, error) {
+	// a nil version is one that doesn't parse, and can only match exactly
+	localVersion, _ := semver.NewVersion(chartVersion)
+
+	candidates := []candidate{}
+	for _, indexChart := range i.charts {
+		if indexChart.Name != chartName {
+			continue
+		}
+
+		repoCandidates := []candidate{}
+		for _, version := range indexChart.Versions {
+			parsedChartVersion, _ := semver.NewVersion(version.ChartVersion)
+
+			c := candidate{
+				match: ChartMatch{
+					Repo:         indexChart.Repo,
+					URI:          indexChart.URI,
+					Name:         indexChart.Name,
+					ChartVersion: version.ChartVersion,
+					AppVersion:   version.AppVersion,
+					ChartURL:     version.URL,
+				},
+			}
+
+			if version.ChartVersion == chartVersion {
+				c.match.MatchQuality = MatchChartVersion
+				if version.AppVersion == appVersion {
+					c.match.MatchQuality = MatchExact
+				}
+			} else if localVersion != nil && parsedChartVersion != nil {
+				c.match.MatchQuality = MatchNearest
+				c.distance = distance(localVersion, parsedChartVersion)
+			} else {
+				continue
+			}
+			c.distance.sameAppVersion = version.AppVersion == appVersion
+
+			repoCandidates = append(repoCandidates, c)
+		}
+
+		sortCandidates(repoCandidates)
+		if maxPerRepo > 0 && len(repoCandidates) > maxPerRepo {
+			repoCandidates = repoCandidates[:maxPerRepo]
+		}
+
+		latestChartVersion, latestAppVersion := latestVersion(indexChart.Versions)
+		for _, c := range repoCandidates {
+			c.match.LatestChartVersion = latestChartVersion
+			c.match.LatestAppVersion = latestAppVersion
+			candidates = append(candidates, c)
+		}
+	}
+
+	sortCandidates(candidates)
+
 	chartMatches := []ChartMatch{}
+	for _, c := range candidates {
+		chartMatches = append(chartMatches, c.match)
+	}
+	return chartMatches, nil
+}
 
-	chartIndex, err := loadIndex()
+// ResolveVersionRange returns the newest version of chartName in the repo at repoURL that's in
+// versionRange, such as 1.2.* or ^1.2. Returns false if versionRange is a version rather than a
+// range, or if no version in the index is in it
+func (i *ChartIndex) ResolveVersionRange(repoURL string, chartName string, versionRange string) (ChartVersion, bool) {
+	if _, err := semver.NewVersion(versionRange); err == nil {
+		return ChartVersion{}, false
+	}
+	constraint, err := semver.NewConstraint(versionRange)
 	if err != nil {
-		return nil, err
+		return ChartVersion{}, false
 	}
 
-	for _, indexChart := range chartIndex.charts {
-		if indexChart.Name == chartName {
-			var chartMatch *ChartMatch
+	var newest *semver.Version
+	var resolved ChartVersion
+	for _, indexChart := range i.charts {
+		if strings.TrimSuffix(indexChart.URI, "/") != strings.TrimSuffix(repoURL, "/") || indexChart.Name != chartName {
+			continue
+		}
 
-			highestChartVersion := semver.MustParse("0.0.0")
-			highestAppVersion := ""
+		for _, version := range indexChart.Versions {
+			parsedChartVersion, err := semver.NewVersion(version.ChartVersion)
+			if err != nil || !constraint.Check(parsedChartVersion) {
+				continue
+			}
+			if newest == nil || parsedChartVersion.GreaterThan(newest) {
+				newest = parsedChartVersion
+				resolved = version
+			}
+		}
+	}
 
-			for _, version := range indexChart.Versions {
-				parsedChartVersion := semver.MustParse(version.ChartVersion)
-				if parsedChartVersion.GreaterThan(highestChartVersion) {
-					highestChartVersion = parsedChartVersion
-					highestAppVersion = version.AppVersion
-				}
+	return resolved, newest != nil
+}
 
-				if version.ChartVersion == chartVersion {
-					if version.AppVersion == appVersion {
+// sortCandidates puts exact matches first, then the same chart version, then the nearest versions
+func sortCandidates(candidates []candidate) {
+	rank := map[MatchQuality]int{MatchExact: 0, MatchChartVersion: 1, MatchNearest: 2}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		if rank[candidates[a].match.MatchQuality] != rank[candidates[b].match.MatchQuality] {
+			return rank[candidates[a].match.MatchQuality] < rank[candidates[b].match.MatchQuality]
+		}
+		return candidates[a].distance.less(candidates[b].distance)
+	})
+}
 
-						chartMatch = &ChartMatch{
-							Repo:         indexChart.Repo,
-							Name:         indexChart.Name,
-							ChartVersion: version.ChartVersion,
-							AppVersion:   version.AppVersion,
-						}
-					}
-				}
+// FindUpstreamMatchesByContent returns the charts whose templates are most like the fingerprint, whatever
+// they're named, at most maxMatches with the most similar first. Only the most similar version of each
+// chart in each repo is returned, and only if its similarity is at least minSimilarity
+func (i *ChartIndex) FindUpstreamMatchesByContent(fingerprint Fingerprint, minSimilarity float64, maxMatches int) []ChartMatch {
+	chartMatches := []ChartMatch{}
+	for _, indexChart := range i.charts {
+		var best *ChartMatch
+		for _, version := range indexChart.Versions {
+			if version.Fingerprint == nil {
+				continue
 			}
 
-			if chartMatch != nil {
-				chartMatch.LatestChartVersion = highestChartVersion.String()
-				chartMatch.LatestAppVersion = highestAppVersion
-				chartMatches = append(chartMatches, *chartMatch)
+			similarity := fingerprint.Similarity(*version.Fingerprint)
+			if similarity < minSimilarity || (best != nil && similarity <= best.Similarity) {
+				continue
 			}
+
+			best = &ChartMatch{
+				Repo:         indexChart.Repo,
+				URI:          indexChart.URI,
+				Name:         indexChart.Name,
+				ChartVersion: version.ChartVersion,
+				AppVersion:   version.AppVersion,
+				ChartURL:     version.URL,
+				MatchQuality: MatchContent,
+				Similarity:   similarity,
+			}
+		}
+
+		if best != nil {
+			best.LatestChartVersion, best.LatestAppVersion = latestVersion(indexChart.Versions)
+			chartMatches = append(chartMatches, *best)
 		}
 	}
-	return chartMatches, nil
+
+	sort.SliceStable(chartMatches, func(a, b int) bool {
+		return chartMatches[a].Similarity > chartMatches[b].Similarity
+	})
+	if maxMatches > 0 && len(chartMatches) > maxMatches {
+		chartMatches = chartMatches[:maxMatches]
+	}
+	return chartMatches
+}
+
+// latestVersion returns the highest chart version that's valid semver, and its app version
+func latestVersion(versions []ChartVersion) (string, string) {
+	var highestChartVersion *semver.Version
+	highestAppVersion := ""
+	for _, version := range versions {
+		parsedChartVersion, err := semver.NewVersion(version.ChartVersion)
+		if err != nil {
+			continue
+		}
+		if highestChartVersion == nil || parsedChartVersion.GreaterThan(highestChartVersion) {
+			highestChartVersion = parsedChartVersion
+			highestAppVersion = version.AppVersion
+		}
+	}
+
+	if highestChartVersion == nil {
+		return "", ""
+	}
+	return highestChartVersion.Original(), highestAppVersion
 }
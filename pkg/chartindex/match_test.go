@@ -0,0 +1,240 @@
+package chartindex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FindBestUpstreamMatches(t *testing.T) {
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "stable",
+				Name: "redis",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7"},
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7"},
+					{ChartVersion: "10.5.5", AppVersion: "5.0.6"},
+					{ChartVersion: "10.4.0", AppVersion: "5.0.5"},
+					{ChartVersion: "9.0.0", AppVersion: "5.0.0"},
+					{ChartVersion: "not-semver", AppVersion: "5.0.0"},
+				},
+			},
+			{
+				Repo: "bitnami",
+				Name: "redis",
+				URI:  "https://charts.bitnami.com/bitnami",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.6", AppVersion: "5.0.6"},
+					{ChartVersion: "v10.6.0", AppVersion: "5.0.7"},
+				},
+			},
+			{
+				Repo: "stable",
+				Name: "mysql",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		chartVersion string
+		appVersion   string
+		maxPerRepo   int
+		expected     []ChartMatch
+	}{
+		{
+			name:         "exact match first",
+			chartVersion: "10.5.6",
+			appVersion:   "5.0.7",
+			maxPerRepo:   2,
+			expected: []ChartMatch{
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.7", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchExact},
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.6", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchChartVersion},
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "v10.6.0", AppVersion: "5.0.7", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+			},
+		},
+		{
+			name:         "a bumped fork matches the nearest patch before the nearest minor",
+			chartVersion: "10.5.8",
+			appVersion:   "5.0.7",
+			maxPerRepo:   1,
+			expected: []ChartMatch{
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.6", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+			},
+		},
+		{
+			name:         "the same app version breaks a tie, then the older chart",
+			chartVersion: "10.5.6",
+			appVersion:   "5.0.6",
+			maxPerRepo:   3,
+			expected: []ChartMatch{
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.6", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchExact},
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.7", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchChartVersion},
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.5", AppVersion: "5.0.6", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "v10.6.0", AppVersion: "5.0.7", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+			},
+		},
+		{
+			name:         "prerelease fork",
+			chartVersion: "10.5.5-fork.1",
+			appVersion:   "5.0.6",
+			maxPerRepo:   1,
+			expected: []ChartMatch{
+				{Repo: "stable", Name: "redis", ChartVersion: "10.5.5", AppVersion: "5.0.6", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+				{Repo: "bitnami", URI: "https://charts.bitnami.com/bitnami", Name: "redis", ChartVersion: "10.5.6", AppVersion: "5.0.6", LatestChartVersion: "v10.6.0", LatestAppVersion: "5.0.7", MatchQuality: MatchNearest},
+			},
+		},
+		{
+			name:         "versions that aren't semver only match exactly",
+			chartVersion: "not-semver",
+			appVersion:   "5.0.0",
+			maxPerRepo:   DefaultMatchesPerRepo,
+			expected: []ChartMatch{
+				{Repo: "stable", Name: "redis", ChartVersion: "not-semver", AppVersion: "5.0.0", LatestChartVersion: "10.5.7", LatestAppVersion: "5.0.7", MatchQuality: MatchExact},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := index.FindBestUpstreamMatches("redis", test.chartVersion, test.appVersion, test.maxPerRepo)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_FindUpstreamMatchesByContent(t *testing.T) {
+	redis := Fingerprint{Templates: []string{"a", "b", "c", "d"}, Kinds: []string{"Deployment", "Service"}}
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "stable",
+				Name: "redis",
+				URI:  "https://charts.example.com/stable",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7", Fingerprint: &Fingerprint{Templates: []string{"a", "b", "c", "e"}, Kinds: redis.Kinds}},
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7", Fingerprint: &redis},
+					{ChartVersion: "10.5.5", AppVersion: "5.0.6"},
+				},
+			},
+			{
+				Repo: "stable",
+				Name: "redis-ha",
+				URI:  "https://charts.example.com/stable",
+				Versions: []ChartVersion{
+					{ChartVersion: "4.0.0", AppVersion: "5.0.7", Fingerprint: &Fingerprint{Templates: []string{"a", "f", "g", "h"}, Kinds: []string{"StatefulSet", "Service"}}},
+				},
+			},
+			{
+				Repo: "stable",
+				Name: "mysql",
+				URI:  "https://charts.example.com/stable",
+				Versions: []ChartVersion{
+					{ChartVersion: "1.6.2", AppVersion: "5.7.28", Fingerprint: &Fingerprint{Templates: []string{"x", "y"}, Kinds: redis.Kinds}},
+				},
+			},
+		},
+	}
+
+	// the fork is renamed, and has changed one template
+	fork := Fingerprint{Templates: []string{"a", "b", "c", "z"}, Kinds: redis.Kinds}
+
+	actual := index.FindUpstreamMatchesByContent(fork, 0.1, 0)
+	require.Len(t, actual, 2)
+	assert.InDelta(t, 0.8*3/5+0.2, actual[0].Similarity, 0.0001)
+	actual[0].Similarity = 0
+	assert.Equal(t, ChartMatch{
+		Repo:               "stable",
+		URI:                "https://charts.example.com/stable",
+		Name:               "redis",
+		ChartVersion:       "10.5.7",
+		AppVersion:         "5.0.7",
+		LatestChartVersion: "10.5.7",
+		LatestAppVersion:   "5.0.7",
+		MatchQuality:       MatchContent,
+	}, actual[0])
+	assert.Equal(t, "content 68%", ChartMatch{MatchQuality: MatchContent, Similarity: 0.68}.MatchDescription())
+	assert.Equal(t, "redis-ha", actual[1].Name)
+
+	assert.Len(t, index.FindUpstreamMatchesByContent(fork, DefaultMinSimilarity, 0), 1)
+	assert.Len(t, index.FindUpstreamMatchesByContent(fork, 0.1, 1), 1)
+}
+
+func Test_ResolveVersionRange(t *testing.T) {
+	index := ChartIndex{
+		charts: []ChartAndVersions{
+			{
+				Repo: "bitnami",
+				Name: "redis",
+				URI:  "https://charts.bitnami.com/bitnami",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.6.1", AppVersion: "5.0.8"},
+					{ChartVersion: "10.5.7", AppVersion: "5.0.7"},
+					{ChartVersion: "10.5.6", AppVersion: "5.0.7"},
+					{ChartVersion: "9.0.0", AppVersion: "5.0.0"},
+				},
+			},
+			{
+				Repo: "stable",
+				Name: "redis",
+				URI:  "https://kubernetes-charts.storage.googleapis.com",
+				Versions: []ChartVersion{
+					{ChartVersion: "10.5.9", AppVersion: "5.0.7"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		repoURL      string
+		versionRange string
+		expected     string
+		expectOK     bool
+	}{
+		{
+			name:         "wildcard",
+			repoURL:      "https://charts.bitnami.com/bitnami",
+			versionRange: "10.5.*",
+			expected:     "10.5.7",
+			expectOK:     true,
+		},
+		{
+			name:         "caret, with a trailing slash on the repo",
+			repoURL:      "https://charts.bitnami.com/bitnami/",
+			versionRange: "^10.0.0",
+			expected:     "10.6.1",
+			expectOK:     true,
+		},
+		{
+			name:         "exact version is not a range",
+			repoURL:      "https://charts.bitnami.com/bitnami",
+			versionRange: "10.5.6",
+			expectOK:     false,
+		},
+		{
+			name:         "nothing in range",
+			repoURL:      "https://charts.bitnami.com/bitnami",
+			versionRange: ">= 11.0.0",
+			expectOK:     false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, ok := index.ResolveVersionRange(test.repoURL, "redis", test.versionRange)
+			assert.Equal(t, test.expectOK, ok)
+			assert.Equal(t, test.expected, version.ChartVersion)
+		})
+	}
+}
@@ -1,7 +1,15 @@
 package chartindex
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type MonocularResponse struct {
@@ -21,9 +29,8 @@ type MonocularChartData struct {
 }
 
 type MonocularChartAttributes struct {
-	Name     string             `json:"name"`
-	Keywords []string           `json:"keywords"`
-	Repo     MonocularChartRepo `json:"repo"`
+	Name string             `json:"name"`
+	Repo MonocularChartRepo `json:"repo"`
 }
 
 type MonocularChartRepo struct {
@@ -46,3 +53,105 @@ type MonocularChartVersionData struct {
 	Readme     string    `json:"readme"`
 	Values     string    `json:"values"`
 }
+
+const (
+	DefaultMonocularURL = "https://hub.kubeapps.com/api/chartsvc"
+)
+
+var (
+	kubeAppsPageSize = 100
+	monocularWorkers = 4
+)
+
+// MonocularProvider lists the repositories of the charts in a Monocular chartsvc API
+type MonocularProvider struct {
+	URL string
+}
+
+func (p MonocularProvider) Name() string {
+	return SourceMonocular
+}
+
+// Repositories gets the first page of charts to find the number of pages, and then gets the
+// rest of the pages at the same time
+func (p MonocularProvider) Repositories() ([]Repository, error) {
+	baseURL := p.URL
+	if baseURL == "" {
+		baseURL = DefaultMonocularURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	firstPage, err := getMonocularPage(baseURL, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]*MonocularResponse, firstPage.Meta.TotalPages)
+	errs := make([]error, firstPage.Meta.TotalPages)
+	if len(pages) > 0 {
+		pages[0] = firstPage
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < monocularWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range jobs {
+				pages[page-1], errs[page-1] = getMonocularPage(baseURL, page)
+			}
+		}()
+	}
+	for page := 2; page <= firstPage.Meta.TotalPages; page++ {
+		jobs <- page
+	}
+	close(jobs)
+	wg.Wait()
+
+	repositories := []Repository{}
+	seenRepos := map[string]bool{}
+	for i, page := range pages {
+		if errs[i] != nil {
+			return nil, errors.Wrapf(errs[i], "failed to get page %d", i+1)
+		}
+
+		for _, chart := range page.Data {
+			if _, ok := seenRepos[chart.Attributes.Repo.URL]; ok {
+				continue
+			}
+			repositories = append(repositories, Repository{
+				Name:   chart.Attributes.Repo.Name,
+				URL:    chart.Attributes.Repo.URL,
+				Source: SourceMonocular,
+			})
+			seenRepos[chart.Attributes.Repo.URL] = true
+		}
+	}
+
+	return repositories, nil
+}
+
+func getMonocularPage(baseURL string, page int) (*MonocularResponse, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/v1/charts?size=%d&page=%d", baseURL, kubeAppsPageSize, page))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	monocularResponse := MonocularResponse{}
+	if err := json.Unmarshal(body, &monocularResponse); err != nil {
+		return nil, err
+	}
+
+	return &monocularResponse, nil
+}
@@ -0,0 +1,24 @@
+package chartindex
+
+const (
+	SourceRepositories = "repositories"
+	SourceMonocular    = "monocular"
+	SourceArtifactHub  = "artifacthub"
+	SourceUnfork       = "unfork"
+	SourceHelm2        = "helm2"
+	SourceHelm3        = "helm3"
+	SourceIndexURL     = "index-url"
+)
+
+// Provider lists chart repositories to add to the index
+type Provider interface {
+	Name() string
+	Repositories() ([]Repository, error)
+}
+
+// Repository is a chart repository to add to the index, and where it was found
+type Repository struct {
+	Name   string
+	URL    string
+	Source string
+}
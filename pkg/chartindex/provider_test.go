@@ -0,0 +1,164 @@
+package chartindex
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MonocularProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/chartsvc/v1/charts", r.URL.Path)
+
+		switch r.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprint(w, `{"data": [
+				{"attributes": {"name": "redis", "repo": {"name": "stable", "url": "https://charts.example.com/stable"}}},
+				{"attributes": {"name": "mysql", "repo": {"name": "stable", "url": "https://charts.example.com/stable"}}}
+			], "meta": {"totalPages": 2}}`)
+		case "2":
+			fmt.Fprint(w, `{"data": [
+				{"attributes": {"name": "nginx-ingress", "repo": {"name": "nginx", "url": "https://charts.example.com/nginx"}}}
+			], "meta": {"totalPages": 2}}`)
+		default:
+			fmt.Fprint(w, `{"data": [], "meta": {"totalPages": 2}}`)
+		}
+	}))
+	defer server.Close()
+
+	repositories, err := MonocularProvider{URL: server.URL + "/api/chartsvc/"}.Repositories()
+	require.NoError(t, err)
+	assert.Equal(t, []Repository{
+		{Name: "stable", URL: "https://charts.example.com/stable", Source: SourceMonocular},
+		{Name: "nginx", URL: "https://charts.example.com/nginx", Source: SourceMonocular},
+	}, repositories)
+}
+
+func Test_ArtifactHubProvider(t *testing.T) {
+	pageSize := artifactHubPageSize
+	artifactHubPageSize = 2
+	defer func() { artifactHubPageSize = pageSize }()
+
+	allRepositories := []string{
+		`{"name": "bitnami", "url": "https://charts.bitnami.com/bitnami/", "kind": 0}`,
+		`{"name": "falco-rules", "url": "https://github.com/falcosecurity/rules", "kind": 1}`,
+		`{"name": "redis", "url": "oci://ghcr.io/example/charts/redis", "kind": 0}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/repositories/search", r.URL.Path)
+		require.Equal(t, "0", r.URL.Query().Get("kind"))
+
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		require.NoError(t, err)
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		require.NoError(t, err)
+
+		page := "["
+		for i := offset; i < offset+limit && i < len(allRepositories); i++ {
+			if i > offset {
+				page += ","
+			}
+			page += allRepositories[i]
+		}
+		page += "]"
+
+		w.Header().Set("Pagination-Total-Count", strconv.Itoa(len(allRepositories)))
+		fmt.Fprint(w, page)
+	}))
+	defer server.Close()
+
+	repositories, err := ArtifactHubProvider{URL: server.URL}.Repositories()
+	require.NoError(t, err)
+	assert.Equal(t, []Repository{
+		{Name: "bitnami", URL: "https://charts.bitnami.com/bitnami", Source: SourceArtifactHub},
+		{Name: "redis", URL: "oci://ghcr.io/example/charts/redis", Source: SourceArtifactHub},
+	}, repositories)
+}
+
+func Test_ArtifactHubProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := ArtifactHubProvider{URL: server.URL}.Repositories()
+	require.Error(t, err)
+}
+
+type fakeProvider struct {
+	repositories []Repository
+	err          error
+}
+
+func (p fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p fakeProvider) Repositories() ([]Repository, error) {
+	return p.repositories, p.err
+}
+
+func Test_Build(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/internal/index.yaml", r.URL.Path)
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `apiVersion: v1
+entries:
+  redis:
+  - apiVersion: v1
+    appVersion: 5.0.7
+    name: redis
+    version: 10.5.7
+    urls:
+    - redis-10.5.7.tgz
+generated: "2020-01-01T00:00:00Z"
+`)
+	}))
+	defer server.Close()
+
+	providers := []Provider{
+		fakeProvider{err: fmt.Errorf("the hub is down")},
+		RepositoriesProvider{IndexURLs: []string{server.URL + "/internal/index.yaml"}},
+		// the same repository is only indexed the first time
+		fakeProvider{repositories: []Repository{{Name: "other", URL: server.URL + "/internal", Source: SourceArtifactHub}}},
+	}
+
+	repoConfigs := chartrepo.Configs{
+		{URL: server.URL + "/internal", Username: "user", Password: "secret"},
+	}
+
+	index := ChartIndex{}
+	require.NoError(t, index.Build(BuildOptions{RepoConfigs: repoConfigs, Providers: providers}))
+	assert.Equal(t, []ChartAndVersions{
+		{
+			Repo:   "internal",
+			Name:   "redis",
+			URI:    server.URL + "/internal",
+			Source: SourceIndexURL,
+			Versions: []ChartVersion{
+				{ChartVersion: "10.5.7", AppVersion: "5.0.7"},
+			},
+		},
+	}, index.charts)
+	assert.True(t, index.HasRepo(server.URL+"/internal"))
+
+	// the provider that failed is recorded, for the caller to report
+	require.Len(t, index.ProviderErrors(), 1)
+	assert.EqualError(t, index.ProviderErrors()[0], "failed to list repositories from fake: the hub is down")
+
+	// there's nothing to index when every provider fails
+	require.Error(t, index.Build(BuildOptions{
+		RepoConfigs: repoConfigs,
+		Providers:   []Provider{fakeProvider{err: fmt.Errorf("the hub is down")}},
+	}))
+}
@@ -0,0 +1,129 @@
+package chartindex
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/replicatedhq/unfork/pkg/util"
+)
+
+// RepositoriesProvider lists the repositories in unfork's repositories file, the ones that the
+// user has added to helm, and the repositories of plain index.yaml files
+type RepositoriesProvider struct {
+	UnforkRepositoriesFile string
+	Helm2RepositoriesFile  string
+	Helm3RepositoriesFile  string
+	IndexURLs              []string
+}
+
+// DefaultUnforkRepositoriesFile is unfork's own repositories file, for repositories that
+// aren't added to helm or that need settings that helm doesn't have
+func DefaultUnforkRepositoriesFile() string {
+	return filepath.Join(util.ConfigDir(), "unfork", "repositories.yaml")
+}
+
+// DefaultHelm2RepositoriesFile is the repositories file of the helm 2 client, in $HELM_HOME
+func DefaultHelm2RepositoriesFile() string {
+	helmHome := os.Getenv("HELM_HOME")
+	if helmHome == "" {
+		helmHome = filepath.Join(util.HomeDir(), ".helm")
+	}
+	return filepath.Join(helmHome, "repository", "repositories.yaml")
+}
+
+// DefaultHelm3RepositoriesFile is the repositories file of the helm 3 client
+func DefaultHelm3RepositoriesFile() string {
+	if repositoriesFile := os.Getenv("HELM_REPOSITORY_CONFIG"); repositoriesFile != "" {
+		return repositoriesFile
+	}
+	return filepath.Join(util.ConfigDir(), "helm", "repositories.yaml")
+}
+
+func (p RepositoriesProvider) Name() string {
+	return SourceRepositories
+}
+
+// Repositories lists the repositories in the repositories files, followed by the index urls
+func (p RepositoriesProvider) Repositories() ([]Repository, error) {
+	repositories := []Repository{}
+
+	unforkRepositories, err := repositoriesFromFile(p.UnforkRepositoriesFile, SourceUnfork)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read unfork repositories")
+	}
+	repositories = append(repositories, unforkRepositories...)
+
+	helm2Repositories, err := repositoriesFromFile(p.Helm2RepositoriesFile, SourceHelm2)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read helm 2 repositories")
+	}
+	repositories = append(repositories, helm2Repositories...)
+
+	helm3Repositories, err := repositoriesFromFile(p.Helm3RepositoriesFile, SourceHelm3)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read helm 3 repositories")
+	}
+	repositories = append(repositories, helm3Repositories...)
+
+	for _, indexURL := range p.IndexURLs {
+		repository, err := repositoryFromIndexURL(indexURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse index url %s", indexURL)
+		}
+		repositories = append(repositories, repository)
+	}
+
+	return repositories, nil
+}
+
+// repositoriesFromFile reads a helm 2, helm 3 or unfork repositories file. Either helm client
+// may not be installed, so a file that doesn't exist has no repositories
+func repositoriesFromFile(filename string, source string) ([]Repository, error) {
+	repoConfigs, err := chartrepo.LoadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories := []Repository{}
+	for _, repoConfig := range repoConfigs {
+		repositories = append(repositories, Repository{
+			Name:   repoConfig.Name,
+			URL:    repoConfig.URL,
+			Source: source,
+		})
+	}
+
+	return repositories, nil
+}
+
+// repositoryFromIndexURL returns the repository that serves an index.yaml. The url can be the
+// index itself or the repository, file:// urls are read from disk, and oci:// urls are a
+// namespace in an oci registry
+func repositoryFromIndexURL(indexURL string) (Repository, error) {
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return Repository{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" && u.Scheme != "oci" {
+		return Repository{}, errors.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	repoURL := strings.TrimSuffix(strings.TrimSuffix(indexURL, "/"), "/index.yaml")
+
+	// name the repository for its last path element, or its host
+	name := path.Base(strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/index.yaml"))
+	if name == "/" || name == "." {
+		name = u.Host
+	}
+
+	return Repository{
+		Name:   name,
+		URL:    repoURL,
+		Source: SourceIndexURL,
+	}, nil
+}
@@ -0,0 +1,159 @@
+package chartindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_repositoriesFromFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		source   string
+		expected []Repository
+	}{
+		{
+			name: "helm 2",
+			content: `apiVersion: v1
+generated: "2019-05-29T14:31:58.906598702Z"
+repositories:
+- caFile: ""
+  cache: /home/user/.helm/repository/cache/stable-index.yaml
+  certFile: ""
+  keyFile: ""
+  name: stable
+  password: ""
+  url: https://kubernetes-charts.storage.googleapis.com
+  username: ""
+- cache: /home/user/.helm/repository/cache/local-index.yaml
+  name: local
+  url: http://127.0.0.1:8879/charts
+`,
+			source: SourceHelm2,
+			expected: []Repository{
+				{Name: "stable", URL: "https://kubernetes-charts.storage.googleapis.com", Source: SourceHelm2},
+				{Name: "local", URL: "http://127.0.0.1:8879/charts", Source: SourceHelm2},
+			},
+		},
+		{
+			name: "helm 3 doesn't set the api version",
+			content: `apiVersion: ""
+generated: "0001-01-01T00:00:00Z"
+repositories:
+- caFile: ""
+  certFile: ""
+  insecure_skip_tls_verify: false
+  keyFile: ""
+  name: internal
+  password: ""
+  url: https://charts.example.com/internal/
+  username: ""
+`,
+			source: SourceHelm3,
+			expected: []Repository{
+				{Name: "internal", URL: "https://charts.example.com/internal", Source: SourceHelm3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			repositoriesFile, err := ioutil.TempFile("", "repositories")
+			req.NoError(err)
+			defer os.Remove(repositoriesFile.Name())
+
+			_, err = repositoriesFile.WriteString(test.content)
+			req.NoError(err)
+			req.NoError(repositoriesFile.Close())
+
+			actual, err := repositoriesFromFile(repositoriesFile.Name(), test.source)
+			req.NoError(err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+
+	actual, err := repositoriesFromFile(filepath.Join(os.TempDir(), "does-not-exist", "repositories.yaml"), SourceHelm2)
+	require.NoError(t, err)
+	assert.Empty(t, actual)
+}
+
+func Test_repositoryFromIndexURL(t *testing.T) {
+	tests := []struct {
+		indexURL    string
+		expected    Repository
+		expectError bool
+	}{
+		{
+			indexURL: "https://charts.example.com/index.yaml",
+			expected: Repository{Name: "charts.example.com", URL: "https://charts.example.com", Source: SourceIndexURL},
+		},
+		{
+			indexURL: "https://example.com/helm/stable/",
+			expected: Repository{Name: "stable", URL: "https://example.com/helm/stable", Source: SourceIndexURL},
+		},
+		{
+			indexURL: "file:///srv/charts/index.yaml",
+			expected: Repository{Name: "charts", URL: "file:///srv/charts", Source: SourceIndexURL},
+		},
+		{
+			indexURL:    "s3://bucket/charts",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.indexURL, func(t *testing.T) {
+			actual, err := repositoryFromIndexURL(test.indexURL)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_indexRepoFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	index := `apiVersion: v1
+entries:
+  redis:
+  - apiVersion: v1
+    appVersion: 5.0.7
+    name: redis
+    version: 10.5.7
+    digest: sha256:3d1ab9bd4a2ee7f5b1c6d6e7b8a9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7
+    urls:
+    - redis-10.5.7.tgz
+  - apiVersion: v1
+    appVersion: 5.0.6
+    name: redis
+    version: 10.5.6
+    deprecated: true
+    urls:
+    - redis-10.5.6.tgz
+generated: "2020-01-01T00:00:00Z"
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.yaml"), []byte(index), 0644))
+
+	repository := Repository{Name: "internal", URL: "file://" + dir, Source: SourceIndexURL}
+	result := indexRepo(repository, chartrepo.Config{URL: repository.URL}, nil, nil, 0, newHostLimiter(0))
+	assert.Empty(t, result.record.Error)
+	require.Len(t, result.charts, 1)
+	assert.Equal(t, []ChartVersion{
+		{ChartVersion: "10.5.7", AppVersion: "5.0.7", Digest: "3d1ab9bd4a2ee7f5b1c6d6e7b8a9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7"},
+		{ChartVersion: "10.5.6", AppVersion: "5.0.6", Deprecated: true},
+	}, result.charts[0].Versions)
+}
@@ -0,0 +1,332 @@
+package chartrepo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/repo"
+)
+
+// requestTimeout is the longest a request can take, including reading a chart archive
+const requestTimeout = 2 * time.Minute
+
+var (
+	// httpClients are shared by the configs with the same tls and proxy settings
+	httpClients   = map[clientKey]*http.Client{}
+	httpClientsMu sync.Mutex
+)
+
+// clientKey is the settings of a config that its http client depends on. Credentials are
+// sent with each request, so configs with different credentials share a client
+type clientKey struct {
+	CertFile              string
+	KeyFile               string
+	CAFile                string
+	InsecureSkipTLSVerify bool
+	Proxy                 string
+}
+
+// Validators identify the version of an index.yaml that was downloaded, so that it's only
+// downloaded again if it's changed
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// DownloadIndex returns the index.yaml of the repository. file:// repositories are read from disk
+func (c Config) DownloadIndex() ([]byte, error) {
+	return c.get(c.URL + "/index.yaml")
+}
+
+// DownloadIndexIfModified returns the index.yaml of the repository, unless it hasn't changed
+// since the download that returned validators. The index is nil if it hasn't changed
+func (c Config) DownloadIndexIfModified(validators Validators) ([]byte, Validators, error) {
+	indexURL := c.URL + "/index.yaml"
+	if strings.HasPrefix(indexURL, "file://") {
+		b, err := c.get(indexURL)
+		return b, Validators{}, err
+	}
+
+	header := http.Header{}
+	if validators.ETag != "" {
+		header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	resp, b, err := c.do(indexURL, header)
+	if err != nil {
+		return nil, Validators{}, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, validators, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, Validators{}, errors.Errorf("unexpected status code %d from %s", resp.StatusCode, indexURL)
+	}
+
+	return b, Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// ParseIndex parses an index.yaml
+func ParseIndex(b []byte) (*repo.IndexFile, error) {
+	index := repo.IndexFile{}
+	if err := yaml.Unmarshal(b, &index); err != nil {
+		return nil, errors.Wrap(err, "failed to parse index")
+	}
+	if index.APIVersion == "" {
+		return nil, repo.ErrNoAPIVersion
+	}
+	index.SortEntries()
+
+	return &index, nil
+}
+
+// LoadIndex downloads and parses the index.yaml of the repository. oci registries don't have
+// an index.yaml, so one is created from the charts in the registry
+func (c Config) LoadIndex() (*repo.IndexFile, error) {
+	if IsOCI(c.URL) {
+		return c.loadOCIIndex()
+	}
+
+	b, err := c.DownloadIndex()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download index")
+	}
+
+	return ParseIndex(b)
+}
+
+// DownloadChart returns the archive of a version of a chart in the repository
+func (c Config) DownloadChart(chartName string, chartVersion string) ([]byte, error) {
+	// a chart is usually in a repository named for it, which saves listing the whole namespace.
+	// If it isn't found there or in the index, the error of pulling it directly is returned, which
+	// is the more useful one for registries that can't be listed
+	var pullErr error
+	if IsOCI(c.URL) {
+		archive, err := c.downloadOCIChart(fmt.Sprintf("%s/%s:%s", c.URL, chartName, ociTag(chartVersion)))
+		if err == nil {
+			return archive, nil
+		}
+		pullErr = errors.Wrapf(err, "failed to pull %s@%s", chartName, chartVersion)
+	}
+
+	index, err := c.LoadIndex()
+	if err != nil {
+		if pullErr != nil {
+			return nil, pullErr
+		}
+		return nil, err
+	}
+
+	version, err := index.Get(chartName, chartVersion)
+	if err != nil {
+		if pullErr != nil {
+			return nil, pullErr
+		}
+		return nil, errors.Wrapf(err, "failed to find %s@%s", chartName, chartVersion)
+	}
+
+	return c.DownloadChartVersion(version)
+}
+
+// DownloadChartVersion downloads the archive of a chart version in the repository's index
+func (c Config) DownloadChartVersion(version *repo.ChartVersion) ([]byte, error) {
+	if len(version.URLs) == 0 {
+		return nil, errors.Errorf("%s@%s has no download urls", version.GetName(), version.GetVersion())
+	}
+
+	if IsOCI(version.URLs[0]) {
+		return c.downloadOCIChart(version.URLs[0])
+	}
+
+	chartURL, err := c.resolveURL(version.URLs[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve chart url")
+	}
+
+	return c.get(chartURL)
+}
+
+// resolveURL resolves a url in the index, which can be relative to the repository
+func (c Config) resolveURL(ref string) (string, error) {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(refURL).String(), nil
+}
+
+func (c Config) get(getURL string) ([]byte, error) {
+	if strings.HasPrefix(getURL, "file://") {
+		return ioutil.ReadFile(filepath.FromSlash(strings.TrimPrefix(getURL, "file://")))
+	}
+
+	resp, b, err := c.do(getURL, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code %d from %s", resp.StatusCode, getURL)
+	}
+
+	return b, nil
+}
+
+// do gets getURL with the repository's credentials, and returns the response and its body
+func (c Config) do(getURL string, header http.Header) (*http.Response, []byte, error) {
+	client, err := c.httpClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest("GET", getURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = header
+
+	// charts can be served from another host, which mustn't be sent the repository's credentials
+	if sameHost(c.URL, getURL) {
+		if c.Token != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+		} else if c.Username != "" || c.Password != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, b, nil
+}
+
+// httpClient returns the client for the config's tls and proxy settings. Clients are shared by
+// every config with the same settings, so that connections to a host are reused between requests
+func (c Config) httpClient() (*http.Client, error) {
+	key := clientKey{
+		CertFile:              c.CertFile,
+		KeyFile:               c.KeyFile,
+		CAFile:                c.CAFile,
+		InsecureSkipTLSVerify: c.InsecureSkipTLSVerify,
+		Proxy:                 c.Proxy,
+	}
+
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+
+	if client, ok := httpClients[key]; ok {
+		return client, nil
+	}
+
+	client, err := c.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	httpClients[key] = client
+
+	return client, nil
+}
+
+// newHTTPClient creates a client with the tls and proxy settings of the config. Each request times
+// out, so that a repository that stops responding fails instead of blocking the index, and idle
+// connections are closed
+func (c Config) newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipTLSVerify,
+	}
+
+	if c.CAFile != "" {
+		caCert, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca file")
+		}
+
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("no certificates found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse proxy url")
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		Timeout: requestTimeout,
+	}, nil
+}
+
+func sameHost(a string, b string) bool {
+	aURL, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	bURL, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return aURL.Host == bURL.Host
+}
@@ -0,0 +1,208 @@
+package chartrepo
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIndex = `apiVersion: v1
+entries:
+  redis:
+  - apiVersion: v1
+    appVersion: 5.0.7
+    name: redis
+    version: 10.5.7
+    urls:
+    - charts/redis-10.5.7.tgz
+  - apiVersion: v1
+    appVersion: 5.0.6
+    name: redis
+    version: 10.5.6
+    urls:
+    - %s/redis-10.5.6.tgz
+generated: "2020-01-01T00:00:00Z"
+`
+
+func Test_LoadFile(t *testing.T) {
+	repositoriesFile, err := ioutil.TempFile("", "repositories")
+	require.NoError(t, err)
+	defer os.Remove(repositoriesFile.Name())
+
+	_, err = repositoriesFile.WriteString(`apiVersion: ""
+repositories:
+- name: internal
+  url: https://charts.example.com/internal/
+  username: user
+  password: secret
+  caFile: /etc/ssl/internal-ca.pem
+  insecure_skip_tls_verify: true
+- name: tokens
+  url: https://tokens.example.com
+  token: abc
+  proxy: http://proxy.example.com:3128
+- name: empty
+`)
+	require.NoError(t, err)
+	require.NoError(t, repositoriesFile.Close())
+
+	configs, err := LoadFile(repositoriesFile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, Configs{
+		{
+			Name:                  "internal",
+			URL:                   "https://charts.example.com/internal",
+			Username:              "user",
+			Password:              "secret",
+			CAFile:                "/etc/ssl/internal-ca.pem",
+			InsecureSkipTLSVerify: true,
+		},
+		{
+			Name:  "tokens",
+			URL:   "https://tokens.example.com",
+			Token: "abc",
+			Proxy: "http://proxy.example.com:3128",
+		},
+	}, configs)
+
+	assert.Equal(t, "user", configs.ForURL("https://charts.example.com/internal/").Username)
+	assert.Equal(t, Config{URL: "https://charts.example.com"}, configs.ForURL("https://charts.example.com"))
+
+	configs, err = LoadFile("/does/not/exist/repositories.yaml")
+	require.NoError(t, err)
+	assert.Empty(t, configs)
+}
+
+func Test_DownloadChart(t *testing.T) {
+	// charts can be served from another host, which never gets the credentials
+	otherHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "redis-10.5.6")
+	}))
+	defer otherHost.Close()
+
+	tests := []struct {
+		name       string
+		authorized func(r *http.Request) bool
+		config     func(url string) Config
+	}{
+		{
+			name: "basic auth",
+			authorized: func(r *http.Request) bool {
+				username, password, ok := r.BasicAuth()
+				return ok && username == "user" && password == "secret"
+			},
+			config: func(url string) Config {
+				return Config{URL: url, Username: "user", Password: "secret"}
+			},
+		},
+		{
+			name: "bearer token",
+			authorized: func(r *http.Request) bool {
+				return r.Header.Get("Authorization") == "Bearer abc"
+			},
+			config: func(url string) Config {
+				return Config{URL: url, Token: "abc"}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !test.authorized(r) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				switch r.URL.Path {
+				case "/internal/index.yaml":
+					fmt.Fprintf(w, testIndex, otherHost.URL)
+				case "/internal/charts/redis-10.5.7.tgz":
+					fmt.Fprint(w, "redis-10.5.7")
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := test.config(server.URL + "/internal")
+
+			archive, err := config.DownloadChart("redis", "10.5.7")
+			req.NoError(err)
+			assert.Equal(t, "redis-10.5.7", string(archive))
+
+			archive, err = config.DownloadChart("redis", "10.5.6")
+			req.NoError(err)
+			assert.Equal(t, "redis-10.5.6", string(archive))
+
+			_, err = config.DownloadChart("redis", "1.0.0")
+			req.Error(err)
+
+			_, err = Config{URL: server.URL + "/internal"}.DownloadChart("redis", "10.5.7")
+			req.Error(err)
+		})
+	}
+}
+
+func Test_DownloadIndexTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, testIndex, "https://example.com")
+	}))
+	defer server.Close()
+
+	caFile, err := ioutil.TempFile("", "ca")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+	require.NoError(t, pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.NoError(t, caFile.Close())
+
+	_, err = Config{URL: server.URL}.LoadIndex()
+	require.Error(t, err)
+
+	index, err := Config{URL: server.URL, CAFile: caFile.Name()}.LoadIndex()
+	require.NoError(t, err)
+	assert.Len(t, index.Entries["redis"], 2)
+
+	_, err = Config{URL: server.URL, InsecureSkipTLSVerify: true}.LoadIndex()
+	require.NoError(t, err)
+}
+
+func Test_proxy(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		fmt.Fprintf(w, testIndex, "https://example.com")
+	}))
+	defer proxy.Close()
+
+	_, err := Config{URL: "http://charts.example.invalid", Proxy: proxy.URL}.LoadIndex()
+	require.NoError(t, err)
+	assert.True(t, proxied)
+}
+
+func Test_httpClient(t *testing.T) {
+	client, err := Config{URL: "https://charts.example.com", Username: "user", Password: "secret"}.httpClient()
+	require.NoError(t, err)
+	assert.Equal(t, requestTimeout, client.Timeout)
+
+	// credentials are sent with each request, so they share the client and its connections
+	anonymous, err := Config{URL: "https://other.example.com"}.httpClient()
+	require.NoError(t, err)
+	assert.True(t, client == anonymous)
+
+	insecure, err := Config{URL: "https://charts.example.com", InsecureSkipTLSVerify: true}.httpClient()
+	require.NoError(t, err)
+	assert.False(t, client == insecure)
+}
@@ -0,0 +1,81 @@
+package chartrepo
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Config is how to connect to a chart repository. The fields are the same as in the helm 2
+// and helm 3 repositories files, so entries can be copied from them into unfork's file
+type Config struct {
+	Name                  string `json:"name"`
+	URL                   string `json:"url"`
+	Username              string `json:"username,omitempty"`
+	Password              string `json:"password,omitempty"`
+	Token                 string `json:"token,omitempty"`
+	CertFile              string `json:"certFile,omitempty"`
+	KeyFile               string `json:"keyFile,omitempty"`
+	CAFile                string `json:"caFile,omitempty"`
+	InsecureSkipTLSVerify bool   `json:"insecure_skip_tls_verify,omitempty"`
+	Proxy                 string `json:"proxy,omitempty"`
+	// PlainHTTP connects to an oci registry without tls
+	PlainHTTP bool `json:"plainHttp,omitempty"`
+}
+
+// Configs are the configured repositories, in order of precedence
+type Configs []Config
+
+type repositoriesFile struct {
+	Repositories []Config `json:"repositories"`
+}
+
+// LoadFile reads the repositories in a helm 2, helm 3 or unfork repositories file. A file
+// that doesn't exist has no repositories
+func LoadFile(filename string) (Configs, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filename)
+	}
+
+	file := repositoriesFile{}
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filename)
+	}
+
+	configs := Configs{}
+	for _, config := range file.Repositories {
+		if config.URL == "" {
+			continue
+		}
+		config.URL = strings.TrimSuffix(config.URL, "/")
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// ForURL returns the config of the repository at repoURL. A repository that isn't configured
+// is connected to anonymously
+func (c Configs) ForURL(repoURL string) Config {
+	repoURL = strings.TrimSuffix(repoURL, "/")
+
+	for _, config := range c {
+		if config.URL == repoURL {
+			return config
+		}
+	}
+
+	return Config{
+		URL: repoURL,
+	}
+}
@@ -0,0 +1,440 @@
+package chartrepo
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+const (
+	ociManifestMediaType     = "application/vnd.oci.image.manifest.v1+json"
+	helmConfigMediaType      = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType       = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	helmLegacyChartMediaType = "application/tar+gzip"
+)
+
+var (
+	ociPageSize = 100
+
+	linkNextPattern  = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+	authParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	ociScopePattern  = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/`)
+
+	// ociAuthorizations are the tokens that registries have issued, for each host, scope and
+	// credentials, so that each request doesn't need to be challenged and exchange a token again
+	ociAuthorizations   = map[string]string{}
+	ociAuthorizationsMu sync.Mutex
+)
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociCatalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+type ociTags struct {
+	Tags []string `json:"tags"`
+}
+
+// IsOCI returns true if repoURL is a namespace in an oci registry, such as oci://registry.example.com/charts.
+// Each repository in the namespace is a chart, and each of its tags is a version
+func IsOCI(repoURL string) bool {
+	return strings.HasPrefix(repoURL, "oci://")
+}
+
+// ociReference is a chart in an oci registry
+type ociReference struct {
+	host       string
+	repository string
+	tag        string
+}
+
+func parseOCIReference(ref string) (ociReference, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ociReference{}, err
+	}
+	if u.Scheme != "oci" {
+		return ociReference{}, errors.Errorf("%s is not an oci reference", ref)
+	}
+
+	repository := strings.Trim(u.Path, "/")
+	tag := ""
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		tag = repository[i+1:]
+		repository = repository[:i]
+	}
+
+	return ociReference{
+		host:       u.Host,
+		repository: repository,
+		tag:        tag,
+	}, nil
+}
+
+// ParseOCIChart splits a chart reference such as oci://registry.example.com/charts/redis:10.5.7
+// into the namespace that's the chart's repository, the chart's name and its version
+func ParseOCIChart(chartRef string) (string, string, string, error) {
+	ref, err := parseOCIReference(chartRef)
+	if err != nil {
+		return "", "", "", err
+	}
+	if ref.tag == "" {
+		return "", "", "", errors.Errorf("%s has no version", chartRef)
+	}
+
+	namespace := ""
+	chartName := ref.repository
+	if i := strings.LastIndex(ref.repository, "/"); i >= 0 {
+		namespace = "/" + ref.repository[:i]
+		chartName = ref.repository[i+1:]
+	}
+
+	return fmt.Sprintf("oci://%s%s", ref.host, namespace), chartName, strings.Replace(ref.tag, "_", "+", -1), nil
+}
+
+// ociTag is the tag of a chart version. oci tags can't contain a +, so helm replaces it with _
+func ociTag(chartVersion string) string {
+	return strings.Replace(chartVersion, "+", "_", -1)
+}
+
+// loadOCIIndex lists the charts in the oci namespace, and creates an index of them
+func (c Config) loadOCIIndex() (*repo.IndexFile, error) {
+	namespace, err := parseOCIReference(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories, err := c.ociChartRepositories(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	index := repo.NewIndexFile()
+	for _, repository := range repositories {
+		tags, err := c.ociList(namespace.host, fmt.Sprintf("/v2/%s/tags/list?n=%d", repository, ociPageSize), func(b []byte) ([]string, error) {
+			tags := ociTags{}
+			err := json.Unmarshal(b, &tags)
+			return tags.Tags, err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list tags of %s", repository)
+		}
+
+		for _, tag := range tags {
+			ref := ociReference{host: namespace.host, repository: repository, tag: tag}
+
+			manifest, err := c.ociManifest(ref)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get manifest of %s:%s", repository, tag)
+			}
+			if manifest.Config.MediaType != helmConfigMediaType {
+				// an image, or another kind of artifact
+				continue
+			}
+
+			b, err := c.ociBlob(ref, manifest.Config.Digest)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get config of %s:%s", repository, tag)
+			}
+			metadata := chart.Metadata{}
+			if err := json.Unmarshal(b, &metadata); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse config of %s:%s", repository, tag)
+			}
+
+			// the digest of the chart archive is the same as in the index.yaml of a repo with the same chart
+			digest := ""
+			for _, layer := range manifest.Layers {
+				if layer.MediaType == helmChartMediaType || layer.MediaType == helmLegacyChartMediaType {
+					digest = strings.TrimPrefix(layer.Digest, "sha256:")
+				}
+			}
+
+			index.Entries[metadata.Name] = append(index.Entries[metadata.Name], &repo.ChartVersion{
+				Metadata: &metadata,
+				URLs:     []string{fmt.Sprintf("oci://%s/%s:%s", ref.host, ref.repository, ref.tag)},
+				Created:  time.Now(),
+				Digest:   digest,
+			})
+		}
+	}
+
+	index.SortEntries()
+	return index, nil
+}
+
+// ociChartRepositories returns the repositories in the namespace that can be charts, and the namespace
+// itself. Most public registries don't serve the catalog, so a namespace that's a chart's own repository,
+// such as an oci repository on artifact hub, is listed by its tags instead
+func (c Config) ociChartRepositories(namespace ociReference) ([]string, error) {
+	catalog, catalogErr := c.ociList(namespace.host, fmt.Sprintf("/v2/_catalog?n=%d", ociPageSize), func(b []byte) ([]string, error) {
+		catalog := ociCatalog{}
+		err := json.Unmarshal(b, &catalog)
+		return catalog.Repositories, err
+	})
+	if catalogErr != nil {
+		if namespace.repository == "" {
+			return nil, errors.Wrap(catalogErr, "failed to list registry catalog")
+		}
+		if _, err := c.ociList(namespace.host, fmt.Sprintf("/v2/%s/tags/list?n=1", namespace.repository), func([]byte) ([]string, error) { return nil, nil }); err != nil {
+			return nil, errors.Wrapf(catalogErr, "failed to list registry catalog, and %s is not a chart (%s)", namespace.repository, err.Error())
+		}
+		return []string{namespace.repository}, nil
+	}
+
+	repositories := []string{}
+	for _, repository := range catalog {
+		if repository == namespace.repository {
+			repositories = append(repositories, repository)
+			continue
+		}
+
+		chartName := repository
+		if namespace.repository != "" {
+			if !strings.HasPrefix(repository, namespace.repository+"/") {
+				continue
+			}
+			chartName = strings.TrimPrefix(repository, namespace.repository+"/")
+		}
+		if strings.Contains(chartName, "/") {
+			// in a nested namespace
+			continue
+		}
+		repositories = append(repositories, repository)
+	}
+
+	return repositories, nil
+}
+
+// downloadOCIChart returns the chart archive in the oci reference
+func (c Config) downloadOCIChart(chartRef string) ([]byte, error) {
+	ref, err := parseOCIReference(chartRef)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := c.ociManifest(ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get manifest")
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == helmChartMediaType || layer.MediaType == helmLegacyChartMediaType {
+			return c.ociBlob(ref, layer.Digest)
+		}
+	}
+
+	return nil, errors.Errorf("%s is not a helm chart", chartRef)
+}
+
+func (c Config) ociManifest(ref ociReference) (*ociManifest, error) {
+	b, _, err := c.ociGet(ref.host, fmt.Sprintf("/v2/%s/manifests/%s", ref.repository, ref.tag), ociManifestMediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := ociManifest{}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to parse manifest")
+	}
+
+	return &manifest, nil
+}
+
+func (c Config) ociBlob(ref ociReference, digest string) ([]byte, error) {
+	b, _, err := c.ociGet(ref.host, fmt.Sprintf("/v2/%s/blobs/%s", ref.repository, digest), "")
+	return b, err
+}
+
+// ociList follows the pagination of a registry list api, and returns all of the items
+func (c Config) ociList(host string, uri string, parse func([]byte) ([]string, error)) ([]string, error) {
+	items := []string{}
+
+	for uri != "" {
+		b, header, err := c.ociGet(host, uri, "")
+		if err != nil {
+			return nil, err
+		}
+
+		pageItems, err := parse(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse list")
+		}
+		items = append(items, pageItems...)
+
+		uri = ""
+		if match := linkNextPattern.FindStringSubmatch(header.Get("Link")); match != nil {
+			uri = match[1]
+		}
+	}
+
+	return items, nil
+}
+
+// ociGet gets uri from the registry at host. Registries that require a token return a challenge
+// that says where to get one, and the token is requested with the repository's credentials
+func (c Config) ociGet(host string, uri string, accept string) ([]byte, http.Header, error) {
+	client, err := c.httpClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	getURL := fmt.Sprintf("%s://%s%s", c.ociScheme(), host, uri)
+	authorizationKey := c.ociAuthorizationKey(host, uri)
+	authorization := ""
+	if c.Token != "" {
+		authorization = fmt.Sprintf("Bearer %s", c.Token)
+	}
+	ociAuthorizationsMu.Lock()
+	if cached, ok := ociAuthorizations[authorizationKey]; ok {
+		authorization = cached
+	}
+	ociAuthorizationsMu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest("GET", getURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			authorization, err = c.ociAuthorization(client, resp.Header.Get("WWW-Authenticate"))
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to authenticate with registry")
+			}
+			ociAuthorizationsMu.Lock()
+			ociAuthorizations[authorizationKey] = authorization
+			ociAuthorizationsMu.Unlock()
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, errors.Errorf("unexpected status code %d from %s", resp.StatusCode, getURL)
+		}
+
+		return b, resp.Header, nil
+	}
+
+	return nil, nil, errors.Errorf("unauthorized to get %s", getURL)
+}
+
+// ociScheme is http for registries that are configured with plainHttp, and https for the rest
+func (c Config) ociScheme() string {
+	if c.PlainHTTP {
+		return "http"
+	}
+	return "https"
+}
+
+// ociAuthorizationKey is the host, the scope that a token for uri is issued for, and the credentials
+// it was requested with. The credentials are hashed so that they're not kept in memory as is
+func (c Config) ociAuthorizationKey(host string, uri string) string {
+	scope := "registry:catalog:*"
+	if match := ociScopePattern.FindStringSubmatch(uri); match != nil {
+		scope = fmt.Sprintf("repository:%s:pull", match[1])
+	}
+
+	credentials := sha256.Sum256([]byte(c.Username + ":" + c.Password + ":" + c.Token))
+	return fmt.Sprintf("%s %s %x", host, scope, credentials)
+}
+
+// ociAuthorization answers a registry's WWW-Authenticate challenge
+func (c Config) ociAuthorization(client *http.Client, challenge string) (string, error) {
+	if strings.HasPrefix(challenge, "Basic") {
+		credentials := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		return fmt.Sprintf("Basic %s", credentials), nil
+	}
+
+	if !strings.HasPrefix(challenge, "Bearer") {
+		return "", errors.Errorf("unsupported challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, match := range authParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", errors.New("challenge has no realm")
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse realm")
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status code %d from %s", resp.StatusCode, params["realm"])
+	}
+
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", errors.Wrap(err, "failed to parse token")
+	}
+
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	return fmt.Sprintf("Bearer %s", token), nil
+}
@@ -0,0 +1,324 @@
+package chartrepo
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is an in-process oci registry that requires a bearer token, which is issued
+// to a user with the right password
+type testRegistry struct {
+	server        *httptest.Server
+	manifests     map[string]map[string][]byte
+	blobs         map[string][]byte
+	tokenRequests int
+	noCatalog     bool // like most public registries
+}
+
+var testRegistryPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags)/(.+)$`)
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		manifests: map[string]map[string][]byte{},
+		blobs:     map[string][]byte{},
+	}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+func newPlainHTTPTestRegistry() *testRegistry {
+	r := &testRegistry{
+		manifests: map[string]map[string][]byte{},
+		blobs:     map[string][]byte{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "https://"), "http://")
+}
+
+func (r *testRegistry) addBlob(content []byte) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	r.blobs[digest] = content
+	return digest
+}
+
+func (r *testRegistry) push(repository string, tag string, configMediaType string, config string, layerMediaType string, layer string) {
+	manifest := ociManifest{
+		Config: ociDescriptor{MediaType: configMediaType, Digest: r.addBlob([]byte(config))},
+		Layers: []ociDescriptor{{MediaType: layerMediaType, Digest: r.addBlob([]byte(layer))}},
+	}
+	b, _ := json.Marshal(manifest)
+
+	if _, ok := r.manifests[repository]; !ok {
+		r.manifests[repository] = map[string][]byte{}
+	}
+	r.manifests[repository][tag] = b
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenRequests++
+		if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "registry-token"}`)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer registry-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="%s",scope="registry:catalog:*"`, r.server.URL, r.host()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if req.URL.Path == "/v2/_catalog" {
+		if r.noCatalog {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		repositories := []string{}
+		for repository := range r.manifests {
+			repositories = append(repositories, repository)
+		}
+		sort.Strings(repositories)
+
+		// one repository per page, to follow the links
+		last := req.URL.Query().Get("last")
+		page := []string{}
+		for _, repository := range repositories {
+			if repository > last {
+				page = append(page, repository)
+				break
+			}
+		}
+		if len(page) > 0 && page[0] != repositories[len(repositories)-1] {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=1>; rel="next"`, page[0]))
+		}
+		b, _ := json.Marshal(ociCatalog{Repositories: page})
+		w.Write(b)
+		return
+	}
+
+	match := testRegistryPath.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repository, kind, ref := match[1], match[2], match[3]
+	if _, ok := r.manifests[repository]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch kind {
+	case "tags":
+		tags := []string{}
+		for tag := range r.manifests[repository] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		b, _ := json.Marshal(ociTags{Tags: tags})
+		w.Write(b)
+	case "manifests":
+		manifest, ok := r.manifests[repository][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Write(manifest)
+	case "blobs":
+		blob, ok := r.blobs[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	}
+}
+
+func Test_OCIRegistry(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.server.Close()
+
+	registry.push("charts/redis", "10.5.7", helmConfigMediaType, `{"name": "redis", "version": "10.5.7", "appVersion": "5.0.7"}`, helmChartMediaType, "redis-10.5.7")
+	registry.push("charts/redis", "10.5.8_build.1", helmConfigMediaType, `{"name": "redis", "version": "10.5.8+build.1", "appVersion": "5.0.7"}`, helmChartMediaType, "redis-10.5.8")
+	registry.push("charts/nginx", "latest", "application/vnd.oci.image.config.v1+json", `{}`, "application/vnd.oci.image.layer.v1.tar+gzip", "an image")
+	registry.push("charts/team/mysql", "1.0.0", helmConfigMediaType, `{"name": "mysql", "version": "1.0.0"}`, helmChartMediaType, "mysql-1.0.0")
+	registry.push("other/postgres", "1.0.0", helmConfigMediaType, `{"name": "postgres", "version": "1.0.0"}`, helmChartMediaType, "postgres-1.0.0")
+
+	config := Config{
+		URL:                   fmt.Sprintf("oci://%s/charts", registry.host()),
+		Username:              "user",
+		Password:              "secret",
+		InsecureSkipTLSVerify: true,
+	}
+
+	index, err := config.LoadIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Entries, 1)
+	require.Len(t, index.Entries["redis"], 2)
+	assert.Equal(t, "10.5.8+build.1", index.Entries["redis"][0].GetVersion())
+	assert.Equal(t, "5.0.7", index.Entries["redis"][0].GetAppVersion())
+	assert.Equal(t, []string{fmt.Sprintf("oci://%s/charts/redis:10.5.8_build.1", registry.host())}, index.Entries["redis"][0].URLs)
+
+	archive, err := config.DownloadChart("redis", "10.5.8+build.1")
+	require.NoError(t, err)
+	assert.Equal(t, "redis-10.5.8", string(archive))
+
+	_, err = config.DownloadChart("nginx", "latest")
+	require.Error(t, err)
+
+	config.Password = "wrong"
+	_, err = config.LoadIndex()
+	require.Error(t, err)
+}
+
+func Test_OCIRegistryRepositoryNotNamedForChart(t *testing.T) {
+	registry := newTestRegistry()
+	defer registry.server.Close()
+
+	registry.push("charts/cache-chart", "1.0.0", helmConfigMediaType, `{"name": "memcached", "version": "1.0.0"}`, helmChartMediaType, "memcached-1.0.0")
+	registry.push("charts/redis", "10.5.7", helmConfigMediaType, `{"name": "redis", "version": "10.5.7"}`, helmChartMediaType, "redis-10.5.7")
+
+	config := Config{
+		URL:                   fmt.Sprintf("oci://%s/charts", registry.host()),
+		Username:              "user",
+		Password:              "secret",
+		InsecureSkipTLSVerify: true,
+	}
+
+	index, err := config.LoadIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Entries["memcached"], 1)
+	assert.Equal(t, []string{fmt.Sprintf("oci://%s/charts/cache-chart:1.0.0", registry.host())}, index.Entries["memcached"][0].URLs)
+
+	// a token is exchanged once for the catalog and once for each repository, not for every request
+	assert.Equal(t, 3, registry.tokenRequests)
+
+	archive, err := config.DownloadChartVersion(index.Entries["memcached"][0])
+	require.NoError(t, err)
+	assert.Equal(t, "memcached-1.0.0", string(archive))
+
+	// without the url, the chart is found in the index
+	archive, err = config.DownloadChart("memcached", "1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, "memcached-1.0.0", string(archive))
+}
+
+func Test_OCIRegistryWithoutCatalog(t *testing.T) {
+	registry := newTestRegistry()
+	registry.noCatalog = true
+	defer registry.server.Close()
+
+	registry.push("charts/redis", "10.5.7", helmConfigMediaType, `{"name": "redis", "version": "10.5.7"}`, helmChartMediaType, "redis-10.5.7")
+
+	config := Config{
+		URL:                   fmt.Sprintf("oci://%s/charts/redis", registry.host()),
+		Username:              "user",
+		Password:              "secret",
+		InsecureSkipTLSVerify: true,
+	}
+
+	// a chart's own repository is indexed by its tags
+	index, err := config.LoadIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Entries["redis"], 1)
+	assert.Equal(t, []string{fmt.Sprintf("oci://%s/charts/redis:10.5.7", registry.host())}, index.Entries["redis"][0].URLs)
+
+	// a namespace can't be listed
+	config.URL = fmt.Sprintf("oci://%s/charts", registry.host())
+	_, err = config.LoadIndex()
+	require.Error(t, err)
+
+	// the chart is still pulled from its repository in the namespace
+	archive, err := config.DownloadChart("redis", "10.5.7")
+	require.NoError(t, err)
+	assert.Equal(t, "redis-10.5.7", string(archive))
+
+	// and when it isn't there, the error is about pulling it rather than listing the namespace
+	_, err = config.DownloadChart("redis", "10.5.8")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to pull redis@10.5.8")
+}
+
+func Test_OCIRegistryPlainHTTP(t *testing.T) {
+	registry := newPlainHTTPTestRegistry()
+	defer registry.server.Close()
+
+	registry.push("charts/redis", "10.5.7", helmConfigMediaType, `{"name": "redis", "version": "10.5.7"}`, helmChartMediaType, "redis-10.5.7")
+
+	config := Config{
+		URL:      fmt.Sprintf("oci://%s/charts", registry.host()),
+		Username: "user",
+		Password: "secret",
+	}
+
+	_, err := config.LoadIndex()
+	require.Error(t, err)
+
+	config.PlainHTTP = true
+	index, err := config.LoadIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Entries["redis"], 1)
+
+	archive, err := config.DownloadChart("redis", "10.5.7")
+	require.NoError(t, err)
+	assert.Equal(t, "redis-10.5.7", string(archive))
+}
+
+func Test_ParseOCIChart(t *testing.T) {
+	tests := []struct {
+		chartRef             string
+		expectedRepoURL      string
+		expectedChartName    string
+		expectedChartVersion string
+		expectError          bool
+	}{
+		{
+			chartRef:             "oci://registry.example.com/charts/redis:10.5.7",
+			expectedRepoURL:      "oci://registry.example.com/charts",
+			expectedChartName:    "redis",
+			expectedChartVersion: "10.5.7",
+		},
+		{
+			chartRef:             "oci://localhost:5000/redis:1.0.0_build.1",
+			expectedRepoURL:      "oci://localhost:5000",
+			expectedChartName:    "redis",
+			expectedChartVersion: "1.0.0+build.1",
+		},
+		{
+			chartRef:    "oci://registry.example.com/charts/redis",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.chartRef, func(t *testing.T) {
+			repoURL, chartName, chartVersion, err := ParseOCIChart(test.chartRef)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRepoURL, repoURL)
+			assert.Equal(t, test.expectedChartName, chartName)
+			assert.Equal(t, test.expectedChartVersion, chartVersion)
+		})
+	}
+}
@@ -3,61 +3,142 @@ package k8sutil
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
 )
 
-func PortForward(config *restclient.Config, localPort int, remotePort int, namespace string, podName string) (chan struct{}, error) {
-	roundTripper, upgrader, err := spdy.RoundTripperFor(config)
-	if err != nil {
-		return nil, err
+// Tunnel forwards an OS assigned local port to a port on a pod
+type Tunnel struct {
+	Local     int
+	Remote    int
+	Namespace string
+	PodName   string
+
+	config   *restclient.Config
+	stopChan chan struct{}
+	mu       sync.Mutex
+}
+
+func NewTunnel(config *restclient.Config, namespace string, podName string, remotePort int) *Tunnel {
+	return &Tunnel{
+		Remote:    remotePort,
+		Namespace: namespace,
+		PodName:   podName,
+		config:    config,
 	}
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", namespace, podName)
-	scheme := ""
-	hostIP := config.Host
+}
 
-	u, err := url.Parse(config.Host)
-	if err != nil {
-		return nil, err
+// ForwardPort opens the tunnel, and blocks until it's ready to accept connections
+// or the timeout expires
+func (t *Tunnel) ForwardPort(timeout time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopChan != nil {
+		return errors.New("tunnel is already open")
 	}
 
-	if u.Scheme == "http" || u.Scheme == "https" {
-		scheme = u.Scheme
-		hostIP = u.Host
+	roundTripper, upgrader, err := spdy.RoundTripperFor(t.config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create round tripper")
 	}
 
-	serverURL := url.URL{Scheme: scheme, Path: path, Host: hostIP}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, &serverURL)
+	serverURL, err := t.portForwardURL()
+	if err != nil {
+		return errors.Wrap(err, "failed to create port forward url")
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, serverURL)
 
-	stopChan, readyChan := make(chan struct{}, 1), make(chan struct{}, 1)
-	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
+	stopChan, readyChan := make(chan struct{}), make(chan struct{})
+	errOut := new(bytes.Buffer)
 
-	forwarder, err := portforward.New(dialer, []string{fmt.Sprintf("%d:%d", localPort, remotePort)}, stopChan, readyChan, out, errOut)
+	// a local port of 0 lets the os choose a free port
+	forwarder, err := portforward.New(dialer, []string{fmt.Sprintf("0:%d", t.Remote)}, stopChan, readyChan, ioutil.Discard, errOut)
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "failed to create port forwarder")
 	}
 
+	errChan := make(chan error, 1)
 	go func() {
-		for range readyChan { // Kubernetes will close this channel when it has something to tell us.
-		}
-		if len(errOut.String()) != 0 {
-			panic(errOut.String())
-		} else if len(out.String()) != 0 {
-			// fmt.Println(out.String())
-		}
+		errChan <- forwarder.ForwardPorts() // Locks until stopChan is closed.
 	}()
 
-	go func() error {
-		if err = forwarder.ForwardPorts(); err != nil { // Locks until stopChan is closed.
-			panic(err)
+	select {
+	case err := <-errChan:
+		if err == nil {
+			err = errors.New(strings.TrimSpace(errOut.String()))
 		}
+		return errors.Wrap(err, "failed to forward port")
+	case <-time.After(timeout):
+		close(stopChan)
+		return errors.Errorf("timed out after %s waiting for port forward to %s/%s", timeout, t.Namespace, t.PodName)
+	case <-readyChan:
+	}
 
-		return nil
-	}()
+	ports, err := forwarder.GetPorts()
+	if err != nil {
+		close(stopChan)
+		return errors.Wrap(err, "failed to get forwarded ports")
+	}
+	if len(ports) != 1 {
+		close(stopChan)
+		return errors.Errorf("expected 1 forwarded port, got %d", len(ports))
+	}
+
+	t.Local = int(ports[0].Local)
+	t.stopChan = stopChan
+
+	return nil
+}
+
+// Reconnect closes the tunnel, if it's open, and opens a new one. The local port may change
+func (t *Tunnel) Reconnect(timeout time.Duration) error {
+	t.Close()
+	return t.ForwardPort(timeout)
+}
+
+// Close stops forwarding and releases the local port. It's safe to call more than once
+func (t *Tunnel) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopChan != nil {
+		close(t.stopChan)
+		t.stopChan = nil
+	}
+}
+
+// Address returns the local address that's forwarded to the pod
+func (t *Tunnel) Address() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return fmt.Sprintf("localhost:%d", t.Local)
+}
+
+func (t *Tunnel) portForwardURL() (*url.URL, error) {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", t.Namespace, t.PodName)
+	scheme := ""
+	hostIP := t.config.Host
+
+	u, err := url.Parse(t.config.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		scheme = u.Scheme
+		hostIP = u.Host
+	}
 
-	return stopChan, nil
+	return &url.URL{Scheme: scheme, Path: path, Host: hostIP}, nil
 }
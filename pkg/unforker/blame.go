@@ -0,0 +1,391 @@
+package unforker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// BlameLine describes the revision that first made a change in the fork, that is still in the latest revision
+type BlameLine struct {
+	Resource     string // kind/name
+	Field        string // the patched field, or empty when the whole resource is only in the fork
+	Revision     int32
+	ChartVersion string
+}
+
+// Blame compares each revision in history with the upstream version it was forked from, and finds
+// the revision that introduced each patched field that's still in the latest revision. Revisions
+// with another chart version than the latest are compared with the nearest version of the upstream
+// in index. history must be sorted from oldest to newest revision
+func Blame(history []*LocalChart, index *chartindex.ChartIndex, upstreamChartMatch chartindex.ChartMatch, unforkOptions UnforkOptions) ([]BlameLine, error) {
+	if len(history) == 0 {
+		return nil, errors.New("release has no revisions")
+	}
+	latest := history[len(history)-1]
+
+	workDir, err := ioutil.TempDir("", "unfork-blame")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create work dir")
+	}
+	defer os.RemoveAll(workDir)
+
+	// the base is rendered with the values of the revision, so revisions share a base only when they
+	// have the same upstream version and values, which is most upgrades that only change the fork
+	bases := map[string]blameBase{}
+
+	diffs := make([]revisionDiff, len(history))
+	for i, revision := range history {
+		upstream := upstreamForRevision(index, upstreamChartMatch, latest, revision)
+		key := blameBaseKey(upstream, revision)
+
+		base, ok := bases[key]
+		if ok {
+			if revision.Chart == nil {
+				revision = revision.withChart(base.chart)
+			}
+		} else {
+			unforkPath := path.Join(workDir, fmt.Sprintf("%d", revision.Revision), revision.HelmName)
+			revision, _, err = pullUpstream(unforkPath, revision, upstream, unforkOptions.RepoConfigs)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to pull upstream %s for revision %d", upstream.ChartVersion, history[i].Revision)
+			}
+
+			base = blameBase{
+				path:  path.Join(unforkPath, "base"),
+				chart: revision.Chart,
+			}
+			bases[key] = base
+		}
+
+		manifests, err := forkedChartManifests(revision, unforkOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get manifests for revision %d", revision.Revision)
+		}
+
+		diffs[i], err = diffRevision(manifests, base.path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to diff revision %d", revision.Revision)
+		}
+	}
+
+	return blameDiffs(history, diffs), nil
+}
+
+// blameBase is an upstream rendered with the values of a revision
+type blameBase struct {
+	path  string
+	chart *chart.Chart // the chart of revisions that have none, which is the upstream
+}
+
+// blameBaseKey identifies the base that revision is compared with, by the upstream chart version and
+// the values that it's rendered with
+func blameBaseKey(upstream chartindex.ChartMatch, revision *LocalChart) string {
+	values := sha256.New()
+	values.Write([]byte(revision.Chart.GetValues().GetRaw()))
+	values.Write([]byte{0})
+	values.Write([]byte(revision.Config.GetRaw()))
+
+	return fmt.Sprintf("%s %s %s/%s@%s %x", upstream.Path, upstream.URI, upstream.Repo, upstream.Name, upstream.ChartVersion, values.Sum(nil))
+}
+
+// upstreamForRevision returns the upstream that revision was forked from. Revisions with the same chart
+// version as the latest use upstreamChartMatch, and others the nearest version in the same repo
+func upstreamForRevision(index *chartindex.ChartIndex, upstreamChartMatch chartindex.ChartMatch, latest *LocalChart, revision *LocalChart) chartindex.ChartMatch {
+	if upstreamChartMatch.Path != "" || revision.ChartVersion == latest.ChartVersion {
+		return upstreamChartMatch
+	}
+
+	upstream := upstreamChartMatch
+	upstream.ChartVersion = revision.ChartVersion
+	upstream.AppVersion = revision.AppVersion
+
+	if index == nil {
+		return upstream
+	}
+	matches, err := index.FindBestUpstreamMatches(upstreamChartMatch.Name, revision.ChartVersion, revision.AppVersion, 1)
+	if err != nil {
+		return upstream
+	}
+	for _, match := range matches {
+		if match.Repo == upstreamChartMatch.Repo && match.URI == upstreamChartMatch.URI {
+			upstream.ChartVersion = match.ChartVersion
+			upstream.AppVersion = match.AppVersion
+			break
+		}
+	}
+
+	return upstream
+}
+
+// revisionDiff is what createPatches finds when a revision is compared with its upstream, keyed by kind/name
+type revisionDiff struct {
+	resources map[string]bool // resources that are only in the fork
+	patches   map[string]map[string]interface{}
+}
+
+func diffRevision(forkedManifests map[string]string, basePath string) (revisionDiff, error) {
+	forkedRoot, err := writeForkedManifests(forkedManifests)
+	if err != nil {
+		return revisionDiff{}, errors.Wrap(err, "failed to write forked manifests")
+	}
+	defer os.RemoveAll(forkedRoot)
+
+	resources, patches, err := createPatches(forkedRoot, basePath)
+	if err != nil {
+		return revisionDiff{}, errors.Wrap(err, "failed to create patches")
+	}
+
+	diff := revisionDiff{
+		resources: map[string]bool{},
+		patches:   map[string]map[string]interface{}{},
+	}
+	for _, content := range resources {
+		if resource := objectKey(content); resource != "" {
+			diff.resources[resource] = true
+		}
+	}
+	for _, content := range patches {
+		resource := objectKey(content)
+		if resource == "" {
+			continue
+		}
+
+		patch := map[string]interface{}{}
+		if err := yaml.Unmarshal(content, &patch); err != nil {
+			return revisionDiff{}, errors.Wrap(err, "failed to unmarshal patch")
+		}
+		diff.patches[resource] = patch
+	}
+
+	return diff, nil
+}
+
+// blameDiffs attributes each resource and patched field in the latest diff to the revision where
+// it first appeared in that revision's diff, with the same value as it has now
+func blameDiffs(history []*LocalChart, diffs []revisionDiff) []BlameLine {
+	latest := diffs[len(diffs)-1]
+	blameLines := []BlameLine{}
+
+	for resource := range latest.resources {
+		resource := resource
+		introduced := introducedAt(len(diffs), func(i int) interface{} {
+			return diffs[i].resources[resource]
+		})
+		blameLines = append(blameLines, BlameLine{
+			Resource:     resource,
+			Revision:     history[introduced].Revision,
+			ChartVersion: history[introduced].ChartVersion,
+		})
+	}
+
+	for resource, patch := range latest.patches {
+		resource := resource
+		for _, field := range patchFields(patch, nil) {
+			field := field
+			introduced := introducedAt(len(diffs), func(i int) interface{} {
+				revisionPatch, ok := diffs[i].patches[resource]
+				if !ok {
+					return nil
+				}
+				return lookupField(revisionPatch, field)
+			})
+			blameLines = append(blameLines, BlameLine{
+				Resource:     resource,
+				Field:        formatFieldPath(field),
+				Revision:     history[introduced].Revision,
+				ChartVersion: history[introduced].ChartVersion,
+			})
+		}
+	}
+
+	sort.Slice(blameLines, func(i, j int) bool {
+		if blameLines[i].Resource != blameLines[j].Resource {
+			return blameLines[i].Resource < blameLines[j].Resource
+		}
+		return blameLines[i].Field < blameLines[j].Field
+	})
+
+	return blameLines
+}
+
+// introducedAt returns the oldest of the revisions in the unbroken run, ending with the
+// latest, where value returns the same as for the latest
+func introducedAt(revisions int, value func(int) interface{}) int {
+	latest := revisions - 1
+	latestValue := value(latest)
+
+	introduced := latest
+	for i := latest - 1; i >= 0; i-- {
+		if !reflect.DeepEqual(value(i), latestValue) {
+			break
+		}
+		introduced = i
+	}
+
+	return introduced
+}
+
+// objectKey returns kind/name for a kubernetes object, or an empty string if it isn't one
+func objectKey(content []byte) string {
+	obj := struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}{}
+	if err := yaml.Unmarshal(content, &obj); err != nil {
+		return ""
+	}
+	if obj.Kind == "" || obj.Metadata.Name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%s", strings.ToLower(obj.Kind), obj.Metadata.Name)
+}
+
+// patchFields returns the path to every field that patch sets. The header that identifies the
+// object and strategic merge directives are skipped. Lists of named items are descended into,
+// any other list is replaced as a whole by a strategic merge patch, so it's a single field
+func patchFields(patch map[string]interface{}, parent []string) [][]string {
+	fields := [][]string{}
+
+	keys := []string{}
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		field := append(append([]string{}, parent...), key)
+		if isPatchHeader(field) {
+			continue
+		}
+
+		switch value := patch[key].(type) {
+		case map[string]interface{}:
+			if len(value) == 0 {
+				fields = append(fields, field)
+				continue
+			}
+			fields = append(fields, patchFields(value, field)...)
+
+		case []interface{}:
+			names, ok := listItemNames(value)
+			if !ok {
+				fields = append(fields, field)
+				continue
+			}
+
+			for i, item := range value {
+				itemField := append(append([]string{}, field...), fmt.Sprintf("[name=%s]", names[i]))
+
+				itemFields := map[string]interface{}{}
+				for itemKey, itemValue := range item.(map[string]interface{}) {
+					if itemKey != "name" {
+						itemFields[itemKey] = itemValue
+					}
+				}
+
+				children := patchFields(itemFields, itemField)
+				if len(children) == 0 {
+					fields = append(fields, itemField)
+				}
+				fields = append(fields, children...)
+			}
+
+		default:
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func isPatchHeader(field []string) bool {
+	switch strings.Join(field, ".") {
+	case "apiVersion", "kind", "metadata.name", "metadata.namespace":
+		return true
+	}
+	return false
+}
+
+// listItemNames returns the name of each item, if every item is a map with a name
+func listItemNames(list []interface{}) ([]string, bool) {
+	names := []string{}
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+
+	return names, len(names) > 0
+}
+
+// lookupField returns the value at field in obj, or nil if it's not set
+func lookupField(obj map[string]interface{}, field []string) interface{} {
+	var current interface{} = obj
+	for _, element := range field {
+		if strings.HasPrefix(element, "[name=") {
+			name := strings.TrimSuffix(strings.TrimPrefix(element, "[name="), "]")
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil
+			}
+
+			var found interface{}
+			for _, item := range list {
+				if m, ok := item.(map[string]interface{}); ok && m["name"] == name {
+					found = m
+					break
+				}
+			}
+			if found == nil {
+				return nil
+			}
+			current = found
+			continue
+		}
+
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[element]
+	}
+
+	return current
+}
+
+func formatFieldPath(field []string) string {
+	formatted := ""
+	for _, element := range field {
+		if strings.HasPrefix(element, "[") || formatted == "" {
+			formatted += element
+		} else {
+			formatted += "." + element
+		}
+	}
+
+	return formatted
+}
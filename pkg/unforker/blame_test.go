@@ -0,0 +1,227 @@
+package unforker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+func Test_patchFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		patch    string
+		expected []string
+	}{
+		{
+			name: "nested fields and named list items",
+			patch: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    team: platform
+spec:
+  replicas: 3
+  template:
+    spec:
+      $setElementOrder/containers:
+      - name: web
+      containers:
+      - name: web
+        image: nginx:2
+`,
+			expected: []string{
+				"metadata.labels.team",
+				"spec.replicas",
+				"spec.template.spec.containers[name=web].image",
+			},
+		},
+		{
+			name: "lists without names are a single field",
+			patch: `kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        args:
+        - --verbose
+`,
+			expected: []string{
+				"spec.template.spec.containers[name=web].args",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			patch := map[string]interface{}{}
+			req.NoError(yaml.Unmarshal([]byte(test.patch), &patch))
+
+			actual := []string{}
+			for _, field := range patchFields(patch, nil) {
+				actual = append(actual, formatFieldPath(field))
+			}
+
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_introducedAt(t *testing.T) {
+	revision := func(replicas int) map[string]map[string]interface{} {
+		return map[string]map[string]interface{}{
+			"deployment/web": {
+				"spec": map[string]interface{}{"replicas": replicas},
+			},
+		}
+	}
+	replicas := func(objects map[string]map[string]interface{}) interface{} {
+		return lookupField(objects["deployment/web"], []string{"spec", "replicas"})
+	}
+
+	tests := []struct {
+		name            string
+		revisionObjects []map[string]map[string]interface{}
+		expected        int
+	}{
+		{
+			name:            "changed in the latest revision",
+			revisionObjects: []map[string]map[string]interface{}{revision(1), revision(1), revision(3)},
+			expected:        2,
+		},
+		{
+			name:            "changed in the middle",
+			revisionObjects: []map[string]map[string]interface{}{revision(1), revision(3), revision(3)},
+			expected:        1,
+		},
+		{
+			name:            "changed, reverted and changed again",
+			revisionObjects: []map[string]map[string]interface{}{revision(3), revision(1), revision(3)},
+			expected:        2,
+		},
+		{
+			name:            "set in the first revision",
+			revisionObjects: []map[string]map[string]interface{}{revision(3), revision(3)},
+			expected:        0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := introducedAt(len(test.revisionObjects), func(i int) interface{} {
+				return replicas(test.revisionObjects[i])
+			})
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_blameDiffsAcrossChartVersions(t *testing.T) {
+	req := require.New(t)
+
+	deployment := func(replicas int, image string) string {
+		return fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: %d
+  template:
+    spec:
+      containers:
+      - name: web
+        image: %s
+`, replicas, image)
+	}
+
+	history := []*LocalChart{
+		{HelmName: "web", Revision: 1, ChartVersion: "1.0.0"},
+		{HelmName: "web", Revision: 2, ChartVersion: "2.0.0"},
+	}
+	// the fork always ran 2 replicas, which was the upstream default until 2.0.0
+	upstreams := []map[string]string{
+		{"deployment.yaml": deployment(2, "nginx:1")},
+		{"deployment.yaml": deployment(1, "nginx:2")},
+	}
+	forks := []map[string]string{
+		{"deployment.yaml": deployment(2, "acme/nginx:1")},
+		{"deployment.yaml": deployment(2, "acme/nginx:1")},
+	}
+
+	diffs := []revisionDiff{}
+	for i := range history {
+		basePath := writeTestFiles(t, upstreams[i])
+		defer os.RemoveAll(basePath)
+
+		diff, err := diffRevision(forks[i], basePath)
+		req.NoError(err)
+		diffs = append(diffs, diff)
+	}
+
+	assert.Equal(t, []BlameLine{
+		{Resource: "deployment/web", Field: "spec.replicas", Revision: 2, ChartVersion: "2.0.0"},
+		{Resource: "deployment/web", Field: "spec.template.spec.containers[name=web].image", Revision: 1, ChartVersion: "1.0.0"},
+	}, blameDiffs(history, diffs))
+}
+
+func Test_upstreamForRevision(t *testing.T) {
+	req := require.New(t)
+
+	dir := writeTestFiles(t, map[string]string{
+		"charts.json": `{"charts": [
+  {"repo": "stable", "name": "redis", "versions": [
+    {"chartVersion": "10.5.7", "appVersion": "5.0.7"},
+    {"chartVersion": "10.4.0", "appVersion": "5.0.5"}
+  ]},
+  {"repo": "bitnami", "name": "redis", "uri": "https://charts.bitnami.com/bitnami", "versions": [
+    {"chartVersion": "10.4.1", "appVersion": "5.0.5"}
+  ]}
+]}`,
+	})
+	defer os.RemoveAll(dir)
+	index, err := chartindex.LoadIndex(filepath.Join(dir, "charts.json"))
+	req.NoError(err)
+
+	upstream := chartindex.ChartMatch{Repo: "stable", Name: "redis", ChartVersion: "10.5.7", AppVersion: "5.0.7"}
+	latest := &LocalChart{ChartVersion: "10.5.7-acme.2", AppVersion: "5.0.7"}
+
+	assert.Equal(t, upstream, upstreamForRevision(index, upstream, latest, latest))
+
+	// the nearest version in the same repo as the upstream
+	actual := upstreamForRevision(index, upstream, latest, &LocalChart{ChartVersion: "10.4.1-acme.1", AppVersion: "5.0.5"})
+	assert.Equal(t, "stable", actual.Repo)
+	assert.Equal(t, "10.4.0", actual.ChartVersion)
+
+	// without an index, the revision's own version
+	actual = upstreamForRevision(nil, upstream, latest, &LocalChart{ChartVersion: "10.4.0", AppVersion: "5.0.5"})
+	assert.Equal(t, "10.4.0", actual.ChartVersion)
+}
+
+func Test_blameBaseKey(t *testing.T) {
+	upstream := chartindex.ChartMatch{Repo: "stable", Name: "redis", ChartVersion: "10.5.7"}
+	revision := func(config string) *LocalChart {
+		return &LocalChart{
+			Chart:  &chart.Chart{Values: &chart.Config{Raw: "replicas: 1\n"}},
+			Config: &chart.Config{Raw: config},
+		}
+	}
+
+	assert.Equal(t, blameBaseKey(upstream, revision("a: 1\n")), blameBaseKey(upstream, revision("a: 1\n")))
+	assert.NotEqual(t, blameBaseKey(upstream, revision("a: 1\n")), blameBaseKey(upstream, revision("a: 2\n")))
+
+	newer := upstream
+	newer.ChartVersion = "10.6.0"
+	assert.NotEqual(t, blameBaseKey(upstream, revision("a: 1\n")), blameBaseKey(newer, revision("a: 1\n")))
+}
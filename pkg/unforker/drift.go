@@ -0,0 +1,469 @@
+package unforker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	kotsk8sutil "github.com/replicatedhq/kots/pkg/k8sutil"
+	kuberneteserrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	kustomizetypes "sigs.k8s.io/kustomize/v3/pkg/types"
+)
+
+var (
+	// serverPopulatedMetadata is set by the api server, not by helm or by people editing resources
+	serverPopulatedMetadata = []string{
+		"managedFields",
+		"resourceVersion",
+		"uid",
+		"selfLink",
+		"creationTimestamp",
+		"generation",
+	}
+
+	// ignoredFieldManagers apply releases, or change resources on their own. The fields they manage
+	// weren't changed by hand, including the fields the api server defaulted when helm created them
+	ignoredFieldManagers = []string{
+		"helm",
+		"tiller",
+		"Go-http-client",
+		"helm-controller",
+		"helm-operator",
+		"argocd-application-controller",
+		"argocd-controller",
+		"kube-controller-manager",
+		"kube-scheduler",
+		"kubelet",
+	}
+
+	// ignoredDriftAnnotations are written by kubectl and controllers
+	ignoredDriftAnnotations = []string{
+		lastAppliedConfigurationAnnotation,
+		"deployment.kubernetes.io/revision",
+	}
+)
+
+// DriftResult describes the manual changes made to a release's resources in the cluster
+type DriftResult struct {
+	Dir     string
+	Patches []string
+	Missing []string
+}
+
+// captureDrift compares each resource that helm applied with the live object in the cluster, and
+// writes the differences as patches to an overlay in driftDir that is based on the unforked downstream
+func captureDrift(configFlags *genericclioptions.ConfigFlags, namespace string, appliedManifests map[string]string, driftDir string) (*DriftResult, error) {
+	restConfig, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read kubeconfig")
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	mapper, err := configFlags.ToRESTMapper()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create rest mapper")
+	}
+
+	driftResult := DriftResult{
+		Dir: driftDir,
+	}
+
+	filenames := []string{}
+	for filename := range appliedManifests {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		for _, doc := range manifestSeparator.Split(appliedManifests[filename], -1) {
+			applied := map[string]interface{}{}
+			if err := yaml.Unmarshal([]byte(doc), &applied); err != nil || len(applied) == 0 {
+				continue
+			}
+			obj := unstructured.Unstructured{Object: applied}
+			if obj.GetKind() == "" || obj.GetName() == "" {
+				continue
+			}
+
+			gvk := obj.GroupVersionKind()
+			description := fmt.Sprintf("%s/%s", strings.ToLower(gvk.Kind), obj.GetName())
+
+			mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+			if err != nil {
+				// the kind isn't served by this cluster any more
+				driftResult.Missing = append(driftResult.Missing, description)
+				continue
+			}
+
+			var resourceClient dynamic.ResourceInterface = dynamicClient.Resource(mapping.Resource)
+			if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+				objNamespace := obj.GetNamespace()
+				if objNamespace == "" {
+					objNamespace = namespace
+				}
+				resourceClient = dynamicClient.Resource(mapping.Resource).Namespace(objNamespace)
+			}
+
+			live, err := resourceClient.Get(obj.GetName(), metav1.GetOptions{})
+			if kuberneteserrors.IsNotFound(err) {
+				driftResult.Missing = append(driftResult.Missing, description)
+				continue
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "failed to get %s", description)
+			}
+
+			liveContent, err := yaml.Marshal(cleanLiveObject(applied, live.Object))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to marshal %s", description)
+			}
+
+			patch, err := createTwoWayMergePatch([]byte(doc), liveContent)
+			if err != nil {
+				// kinds that aren't in the client-go scheme can't be strategic merge patched
+				continue
+			}
+			if patch == nil {
+				continue
+			}
+
+			if err := os.MkdirAll(driftDir, 0755); err != nil {
+				return nil, errors.Wrap(err, "failed to create drift dir")
+			}
+
+			patchFilename := fmt.Sprintf("%s-%s.yaml", strings.ToLower(gvk.Kind), obj.GetName())
+			if err := ioutil.WriteFile(path.Join(driftDir, patchFilename), patch, 0644); err != nil {
+				return nil, errors.Wrap(err, "failed to write drift patch")
+			}
+			driftResult.Patches = append(driftResult.Patches, patchFilename)
+		}
+	}
+
+	if len(driftResult.Patches) == 0 {
+		return &driftResult, nil
+	}
+
+	kustomization := kustomizetypes.Kustomization{
+		TypeMeta: kustomizetypes.TypeMeta{
+			APIVersion: "kustomize.config.k8s.io/v1beta1",
+			Kind:       "Kustomization",
+		},
+		Bases: []string{"../unforked"},
+	}
+	for _, patch := range driftResult.Patches {
+		kustomization.PatchesStrategicMerge = append(kustomization.PatchesStrategicMerge, kustomizetypes.PatchStrategicMerge(patch))
+	}
+	if err := kotsk8sutil.WriteKustomizationToFile(&kustomization, path.Join(driftDir, "kustomization.yaml")); err != nil {
+		return nil, errors.Wrap(err, "failed to write drift kustomization")
+	}
+
+	return &driftResult, nil
+}
+
+// cleanLiveObject removes the fields from a live object that helm never set, and that weren't
+// added by hand. A field is kept if it's in the applied manifest, or if it's managed by someone
+// other than helm and the cluster's controllers, such as with kubectl edit or kubectl patch.
+// Status and server populated metadata are always removed
+func cleanLiveObject(applied map[string]interface{}, live map[string]interface{}) map[string]interface{} {
+	patchMeta := patchMetaFor(applied)
+
+	cleaned, _ := keepFields(live, applied, userOwnedFields(live, patchMeta), patchMeta, "").(map[string]interface{})
+	if cleaned == nil {
+		cleaned = map[string]interface{}{}
+	}
+	delete(cleaned, "status")
+
+	cleanedMetadata, _ := cleaned["metadata"].(map[string]interface{})
+	if cleanedMetadata == nil {
+		return cleaned
+	}
+
+	for _, field := range serverPopulatedMetadata {
+		delete(cleanedMetadata, field)
+	}
+
+	if annotations, ok := cleanedMetadata["annotations"].(map[string]interface{}); ok {
+		for _, ignored := range ignoredDriftAnnotations {
+			delete(annotations, ignored)
+		}
+		if len(annotations) == 0 {
+			delete(cleanedMetadata, "annotations")
+		}
+	}
+
+	return cleaned
+}
+
+// userOwnedFields returns the set of fields in live that were set by hand, in the format of
+// managedFields. Clusters from before managed fields have the configuration last applied with
+// kubectl instead, which kubectl edit also updates
+func userOwnedFields(live map[string]interface{}, patchMeta strategicpatch.LookupPatchMeta) map[string]interface{} {
+	owned := map[string]interface{}{}
+
+	metadata, _ := live["metadata"].(map[string]interface{})
+	if managedFields, ok := metadata["managedFields"].([]interface{}); ok && len(managedFields) > 0 {
+		for _, entry := range managedFields {
+			managedEntry, _ := entry.(map[string]interface{})
+			manager, _ := managedEntry["manager"].(string)
+			if isIgnoredFieldManager(manager) {
+				continue
+			}
+
+			fields, ok := managedEntry["fieldsV1"].(map[string]interface{})
+			if !ok {
+				// before kubernetes 1.18
+				fields, _ = managedEntry["fields"].(map[string]interface{})
+			}
+			owned = mergeValues(owned, fields)
+		}
+		return owned
+	}
+
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	lastApplied, _ := annotations[lastAppliedConfigurationAnnotation].(string)
+	if lastApplied == "" {
+		return owned
+	}
+
+	lastAppliedObject := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lastApplied), &lastAppliedObject); err != nil {
+		return owned
+	}
+	return objectFields(lastAppliedObject, patchMeta, "")
+}
+
+// objectFields returns the set of fields in value, in the format of managedFields. Items in
+// lists with a merge key are keyed by it, other lists are a single field
+func objectFields(value interface{}, patchMeta strategicpatch.LookupPatchMeta, mergeKey string) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			childMeta, childMergeKey := lookupPatchMeta(patchMeta, key, child)
+			fields["f:"+key] = objectFields(child, childMeta, childMergeKey)
+		}
+	case []interface{}:
+		if mergeKey == "" {
+			break
+		}
+		for _, item := range v {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, err := json.Marshal(map[string]interface{}{mergeKey: itemMap[mergeKey]})
+			if err != nil {
+				continue
+			}
+			fields["k:"+string(key)] = objectFields(item, patchMeta, "")
+		}
+	}
+
+	return fields
+}
+
+// keepFields returns the parts of live that are in applied or in the owned set of fields. An
+// owned field that doesn't list any of its children is kept whole. List items are matched by
+// their merge key, so that reordering a list doesn't compare different items
+func keepFields(live interface{}, applied interface{}, owned map[string]interface{}, patchMeta strategicpatch.LookupPatchMeta, mergeKey string) interface{} {
+	switch liveValue := live.(type) {
+	case map[string]interface{}:
+		appliedMap, _ := applied.(map[string]interface{})
+
+		kept := map[string]interface{}{}
+		for key, value := range liveValue {
+			appliedValue, inApplied := appliedMap[key]
+			ownedValue, isOwned := owned["f:"+key].(map[string]interface{})
+			if !inApplied && !isOwned {
+				continue
+			}
+			if isOwned && isWholeField(ownedValue) {
+				kept[key] = value
+				continue
+			}
+
+			childMeta, childMergeKey := lookupPatchMeta(patchMeta, key, value)
+			kept[key] = keepFields(value, appliedValue, ownedValue, childMeta, childMergeKey)
+		}
+		return kept
+
+	case []interface{}:
+		appliedList, _ := applied.([]interface{})
+
+		kept := []interface{}{}
+		for i, item := range liveValue {
+			if _, ok := item.(map[string]interface{}); !ok {
+				// lists of values are set as a whole
+				return liveValue
+			}
+
+			appliedItem, inApplied := findListItem(appliedList, item, i, mergeKey)
+			ownedItem, isOwned := findOwnedListItem(owned, item, i)
+			if !inApplied && !isOwned {
+				continue
+			}
+			if isOwned && isWholeField(ownedItem) {
+				kept = append(kept, item)
+				continue
+			}
+
+			kept = append(kept, keepFields(item, appliedItem, ownedItem, patchMeta, ""))
+		}
+		return kept
+	}
+
+	return live
+}
+
+// findListItem returns the item in list with the same merge key as item, or at the same index
+// if the list has no merge key
+func findListItem(list []interface{}, item interface{}, index int, mergeKey string) (interface{}, bool) {
+	if mergeKey == "" {
+		if index < len(list) {
+			return list[index], true
+		}
+		return nil, false
+	}
+
+	itemMap, _ := item.(map[string]interface{})
+	for _, listItem := range list {
+		listItemMap, ok := listItem.(map[string]interface{})
+		if ok && jsonEqual(listItemMap[mergeKey], itemMap[mergeKey]) {
+			return listItem, true
+		}
+	}
+
+	return nil, false
+}
+
+// findOwnedListItem returns the fields of item in a managed fields list, which are keyed by the
+// item's key fields, its value or its index
+func findOwnedListItem(owned map[string]interface{}, item interface{}, index int) (map[string]interface{}, bool) {
+	itemMap, _ := item.(map[string]interface{})
+
+	for key, value := range owned {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(key, "k:"):
+			keyFields := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &keyFields); err != nil {
+				continue
+			}
+			matches := true
+			for keyField, keyValue := range keyFields {
+				if !jsonEqual(itemMap[keyField], keyValue) {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				return fields, true
+			}
+		case strings.HasPrefix(key, "v:"):
+			var keyValue interface{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "v:")), &keyValue); err == nil && jsonEqual(item, keyValue) {
+				return fields, true
+			}
+		case key == fmt.Sprintf("i:%d", index):
+			return fields, true
+		}
+	}
+
+	return nil, false
+}
+
+// isWholeField returns true if the owned fields don't list any children, so the whole value is owned
+func isWholeField(owned map[string]interface{}) bool {
+	for key := range owned {
+		if key != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPatchMeta returns the strategic merge metadata for the key field of a struct, and its merge
+// key if it's a list. Kinds that aren't in the client-go scheme have no metadata
+func lookupPatchMeta(patchMeta strategicpatch.LookupPatchMeta, key string, value interface{}) (strategicpatch.LookupPatchMeta, string) {
+	if patchMeta == nil {
+		return nil, ""
+	}
+
+	if _, ok := value.([]interface{}); ok {
+		childMeta, childPatchMeta, err := patchMeta.LookupPatchMetadataForSlice(key)
+		if err != nil {
+			return nil, ""
+		}
+		return childMeta, childPatchMeta.GetPatchMergeKey()
+	}
+
+	childMeta, _, err := patchMeta.LookupPatchMetadataForStruct(key)
+	if err != nil {
+		return nil, ""
+	}
+	return childMeta, ""
+}
+
+// patchMetaFor returns the strategic merge metadata for the kind of obj
+func patchMetaFor(obj map[string]interface{}) strategicpatch.LookupPatchMeta {
+	apiVersion, _ := obj["apiVersion"].(string)
+	kind, _ := obj["kind"].(string)
+
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil
+	}
+	versionedObj, err := scheme.Scheme.New(gv.WithKind(kind))
+	if err != nil {
+		return nil
+	}
+	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(versionedObj)
+	if err != nil {
+		return nil
+	}
+
+	return patchMeta
+}
+
+func isIgnoredFieldManager(manager string) bool {
+	for _, ignored := range ignoredFieldManagers {
+		if manager == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEqual compares values the way they'd be serialized, so that an int from the cluster
+// equals the same float64 from a manifest
+func jsonEqual(a interface{}, b interface{}) bool {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,414 @@
+package unforker
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cleanLiveObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		applied  map[string]interface{}
+		live     map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name: "server defaults and status are removed",
+			applied: map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"replicas": 1,
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{"name": "web", "image": "nginx:1"},
+							},
+						},
+					},
+				},
+			},
+			live: map[string]interface{}{
+				"kind": "Deployment",
+				"metadata": map[string]interface{}{
+					"name":            "web",
+					"namespace":       "default",
+					"uid":             "1234",
+					"resourceVersion": "42",
+					"annotations": map[string]interface{}{
+						"deployment.kubernetes.io/revision": "3",
+					},
+				},
+				"spec": map[string]interface{}{
+					"replicas":             3,
+					"revisionHistoryLimit": 10,
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{"name": "web", "image": "nginx:1", "imagePullPolicy": "IfNotPresent"},
+							},
+						},
+					},
+				},
+				"status": map[string]interface{}{"replicas": 3},
+			},
+			expected: map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"replicas": 3,
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{"name": "web", "image": "nginx:1"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "labels and annotations added by hand are kept",
+			applied: map[string]interface{}{
+				"kind":     "Service",
+				"metadata": map[string]interface{}{"name": "web"},
+			},
+			live: map[string]interface{}{
+				"kind": "Service",
+				"metadata": map[string]interface{}{
+					"name":   "web",
+					"labels": map[string]interface{}{"team": "platform"},
+					"annotations": map[string]interface{}{
+						"kubectl.kubernetes.io/last-applied-configuration": "{}",
+						"prometheus.io/scrape":                             "true",
+					},
+					"managedFields": []interface{}{
+						managedFieldsEntry("tiller", `{"f:metadata":{"f:name":{}}}`),
+						managedFieldsEntry("kubectl-label", `{"f:metadata":{"f:labels":{".":{},"f:team":{}}}}`),
+						managedFieldsEntry("kubectl-annotate", `{"f:metadata":{"f:annotations":{".":{},"f:prometheus.io/scrape":{}}}}`),
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"kind": "Service",
+				"metadata": map[string]interface{}{
+					"name":        "web",
+					"labels":      map[string]interface{}{"team": "platform"},
+					"annotations": map[string]interface{}{"prometheus.io/scrape": "true"},
+				},
+			},
+		},
+		{
+			name: "fields and containers added by hand are kept, without helm's defaults",
+			applied: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"containers": []interface{}{
+								map[string]interface{}{"name": "web", "image": "nginx:1"},
+							},
+						},
+					},
+				},
+			},
+			live: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata": map[string]interface{}{
+					"name":        "web",
+					"annotations": map[string]interface{}{},
+					"managedFields": []interface{}{
+						managedFieldsEntry("helm", `{"f:spec":{"f:template":{"f:metadata":{"f:creationTimestamp":{}},"f:spec":{"f:dnsPolicy":{},"f:restartPolicy":{},"f:containers":{"k:{\"name\":\"web\"}":{".":{},"f:name":{},"f:image":{},"f:imagePullPolicy":{}}}}}}}`),
+						managedFieldsEntry("kubectl-patch", `{"f:spec":{"f:strategy":{"f:type":{}},"f:template":{"f:spec":{"f:nodeSelector":{".":{},"f:disk":{}},"f:containers":{"k:{\"name\":\"web\"}":{"f:resources":{"f:limits":{".":{},"f:memory":{}}}},"k:{\"name\":\"sidecar\"}":{".":{},"f:name":{},"f:image":{}}}}}}}`),
+					},
+				},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{"type": "Recreate"},
+					"template": map[string]interface{}{
+						"metadata": map[string]interface{}{"creationTimestamp": nil},
+						"spec": map[string]interface{}{
+							"nodeSelector":  map[string]interface{}{"disk": "ssd"},
+							"dnsPolicy":     "ClusterFirst",
+							"restartPolicy": "Always",
+							"containers": []interface{}{
+								map[string]interface{}{
+									"name":            "web",
+									"image":           "nginx:1",
+									"imagePullPolicy": "IfNotPresent",
+									"resources":       map[string]interface{}{"limits": map[string]interface{}{"memory": "512Mi"}},
+								},
+								map[string]interface{}{"name": "sidecar", "image": "envoy:1"},
+							},
+						},
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{"type": "Recreate"},
+					"template": map[string]interface{}{
+						"spec": map[string]interface{}{
+							"nodeSelector": map[string]interface{}{"disk": "ssd"},
+							"containers": []interface{}{
+								map[string]interface{}{
+									"name":      "web",
+									"image":     "nginx:1",
+									"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "512Mi"}},
+								},
+								map[string]interface{}{"name": "sidecar", "image": "envoy:1"},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "defaults under an applied field are removed",
+			applied: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{"type": "RollingUpdate"},
+				},
+			},
+			live: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata": map[string]interface{}{
+					"name": "web",
+					"managedFields": []interface{}{
+						managedFieldsEntry("helm", `{"f:spec":{"f:strategy":{"f:type":{},"f:rollingUpdate":{".":{},"f:maxSurge":{},"f:maxUnavailable":{}}}}}`),
+					},
+				},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{
+						"type":          "RollingUpdate",
+						"rollingUpdate": map[string]interface{}{"maxSurge": "25%", "maxUnavailable": "25%"},
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"strategy": map[string]interface{}{"type": "RollingUpdate"},
+				},
+			},
+		},
+		{
+			name: "reordered containers are matched by name",
+			applied: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "web", "image": "nginx:1"},
+						map[string]interface{}{"name": "sidecar", "image": "envoy:1"},
+					},
+				},
+			},
+			live: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "sidecar", "image": "envoy:2", "imagePullPolicy": "IfNotPresent"},
+						map[string]interface{}{"name": "web", "image": "nginx:1", "imagePullPolicy": "Always"},
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "sidecar", "image": "envoy:2"},
+						map[string]interface{}{"name": "web", "image": "nginx:1"},
+					},
+				},
+			},
+		},
+		{
+			name: "without managed fields, fields last applied with kubectl are kept",
+			applied: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"ports": []interface{}{
+						map[string]interface{}{"port": 80},
+					},
+				},
+			},
+			live: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata": map[string]interface{}{
+					"name": "web",
+					"annotations": map[string]interface{}{
+						"kubectl.kubernetes.io/last-applied-configuration": `{"apiVersion":"v1","kind":"Service","metadata":{"name":"web"},"spec":{"ports":[{"port":80,"targetPort":8080}]}}`,
+					},
+				},
+				"spec": map[string]interface{}{
+					"clusterIP":       "10.0.0.1",
+					"sessionAffinity": "None",
+					"ports": []interface{}{
+						map[string]interface{}{"port": int64(80), "protocol": "TCP", "targetPort": int64(8080)},
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   map[string]interface{}{"name": "web"},
+				"spec": map[string]interface{}{
+					"ports": []interface{}{
+						map[string]interface{}{"port": int64(80), "targetPort": int64(8080)},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			actual := cleanLiveObject(test.applied, test.live)
+			req.NotNil(actual)
+
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_driftPatchKeepsAddedFields(t *testing.T) {
+	req := require.New(t)
+
+	applied := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1
+`
+	live := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: default
+  uid: "1234"
+  managedFields:
+  - manager: helm
+    operation: Update
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:replicas: {}
+        f:revisionHistoryLimit: {}
+        f:template:
+          f:spec:
+            f:dnsPolicy: {}
+            f:containers:
+              k:{"name":"web"}:
+                .: {}
+                f:name: {}
+                f:image: {}
+                f:imagePullPolicy: {}
+  - manager: kubectl-patch
+    operation: Update
+    fieldsType: FieldsV1
+    fieldsV1:
+      f:spec:
+        f:template:
+          f:spec:
+            f:nodeSelector:
+              .: {}
+              f:disk: {}
+            f:containers:
+              k:{"name":"web"}:
+                f:resources:
+                  f:limits:
+                    .: {}
+                    f:memory: {}
+spec:
+  replicas: 1
+  revisionHistoryLimit: 10
+  template:
+    spec:
+      dnsPolicy: ClusterFirst
+      nodeSelector:
+        disk: ssd
+      containers:
+      - name: web
+        image: nginx:1
+        imagePullPolicy: IfNotPresent
+        resources:
+          limits:
+            memory: 512Mi
+status:
+  replicas: 1
+`
+
+	appliedObject := map[string]interface{}{}
+	req.NoError(yaml.Unmarshal([]byte(applied), &appliedObject))
+	liveObject := map[string]interface{}{}
+	req.NoError(yaml.Unmarshal([]byte(live), &liveObject))
+
+	liveContent, err := yaml.Marshal(cleanLiveObject(appliedObject, liveObject))
+	req.NoError(err)
+
+	patch, err := createTwoWayMergePatch([]byte(applied), liveContent)
+	req.NoError(err)
+
+	assert.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      $setElementOrder/containers:
+      - name: web
+      containers:
+      - name: web
+        resources:
+          limits:
+            memory: 512Mi
+      nodeSelector:
+        disk: ssd
+`, string(patch))
+}
+
+func managedFieldsEntry(manager string, fields string) map[string]interface{} {
+	fieldsV1 := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(fields), &fieldsV1); err != nil {
+		panic(err)
+	}
+
+	return map[string]interface{}{
+		"manager":    manager,
+		"operation":  "Update",
+		"fieldsType": "FieldsV1",
+		"fieldsV1":   fieldsV1,
+	}
+}
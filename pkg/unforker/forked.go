@@ -1,6 +1,9 @@
 package unforker
 
 import (
+	"fmt"
+
+	"github.com/replicatedhq/unfork/pkg/chartindex"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 )
 
@@ -19,5 +22,57 @@ type LocalChart struct {
 	Templates    []*chart.Template
 	Values       map[string]*chart.Value
 	Chart        *chart.Chart
-	Namespace    string
+	Config       *chart.Config // the user supplied values the chart was deployed with
+	// ValueFiles are files in the chart that a gitops controller merges Config on top of. They're
+	// read into Config when the chart is downloaded
+	ValueFiles              []string
+	IgnoreMissingValueFiles bool
+	Manifest                string // the manifest helm applied, when the chart came from a release
+	Namespace               string
+	Revision                int32
+	Status                  string // the helm status of the revision, such as deployed or failed
+
+	// Controller is the gitops controller that deploys the release, if any
+	Controller string
+	// Upstream is the chart repo the release was installed from, when that's already known
+	Upstream *chartindex.ChartMatch
+	// FromLabels is set for charts that were reconstructed from the labels on live objects,
+	// because there's no release record. Manifest has the live objects
+	FromLabels bool
+}
+
+// ReleaseKey identifies the release that the chart was installed as, across revisions
+func (l *LocalChart) ReleaseKey() string {
+	source := "helm3"
+	if l.IsTiller {
+		source = "helm2"
+	} else if l.FromLabels {
+		return fmt.Sprintf("labels:%s/%s/%s", l.Namespace, l.HelmName, l.ChartName)
+	} else if l.Chart == nil && l.Controller != "" {
+		// only known from a gitops resource, there's no helm release
+		source = l.Controller
+	}
+
+	return fmt.Sprintf("%s:%s/%s", source, l.Namespace, l.HelmName)
+}
+
+// withChart returns a copy of the chart that renders c. Charts that were only found in
+// gitops resources are deployed straight from their upstream, so they are rendered with it
+func (l *LocalChart) withChart(c *chart.Chart) *LocalChart {
+	withChart := *l
+	withChart.Chart = c
+	withChart.Templates = c.GetTemplates()
+	withChart.Values = c.GetValues().GetValues()
+	withChart.AppVersion = c.GetMetadata().GetAppVersion()
+	withChart.Keywords = c.GetMetadata().GetKeywords()
+
+	return &withChart
+}
+
+func (l *LocalChart) renderConfig() *chart.Config {
+	if l.Config != nil {
+		return l.Config
+	}
+
+	return &chart.Config{Raw: string(""), Values: l.Values}
 }
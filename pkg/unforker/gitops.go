@@ -0,0 +1,444 @@
+package unforker
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	kuberneteserrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/strvals"
+)
+
+const (
+	ControllerFlux   = "flux"
+	ControllerArgoCD = "argocd"
+)
+
+// The kinds are listed at the version the cluster prefers, so that the controller's api versions
+// don't need to be known. The fields that are read are the same in every version
+var (
+	// fluxHelmOperatorKind is the HelmRelease of flux v1's helm operator
+	fluxHelmOperatorKind = schema.GroupKind{Group: "helm.fluxcd.io", Kind: "HelmRelease"}
+	// fluxHelmControllerKind is the HelmRelease of flux v2's helm controller
+	fluxHelmControllerKind = schema.GroupKind{Group: "helm.toolkit.fluxcd.io", Kind: "HelmRelease"}
+	fluxHelmRepositoryKind = schema.GroupKind{Group: "source.toolkit.fluxcd.io", Kind: "HelmRepository"}
+	argoApplicationKind    = schema.GroupKind{Group: "argoproj.io", Kind: "Application"}
+)
+
+// gitOpsRelease is a chart from a helm repository that a gitops controller deploys
+type gitOpsRelease struct {
+	Controller   string
+	ReleaseName  string
+	Namespace    string
+	RepoName     string
+	RepoURL      string
+	ChartName    string
+	ChartVersion string
+	Values       map[string]interface{}
+
+	// ValueFiles are files in the chart that the values are merged on top of
+	ValueFiles              []string
+	IgnoreMissingValueFiles bool
+}
+
+// queryGitOpsForCharts reads the charts that flux and argo cd deploy from their custom resources.
+// Controllers that aren't installed, or that we aren't allowed to read, are skipped
+func (u *Unforker) queryGitOpsForCharts() ([]*LocalChart, error) {
+	gitOpsReleases := []*gitOpsRelease{}
+
+	fluxHelmOperatorReleases, err := u.listGitOpsResources(fluxHelmOperatorKind)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list flux helm operator releases")
+	}
+	for _, obj := range fluxHelmOperatorReleases {
+		if rls := fluxHelmOperatorRelease(obj); rls != nil {
+			gitOpsReleases = append(gitOpsReleases, rls)
+		}
+	}
+
+	fluxHelmControllerReleases, err := u.listGitOpsResources(fluxHelmControllerKind)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list flux helm controller releases")
+	}
+	if len(fluxHelmControllerReleases) > 0 {
+		helmRepositories, err := u.listGitOpsResources(fluxHelmRepositoryKind)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list flux helm repositories")
+		}
+		repoURLs := map[string]string{}
+		for _, helmRepository := range helmRepositories {
+			repoURL, _, _ := unstructured.NestedString(helmRepository.Object, "spec", "url")
+			repoURLs[fmt.Sprintf("%s/%s", helmRepository.GetNamespace(), helmRepository.GetName())] = repoURL
+		}
+
+		for _, obj := range fluxHelmControllerReleases {
+			if rls := fluxHelmControllerRelease(obj, repoURLs); rls != nil {
+				gitOpsReleases = append(gitOpsReleases, rls)
+			}
+		}
+	}
+
+	argoApplications, err := u.listGitOpsResources(argoApplicationKind)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list argo cd applications")
+	}
+	for _, obj := range argoApplications {
+		rlss, err := argoApplicationReleases(obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read argo cd application %s/%s", obj.GetNamespace(), obj.GetName())
+		}
+		gitOpsReleases = append(gitOpsReleases, rlss...)
+	}
+
+	gitOpsCharts := []*LocalChart{}
+	for _, rls := range gitOpsReleases {
+		localChart, err := gitOpsReleaseToLocalChart(rls)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s release %s", rls.Controller, rls.ReleaseName)
+		}
+		gitOpsCharts = append(gitOpsCharts, localChart)
+	}
+
+	return gitOpsCharts, nil
+}
+
+func hasGitOpsResources(dynamicClient dynamic.Interface, mapper meta.RESTMapper) bool {
+	for _, gk := range []schema.GroupKind{fluxHelmOperatorKind, fluxHelmControllerKind, argoApplicationKind} {
+		mapping, err := mapper.RESTMapping(gk)
+		if err != nil {
+			continue
+		}
+		list, err := dynamicClient.Resource(mapping.Resource).Namespace("").List(metav1.ListOptions{Limit: 1})
+		if err == nil && len(list.Items) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listGitOpsResources lists gk at the version the cluster prefers. Kinds that aren't installed are empty
+func (u *Unforker) listGitOpsResources(gk schema.GroupKind) ([]unstructured.Unstructured, error) {
+	mapping, err := u.restMapper.RESTMapping(gk)
+	if meta.IsNoMatchError(err) {
+		return []unstructured.Unstructured{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list, err := u.dynamicClient.Resource(mapping.Resource).Namespace("").List(metav1.ListOptions{})
+	if kuberneteserrors.IsNotFound(err) || kuberneteserrors.IsForbidden(err) {
+		return []unstructured.Unstructured{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// mergeGitOpsCharts attaches the known upstream to helm releases that a gitops controller deployed,
+// and adds the charts that were only found in gitops resources, such as argo cd applications
+func mergeGitOpsCharts(helmCharts []*LocalChart, gitOpsCharts []*LocalChart) []*LocalChart {
+	helmReleases := map[string]*LocalChart{}
+	for _, helmChart := range helmCharts {
+		helmReleases[fmt.Sprintf("%s/%s", helmChart.Namespace, helmChart.HelmName)] = helmChart
+	}
+
+	merged := append([]*LocalChart{}, helmCharts...)
+	for _, gitOpsChart := range gitOpsCharts {
+		helmChart, ok := helmReleases[fmt.Sprintf("%s/%s", gitOpsChart.Namespace, gitOpsChart.HelmName)]
+		if ok && helmChart.ChartName == gitOpsChart.ChartName {
+			helmChart.Controller = gitOpsChart.Controller
+			helmChart.Upstream = gitOpsChart.Upstream
+			continue
+		}
+
+		merged = append(merged, gitOpsChart)
+	}
+
+	return merged
+}
+
+func gitOpsReleaseToLocalChart(rls *gitOpsRelease) (*LocalChart, error) {
+	config := &chart.Config{Raw: ""}
+	if len(rls.Values) > 0 {
+		raw, err := yaml.Marshal(rls.Values)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal values")
+		}
+		config.Raw = string(raw)
+	}
+
+	localChart := LocalChart{
+		HelmName:                rls.ReleaseName,
+		ChartName:               rls.ChartName,
+		ChartVersion:            rls.ChartVersion,
+		Config:                  config,
+		ValueFiles:              rls.ValueFiles,
+		IgnoreMissingValueFiles: rls.IgnoreMissingValueFiles,
+		Namespace:               rls.Namespace,
+		Controller:              rls.Controller,
+		Upstream: &chartindex.ChartMatch{
+			Repo:         rls.RepoName,
+			Name:         rls.ChartName,
+			ChartVersion: rls.ChartVersion,
+			URI:          rls.RepoURL,
+			MatchQuality: chartindex.MatchExact,
+		},
+	}
+
+	return &localChart, nil
+}
+
+// fluxHelmOperatorRelease reads a flux v1 HelmRelease. Charts from git have no upstream repo, and are skipped
+func fluxHelmOperatorRelease(obj unstructured.Unstructured) *gitOpsRelease {
+	repoURL, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "repository")
+	chartName, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "name")
+	chartVersion, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "version")
+	if repoURL == "" || chartName == "" {
+		return nil
+	}
+
+	namespace, _, _ := unstructured.NestedString(obj.Object, "spec", "targetNamespace")
+	if namespace == "" {
+		namespace = obj.GetNamespace()
+	}
+
+	// the helm operator names releases namespace-name unless a name is set
+	releaseName, _, _ := unstructured.NestedString(obj.Object, "spec", "releaseName")
+	if releaseName == "" {
+		releaseName = fmt.Sprintf("%s-%s", obj.GetNamespace(), obj.GetName())
+	}
+
+	values, _, _ := unstructured.NestedMap(obj.Object, "spec", "values")
+
+	return &gitOpsRelease{
+		Controller:   ControllerFlux,
+		ReleaseName:  releaseName,
+		Namespace:    namespace,
+		RepoName:     repoNameFromURL(repoURL),
+		RepoURL:      repoURL,
+		ChartName:    chartName,
+		ChartVersion: chartVersion,
+		Values:       values,
+	}
+}
+
+// fluxHelmControllerRelease reads a flux v2 HelmRelease. repoURLs has the url of each
+// HelmRepository, keyed by namespace/name. Charts from git or buckets are skipped
+func fluxHelmControllerRelease(obj unstructured.Unstructured, repoURLs map[string]string) *gitOpsRelease {
+	chartName, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "spec", "chart")
+	chartVersion, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "spec", "version")
+	sourceKind, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "spec", "sourceRef", "kind")
+	sourceName, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "spec", "sourceRef", "name")
+	sourceNamespace, _, _ := unstructured.NestedString(obj.Object, "spec", "chart", "spec", "sourceRef", "namespace")
+	if sourceKind != "HelmRepository" || chartName == "" {
+		return nil
+	}
+	if sourceNamespace == "" {
+		sourceNamespace = obj.GetNamespace()
+	}
+
+	repoURL := repoURLs[fmt.Sprintf("%s/%s", sourceNamespace, sourceName)]
+	if repoURL == "" {
+		return nil
+	}
+
+	// the helm controller names releases targetNamespace-name when the target namespace is set
+	targetNamespace, _, _ := unstructured.NestedString(obj.Object, "spec", "targetNamespace")
+	namespace := obj.GetNamespace()
+	releaseName := obj.GetName()
+	if targetNamespace != "" {
+		namespace = targetNamespace
+		releaseName = fmt.Sprintf("%s-%s", targetNamespace, obj.GetName())
+	}
+	if name, _, _ := unstructured.NestedString(obj.Object, "spec", "releaseName"); name != "" {
+		releaseName = name
+	}
+
+	values, _, _ := unstructured.NestedMap(obj.Object, "spec", "values")
+
+	return &gitOpsRelease{
+		Controller:   ControllerFlux,
+		ReleaseName:  releaseName,
+		Namespace:    namespace,
+		RepoName:     sourceName,
+		RepoURL:      repoURL,
+		ChartName:    chartName,
+		ChartVersion: chartVersion,
+		Values:       values,
+	}
+}
+
+// argoApplicationReleases reads the helm repository sources of an argo cd Application, which has
+// one source, or a list of sources. Sources that deploy from git, or that only provide value files
+// to other sources, are skipped
+func argoApplicationReleases(obj unstructured.Unstructured) ([]*gitOpsRelease, error) {
+	sources, _, _ := unstructured.NestedSlice(obj.Object, "spec", "sources")
+	if len(sources) == 0 {
+		if source, ok, _ := unstructured.NestedMap(obj.Object, "spec", "source"); ok {
+			sources = []interface{}{source}
+		}
+	}
+
+	rlss := []*gitOpsRelease{}
+	for _, source := range sources {
+		sourceMap, ok := source.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		rls, err := argoSourceRelease(obj, sourceMap)
+		if err != nil {
+			return nil, err
+		}
+		if rls != nil {
+			rlss = append(rlss, rls)
+		}
+	}
+
+	return rlss, nil
+}
+
+// argoSourceRelease reads a source of an argo cd Application, if it's a chart from a helm repository.
+// targetRevision can be a semver range, which is resolved against the index when the upstream is found
+func argoSourceRelease(obj unstructured.Unstructured, source map[string]interface{}) (*gitOpsRelease, error) {
+	repoURL, _, _ := unstructured.NestedString(source, "repoURL")
+	chartName, _, _ := unstructured.NestedString(source, "chart")
+	chartVersion, _, _ := unstructured.NestedString(source, "targetRevision")
+	if repoURL == "" || chartName == "" {
+		return nil, nil
+	}
+
+	namespace, _, _ := unstructured.NestedString(obj.Object, "spec", "destination", "namespace")
+	if namespace == "" {
+		namespace = obj.GetNamespace()
+	}
+
+	releaseName, _, _ := unstructured.NestedString(source, "helm", "releaseName")
+	if releaseName == "" {
+		releaseName = obj.GetName()
+	}
+
+	// value files are merged first, then values and valuesObject, then parameters
+	valueFiles, _, _ := unstructured.NestedStringSlice(source, "helm", "valueFiles")
+	ignoreMissingValueFiles, _, _ := unstructured.NestedBool(source, "helm", "ignoreMissingValueFiles")
+
+	// valuesObject is used instead of values when it's set
+	values, hasValuesObject, _ := unstructured.NestedMap(source, "helm", "valuesObject")
+	if !hasValuesObject {
+		values = map[string]interface{}{}
+		rawValues, _, _ := unstructured.NestedString(source, "helm", "values")
+		if rawValues != "" {
+			if err := yaml.Unmarshal([]byte(rawValues), &values); err != nil {
+				return nil, errors.Wrap(err, "failed to unmarshal values")
+			}
+		}
+	}
+
+	// parameters override values, like --set
+	parameters, _, _ := unstructured.NestedSlice(source, "helm", "parameters")
+	for _, parameter := range parameters {
+		p, ok := parameter.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := p["name"].(string)
+		value, _ := p["value"].(string)
+		if name == "" {
+			continue
+		}
+
+		parse := strvals.ParseInto
+		if forceString, _ := p["forceString"].(bool); forceString {
+			parse = strvals.ParseIntoString
+		}
+		if err := parse(fmt.Sprintf("%s=%s", name, value), values); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse parameter %s", name)
+		}
+	}
+
+	return &gitOpsRelease{
+		Controller:              ControllerArgoCD,
+		ReleaseName:             releaseName,
+		Namespace:               namespace,
+		RepoName:                repoNameFromURL(repoURL),
+		RepoURL:                 repoURL,
+		ChartName:               chartName,
+		ChartVersion:            chartVersion,
+		Values:                  values,
+		ValueFiles:              valueFiles,
+		IgnoreMissingValueFiles: ignoreMissingValueFiles,
+	}, nil
+}
+
+// withValueFiles returns a copy of l with the value files in upstreamChart merged under its config.
+// Value files from another source or a url can't be read, and fail unless missing files are ignored
+func (l *LocalChart) withValueFiles(upstreamChart *chart.Chart) (*LocalChart, error) {
+	files := map[string][]byte{}
+	for _, file := range upstreamChart.GetFiles() {
+		files[file.GetTypeUrl()] = file.GetValue()
+	}
+	if upstreamChart.GetValues() != nil {
+		files[chartutil.ValuesfileName] = []byte(upstreamChart.GetValues().GetRaw())
+	}
+
+	values := map[string]interface{}{}
+	for _, valueFile := range l.ValueFiles {
+		content, ok := files[strings.TrimPrefix(path.Clean(valueFile), "./")]
+		if !ok {
+			if l.IgnoreMissingValueFiles {
+				continue
+			}
+			return nil, errors.Errorf("value file %s is not in the chart", valueFile)
+		}
+
+		fileValues := map[string]interface{}{}
+		if err := yaml.Unmarshal(content, &fileValues); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal value file %s", valueFile)
+		}
+		values = mergeValues(values, fileValues)
+	}
+
+	configValues := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(l.Config.GetRaw()), &configValues); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal values")
+	}
+	values = mergeValues(values, configValues)
+
+	raw := ""
+	if len(values) > 0 {
+		b, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal values")
+		}
+		raw = string(b)
+	}
+
+	withValueFiles := *l
+	withValueFiles.Config = &chart.Config{Raw: raw}
+	withValueFiles.ValueFiles = nil
+
+	return &withValueFiles, nil
+}
+
+// repoNameFromURL names a helm repository that's only known by its url
+func repoNameFromURL(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return repoURL
+	}
+
+	return u.Host
+}
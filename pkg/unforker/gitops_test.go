@@ -0,0 +1,273 @@
+package unforker
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+func unstructuredFromYAML(t *testing.T, content string) unstructured.Unstructured {
+	obj := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(content), &obj))
+	return unstructured.Unstructured{Object: obj}
+}
+
+func Test_fluxHelmOperatorRelease(t *testing.T) {
+	obj := unstructuredFromYAML(t, `apiVersion: helm.fluxcd.io/v1
+kind: HelmRelease
+metadata:
+  name: redis
+  namespace: flux
+spec:
+  targetNamespace: cache
+  chart:
+    repository: https://kubernetes-charts.storage.googleapis.com/
+    name: redis
+    version: 10.5.7
+  values:
+    cluster:
+      enabled: false
+`)
+
+	rls := fluxHelmOperatorRelease(obj)
+	require.NotNil(t, rls)
+
+	assert.Equal(t, &gitOpsRelease{
+		Controller:   ControllerFlux,
+		ReleaseName:  "flux-redis",
+		Namespace:    "cache",
+		RepoName:     "kubernetes-charts.storage.googleapis.com",
+		RepoURL:      "https://kubernetes-charts.storage.googleapis.com/",
+		ChartName:    "redis",
+		ChartVersion: "10.5.7",
+		Values: map[string]interface{}{
+			"cluster": map[string]interface{}{"enabled": false},
+		},
+	}, rls)
+}
+
+func Test_fluxHelmControllerRelease(t *testing.T) {
+	obj := unstructuredFromYAML(t, `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: podinfo
+  namespace: apps
+spec:
+  chart:
+    spec:
+      chart: podinfo
+      version: 5.0.0
+      sourceRef:
+        kind: HelmRepository
+        name: podinfo
+        namespace: flux-system
+`)
+
+	rls := fluxHelmControllerRelease(obj, map[string]string{"flux-system/podinfo": "https://stefanprodan.github.io/podinfo"})
+	require.NotNil(t, rls)
+	assert.Equal(t, "podinfo", rls.ReleaseName)
+	assert.Equal(t, "apps", rls.Namespace)
+	assert.Equal(t, "podinfo", rls.RepoName)
+	assert.Equal(t, "https://stefanprodan.github.io/podinfo", rls.RepoURL)
+	assert.Equal(t, "5.0.0", rls.ChartVersion)
+
+	assert.Nil(t, fluxHelmControllerRelease(obj, map[string]string{}))
+}
+
+func Test_argoApplicationReleases(t *testing.T) {
+	tests := []struct {
+		name     string
+		app      string
+		expected []*gitOpsRelease
+	}{
+		{
+			name: "helm repo with values and parameters",
+			app: `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: ingress
+  namespace: argocd
+spec:
+  destination:
+    namespace: ingress
+  source:
+    repoURL: https://kubernetes-charts.storage.googleapis.com
+    chart: nginx-ingress
+    targetRevision: 1.24.4
+    helm:
+      releaseName: edge
+      values: |
+        controller:
+          replicaCount: 2
+      parameters:
+      - name: controller.image.tag
+        value: "0.26.1"
+        forceString: true
+`,
+			expected: []*gitOpsRelease{{
+				Controller:   ControllerArgoCD,
+				ReleaseName:  "edge",
+				Namespace:    "ingress",
+				RepoName:     "kubernetes-charts.storage.googleapis.com",
+				RepoURL:      "https://kubernetes-charts.storage.googleapis.com",
+				ChartName:    "nginx-ingress",
+				ChartVersion: "1.24.4",
+				Values: map[string]interface{}{
+					"controller": map[string]interface{}{
+						"replicaCount": float64(2),
+						"image":        map[string]interface{}{"tag": "0.26.1"},
+					},
+				},
+			}},
+		},
+		{
+			name: "valuesObject is used instead of values, with value files",
+			app: `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: redis
+spec:
+  source:
+    repoURL: https://charts.bitnami.com/bitnami
+    chart: redis
+    targetRevision: 10.5.*
+    helm:
+      valueFiles:
+      - values-production.yaml
+      values: |
+        cluster:
+          enabled: false
+      valuesObject:
+        cluster:
+          slaveCount: 3
+`,
+			expected: []*gitOpsRelease{{
+				Controller:   ControllerArgoCD,
+				ReleaseName:  "redis",
+				RepoName:     "charts.bitnami.com",
+				RepoURL:      "https://charts.bitnami.com/bitnami",
+				ChartName:    "redis",
+				ChartVersion: "10.5.*",
+				Values: map[string]interface{}{
+					"cluster": map[string]interface{}{"slaveCount": float64(3)},
+				},
+				ValueFiles: []string{"values-production.yaml"},
+			}},
+		},
+		{
+			name: "multiple sources",
+			app: `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: monitoring
+spec:
+  destination:
+    namespace: monitoring
+  sources:
+  - repoURL: https://github.com/acme/values.git
+    ref: values
+  - repoURL: https://prometheus-community.github.io/helm-charts
+    chart: prometheus
+    targetRevision: 11.0.0
+  - repoURL: https://grafana.github.io/helm-charts
+    chart: grafana
+    targetRevision: 5.0.0
+    helm:
+      releaseName: dashboards
+`,
+			expected: []*gitOpsRelease{
+				{
+					Controller:   ControllerArgoCD,
+					ReleaseName:  "monitoring",
+					Namespace:    "monitoring",
+					RepoName:     "prometheus-community.github.io",
+					RepoURL:      "https://prometheus-community.github.io/helm-charts",
+					ChartName:    "prometheus",
+					ChartVersion: "11.0.0",
+					Values:       map[string]interface{}{},
+				},
+				{
+					Controller:   ControllerArgoCD,
+					ReleaseName:  "dashboards",
+					Namespace:    "monitoring",
+					RepoName:     "grafana.github.io",
+					RepoURL:      "https://grafana.github.io/helm-charts",
+					ChartName:    "grafana",
+					ChartVersion: "5.0.0",
+					Values:       map[string]interface{}{},
+				},
+			},
+		},
+		{
+			name: "git source",
+			app: `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: guestbook
+spec:
+  source:
+    repoURL: https://github.com/argoproj/argocd-example-apps.git
+    path: helm-guestbook
+`,
+			expected: []*gitOpsRelease{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rlss, err := argoApplicationReleases(unstructuredFromYAML(t, test.app))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, rlss)
+		})
+	}
+}
+
+func Test_mergeGitOpsCharts(t *testing.T) {
+	helmChart := &LocalChart{HelmName: "flux-redis", Namespace: "cache", ChartName: "redis"}
+	fluxChart, err := gitOpsReleaseToLocalChart(&gitOpsRelease{Controller: ControllerFlux, ReleaseName: "flux-redis", Namespace: "cache", ChartName: "redis", RepoName: "stable"})
+	require.NoError(t, err)
+	argoChart, err := gitOpsReleaseToLocalChart(&gitOpsRelease{Controller: ControllerArgoCD, ReleaseName: "edge", Namespace: "ingress", ChartName: "nginx-ingress", RepoName: "stable"})
+	require.NoError(t, err)
+
+	merged := mergeGitOpsCharts([]*LocalChart{helmChart}, []*LocalChart{fluxChart, argoChart})
+
+	require.Len(t, merged, 2)
+	assert.Equal(t, helmChart, merged[0])
+	assert.Equal(t, ControllerFlux, helmChart.Controller)
+	assert.Equal(t, "stable", helmChart.Upstream.Repo)
+	assert.Equal(t, argoChart, merged[1])
+	assert.Equal(t, "argocd:ingress/edge", argoChart.ReleaseKey())
+}
+
+func Test_withValueFiles(t *testing.T) {
+	upstreamChart := &chart.Chart{
+		Values: &chart.Config{Raw: "replicas: 1\n"},
+		Files: []*any.Any{
+			{TypeUrl: "values-production.yaml", Value: []byte("replicas: 3\nmetrics:\n  enabled: true\n")},
+		},
+	}
+
+	localChart := &LocalChart{
+		Config:     &chart.Config{Raw: "metrics:\n  port: 9121\n"},
+		ValueFiles: []string{"./values-production.yaml"},
+	}
+
+	withValueFiles, err := localChart.withValueFiles(upstreamChart)
+	require.NoError(t, err)
+	assert.Equal(t, "metrics:\n  enabled: true\n  port: 9121\nreplicas: 3\n", withValueFiles.Config.Raw)
+	assert.Empty(t, withValueFiles.ValueFiles)
+
+	localChart.ValueFiles = []string{"$values/redis/values.yaml"}
+	_, err = localChart.withValueFiles(upstreamChart)
+	assert.Error(t, err)
+
+	localChart.IgnoreMissingValueFiles = true
+	withValueFiles, err = localChart.withValueFiles(upstreamChart)
+	require.NoError(t, err)
+	assert.Equal(t, "metrics:\n  port: 9121\n", withValueFiles.Config.Raw)
+}
@@ -0,0 +1,272 @@
+package unforker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kuberneteserrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+var magicGzip = []byte{0x1f, 0x8b, 0x08}
+
+// helm3Release is the part of a Helm 3 release record that unfork uses. Helm 3
+// stores releases as json, so we decode them without depending on helm v3
+type helm3Release struct {
+	Name      string                 `json:"name"`
+	Info      *helm3Info             `json:"info,omitempty"`
+	Chart     *helm3Chart            `json:"chart,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Manifest  string                 `json:"manifest,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"`
+}
+
+type helm3Info struct {
+	Status string `json:"status,omitempty"`
+}
+
+func (i *helm3Info) status() string {
+	if i == nil {
+		return ""
+	}
+	return i.Status
+}
+
+type helm3Chart struct {
+	Metadata  *helm3Metadata         `json:"metadata"`
+	Templates []*helm3File           `json:"templates"`
+	Values    map[string]interface{} `json:"values"`
+	Files     []*helm3File           `json:"files"`
+}
+
+type helm3Metadata struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	AppVersion  string   `json:"appVersion"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+}
+
+type helm3File struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// helm3Selector matches the releases that discovery lists, written by both the secret and configmap storage drivers
+func helm3Selector() string {
+	return "owner=helm,status in (deployed,failed,pending-upgrade)"
+}
+
+// helm3HistorySelector matches every revision of a release
+func helm3HistorySelector(helmName string) string {
+	return labels.Set{"owner": "helm", "name": helmName}.AsSelector().String()
+}
+
+// hasHelm3Releases returns true if there are any releases in namespace, or in all namespaces if it's empty
+func hasHelm3Releases(client *kubernetes.Clientset, namespace string) (bool, error) {
+	listOptions := metav1.ListOptions{LabelSelector: helm3Selector(), Limit: 1}
+
+	secrets, err := client.CoreV1().Secrets(namespace).List(listOptions)
+	if err == nil && len(secrets.Items) > 0 {
+		return true, nil
+	}
+
+	configMaps, err := client.CoreV1().ConfigMaps(namespace).List(listOptions)
+	if err != nil {
+		return false, err
+	}
+
+	return len(configMaps.Items) > 0, nil
+}
+
+// queryHelm3ForCharts lists the releases in namespace, or in all namespaces if it's empty
+func (u *Unforker) queryHelm3ForCharts(namespace string) ([]*LocalChart, error) {
+	helm3Charts, err := u.queryHelm3(namespace, helm3Selector())
+	if err != nil {
+		return nil, err
+	}
+
+	return latestRevisions(helm3Charts), nil
+}
+
+// queryHelm3ForHistory returns every revision of the release, in one or all namespaces
+func (u *Unforker) queryHelm3ForHistory(namespace string, helmName string) ([]*LocalChart, error) {
+	return u.queryHelm3(namespace, helm3HistorySelector(helmName))
+}
+
+func (u *Unforker) queryHelm3(namespace string, selector string) ([]*LocalChart, error) {
+	listOptions := metav1.ListOptions{LabelSelector: selector}
+
+	encodedReleases := []string{}
+
+	secrets, err := u.client.CoreV1().Secrets(namespace).List(listOptions)
+	if kuberneteserrors.IsForbidden(err) {
+		secrets = &corev1.SecretList{}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to list helm 3 secrets")
+	}
+	for _, secret := range secrets.Items {
+		if secret.Type != "helm.sh/release.v1" {
+			continue
+		}
+		encodedReleases = append(encodedReleases, string(secret.Data["release"]))
+	}
+
+	configMaps, err := u.client.CoreV1().ConfigMaps(namespace).List(listOptions)
+	if kuberneteserrors.IsForbidden(err) {
+		configMaps = &corev1.ConfigMapList{}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to list helm 3 configmaps")
+	}
+	for _, configMap := range configMaps.Items {
+		encodedReleases = append(encodedReleases, configMap.Data["release"])
+	}
+
+	helm3Charts := make([]*LocalChart, 0)
+	for _, encodedRelease := range encodedReleases {
+		helm3Release, err := decodeHelm3Release(encodedRelease)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode helm 3 release")
+		}
+
+		localChart, err := helm3ReleaseToLocalChart(helm3Release)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read helm 3 release %s", helm3Release.Name)
+		}
+
+		helm3Charts = append(helm3Charts, localChart)
+	}
+
+	return helm3Charts, nil
+}
+
+// decodeHelm3Release decodes the base64 encoded, gzipped json that helm 3 stores
+// in the "release" key of the storage secret or configmap
+func decodeHelm3Release(data string) (*helm3Release, error) {
+	b, err := decodeReleaseData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rls := helm3Release{}
+	if err := json.Unmarshal(b, &rls); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal release")
+	}
+
+	return &rls, nil
+}
+
+// decodeReleaseData decodes the base64 encoded, gzipped release that both tiller and helm 3
+// store in the "release" key of their storage secrets and configmaps
+func decodeReleaseData(data string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to base64 decode release")
+	}
+
+	// releases stored by very old versions of tiller are not compressed
+	if len(b) <= 3 || !bytes.Equal(b[0:3], magicGzip) {
+		return b, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gzip reader")
+	}
+	defer r.Close()
+
+	b, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress release")
+	}
+
+	return b, nil
+}
+
+func helm3ReleaseToLocalChart(rls *helm3Release) (*LocalChart, error) {
+	if rls.Chart == nil || rls.Chart.Metadata == nil {
+		return nil, errors.New("release does not contain a chart")
+	}
+
+	c, err := helm3ChartToChart(rls.Chart)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert chart")
+	}
+
+	config := &chart.Config{Raw: ""}
+	if len(rls.Config) > 0 {
+		raw, err := yaml.Marshal(rls.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal release config")
+		}
+		config.Raw = string(raw)
+	}
+
+	localChart := LocalChart{
+		IsTiller:     false,
+		HelmName:     rls.Name,
+		ChartName:    c.GetMetadata().GetName(),
+		ChartVersion: c.GetMetadata().GetVersion(),
+		AppVersion:   c.GetMetadata().GetAppVersion(),
+		Keywords:     c.GetMetadata().GetKeywords(),
+		Templates:    c.GetTemplates(),
+		Values:       c.GetValues().GetValues(),
+		Chart:        c,
+		Config:       config,
+		Manifest:     rls.Manifest,
+		Namespace:    rls.Namespace,
+		Revision:     int32(rls.Version),
+		Status:       normalizeStatus(rls.Info.status()),
+	}
+
+	return &localChart, nil
+}
+
+// helm3ChartToChart converts a helm 3 chart into the helm 2 chart that the rest of unfork renders
+func helm3ChartToChart(c *helm3Chart) (*chart.Chart, error) {
+	values, err := yaml.Marshal(c.Values)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal values")
+	}
+
+	converted := chart.Chart{
+		Metadata: &chart.Metadata{
+			ApiVersion:  "v1",
+			Name:        c.Metadata.Name,
+			Version:     c.Metadata.Version,
+			AppVersion:  c.Metadata.AppVersion,
+			Description: c.Metadata.Description,
+			Keywords:    c.Metadata.Keywords,
+		},
+		Values: &chart.Config{
+			Raw: string(values),
+		},
+	}
+
+	for _, template := range c.Templates {
+		converted.Templates = append(converted.Templates, &chart.Template{
+			Name: template.Name,
+			Data: template.Data,
+		})
+	}
+
+	for _, file := range c.Files {
+		converted.Files = append(converted.Files, &any.Any{
+			TypeUrl: file.Name,
+			Value:   file.Data,
+		})
+	}
+
+	return &converted, nil
+}
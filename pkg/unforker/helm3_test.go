@@ -0,0 +1,77 @@
+package unforker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeHelm3Fixture(t *testing.T, content string, compress bool) string {
+	if !compress {
+		return base64.StdEncoding.EncodeToString([]byte(content))
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func Test_decodeHelm3Release(t *testing.T) {
+	release := `{
+  "name": "my-redis",
+  "namespace": "cache",
+  "version": 3,
+  "info": {"status": "deployed"},
+  "config": {"replicas": 3},
+  "chart": {
+    "metadata": {"name": "redis", "version": "10.5.7", "appVersion": "5.0.7", "keywords": ["redis"]},
+    "templates": [{"name": "templates/svc.yaml", "data": "a2luZDogU2VydmljZQo="}],
+    "values": {"replicas": 1}
+  }
+}`
+
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{
+			name:     "gzipped",
+			compress: true,
+		},
+		{
+			name:     "uncompressed",
+			compress: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			rls, err := decodeHelm3Release(encodeHelm3Fixture(t, release, test.compress))
+			req.NoError(err)
+
+			localChart, err := helm3ReleaseToLocalChart(rls)
+			req.NoError(err)
+
+			assert.Equal(t, "my-redis", localChart.HelmName)
+			assert.Equal(t, "cache", localChart.Namespace)
+			assert.Equal(t, "redis", localChart.ChartName)
+			assert.Equal(t, "10.5.7", localChart.ChartVersion)
+			assert.Equal(t, "5.0.7", localChart.AppVersion)
+			req.Len(localChart.Templates, 1)
+			assert.Equal(t, "templates/svc.yaml", localChart.Templates[0].Name)
+			assert.Equal(t, "kind: Service\n", string(localChart.Templates[0].Data))
+			assert.Equal(t, "replicas: 1\n", localChart.Chart.GetValues().GetRaw())
+			assert.Equal(t, "replicas: 3\n", localChart.Config.GetRaw())
+		})
+	}
+}
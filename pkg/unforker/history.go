@@ -0,0 +1,121 @@
+package unforker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// normalizeStatus converts helm 2 status codes, such as PENDING_UPGRADE, to
+// the names helm 3 uses, such as pending-upgrade
+func normalizeStatus(status string) string {
+	return strings.Replace(strings.ToLower(status), "_", "-", -1)
+}
+
+// latestRevisions keeps only the newest revision of each release
+func latestRevisions(localCharts []*LocalChart) []*LocalChart {
+	latest := map[string]*LocalChart{}
+	order := []string{}
+
+	for _, localChart := range localCharts {
+		key := fmt.Sprintf("%s/%s", localChart.Namespace, localChart.HelmName)
+		existing, ok := latest[key]
+		if !ok {
+			order = append(order, key)
+		}
+		if !ok || localChart.Revision > existing.Revision {
+			latest[key] = localChart
+		}
+	}
+
+	result := make([]*LocalChart, 0, len(order))
+	for _, key := range order {
+		result = append(result, latest[key])
+	}
+
+	return result
+}
+
+// ReleaseHistory returns every revision of the release named helmName, oldest first.
+// Helm 3 releases are only read from namespace, or all namespaces if it's empty
+func (u *Unforker) ReleaseHistory(helmName string, namespace string) ([]*LocalChart, error) {
+	history, err := u.findTillerHistory(helmName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find tiller release history")
+	}
+
+	if len(history) == 0 {
+		helm3History, err := u.queryHelm3ForHistory(namespace, helmName)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find helm 3 release history")
+		}
+
+		namespaces := map[string]bool{}
+		for _, revision := range helm3History {
+			namespaces[revision.Namespace] = true
+		}
+		if len(namespaces) > 1 {
+			return nil, errors.Errorf("release %s exists in more than one namespace, choose one with --namespace", helmName)
+		}
+
+		history = helm3History
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Revision < history[j].Revision
+	})
+
+	return history, nil
+}
+
+func (u *Unforker) findTillerHistory(helmName string) ([]*LocalChart, error) {
+	if u.tillerOptions.Host != "" {
+		return u.queryTillerForHistory(u.tillerOptions.Host, helmName)
+	}
+
+	tillerPods, err := getTillerPods(u.client, u.tillerOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tiller pods")
+	}
+
+	if len(tillerPods) == 0 || u.tillerOptions.ReadStorage {
+		hasStorage, err := hasTillerStorage(u.client, u.tillerOptions.namespace(), u.tillerOptions.Storage)
+		if err != nil || !hasStorage {
+			return []*LocalChart{}, nil
+		}
+
+		return u.queryTillerStorageForHistory(u.tillerOptions.namespace(), u.tillerOptions.Storage, helmName)
+	}
+
+	history := []*LocalChart{}
+	for _, pod := range tillerPods {
+		podHistory, err := u.queryTillerPodForHistory(pod, helmName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query tiller %s/%s", pod.Namespace, pod.Name)
+		}
+		history = append(history, podHistory...)
+	}
+
+	return history, nil
+}
+
+// FindRevision returns the revision from history, or the latest revision if revision is 0
+func FindRevision(history []*LocalChart, revision int32) (*LocalChart, error) {
+	if len(history) == 0 {
+		return nil, errors.New("release has no revisions")
+	}
+
+	if revision == 0 {
+		return history[len(history)-1], nil
+	}
+
+	for _, localChart := range history {
+		if localChart.Revision == revision {
+			return localChart, nil
+		}
+	}
+
+	return nil, errors.Errorf("revision %d was not found, the release has %d revisions", revision, len(history))
+}
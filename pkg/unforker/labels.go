@@ -0,0 +1,335 @@
+package unforker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	kuberneteserrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// labelledKinds are the kinds that are searched for objects installed from a chart without
+// a release record. Charts rarely template other kinds, and listing every kind in the api is slow.
+// Each kind is listed at the version the cluster prefers, so kinds that moved out of beta are found
+var labelledKinds = []schema.GroupKind{
+	{Kind: "ConfigMap"},
+	{Kind: "Secret"},
+	{Kind: "Service"},
+	{Kind: "ServiceAccount"},
+	{Kind: "PersistentVolumeClaim"},
+	{Group: "apps", Kind: "Deployment"},
+	{Group: "apps", Kind: "StatefulSet"},
+	{Group: "apps", Kind: "DaemonSet"},
+	{Group: "batch", Kind: "Job"},
+	{Group: "batch", Kind: "CronJob"},
+	{Group: "networking.k8s.io", Kind: "Ingress"},
+	{Group: "policy", Kind: "PodDisruptionBudget"},
+	{Group: "autoscaling", Kind: "HorizontalPodAutoscaler"},
+	{Group: "rbac.authorization.k8s.io", Kind: "Role"},
+	{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"},
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"},
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"},
+}
+
+// labelDiscoveryInterval is how often the labelled objects are listed again. Charts installed
+// without helm change rarely, and listing every labelled kind is many requests
+const labelDiscoveryInterval = 2 * time.Minute
+
+// chartLabelSelectors find objects rendered by charts that follow the current helm
+// labelling conventions, and by older charts that use chart, release and heritage
+var chartLabelSelectors = []string{
+	"helm.sh/chart",
+	"chart,release,heritage in (Helm,Tiller)",
+}
+
+const lastAppliedConfigurationAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+var chartLabelVersion = regexp.MustCompile(`^v?[0-9]`)
+
+// labelledObject is a live object with the chart and release that it was rendered from
+type labelledObject struct {
+	Release    string
+	Chart      string
+	AppVersion string
+	Object     unstructured.Unstructured
+}
+
+// queryLabelsForCharts creates charts from the live objects that have helm's chart labels,
+// but don't belong to any of the releases in knownCharts. These were usually installed
+// with helm template and kubectl apply
+func (u *Unforker) queryLabelsForCharts(knownCharts []*LocalChart) ([]*LocalChart, error) {
+	if u.labelledObjects == nil || time.Since(u.labelledAt) > labelDiscoveryInterval {
+		labelledObjects, err := u.listLabelledObjects()
+		if err != nil {
+			return nil, err
+		}
+		u.labelledObjects = labelledObjects
+		u.labelledAt = time.Now()
+	}
+
+	return labelledObjectsToLocalCharts(unmanagedObjects(u.labelledObjects, knownCharts))
+}
+
+// listLabelledObjects lists the objects of each of the labelledKinds that the cluster serves with
+// helm's chart labels
+func (u *Unforker) listLabelledObjects() ([]labelledObject, error) {
+	labelledObjects := []labelledObject{}
+	seen := map[string]bool{}
+
+	for _, gk := range labelledKinds {
+		mapping, err := u.restMapper.RESTMapping(gk)
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to find the version of %s", gk.String())
+		}
+
+		for _, selector := range chartLabelSelectors {
+			list, err := u.dynamicClient.Resource(mapping.Resource).Namespace("").List(metav1.ListOptions{LabelSelector: selector})
+			if kuberneteserrors.IsNotFound(err) || kuberneteserrors.IsForbidden(err) {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "failed to list %s", mapping.Resource.Resource)
+			}
+
+			for _, obj := range list.Items {
+				if seen[string(obj.GetUID())] {
+					continue
+				}
+				seen[string(obj.GetUID())] = true
+
+				if labelled, ok := chartLabels(obj); ok {
+					labelledObjects = append(labelledObjects, labelled)
+				}
+			}
+		}
+	}
+
+	return labelledObjects, nil
+}
+
+// unmanagedObjects returns the objects that don't belong to a release in knownCharts. Releases are
+// matched by namespace and name, and cluster scoped objects by name in any namespace
+func unmanagedObjects(labelledObjects []labelledObject, knownCharts []*LocalChart) []labelledObject {
+	knownReleases := map[string]bool{}
+	knownNames := map[string]bool{}
+	for _, knownChart := range knownCharts {
+		knownReleases[knownChart.Namespace+"/"+knownChart.HelmName] = true
+		knownNames[knownChart.HelmName] = true
+	}
+
+	unmanaged := []labelledObject{}
+	for _, labelled := range labelledObjects {
+		namespace := labelled.Object.GetNamespace()
+		if namespace == "" && knownNames[labelled.Release] {
+			continue
+		}
+		if !knownReleases[namespace+"/"+labelled.Release] {
+			unmanaged = append(unmanaged, labelled)
+		}
+	}
+
+	return unmanaged
+}
+
+// chartLabels reads the chart and release from an object's labels. Objects that are owned
+// by another object were created by a controller, not by the chart, and are skipped
+func chartLabels(obj unstructured.Unstructured) (labelledObject, bool) {
+	if len(obj.GetOwnerReferences()) > 0 {
+		return labelledObject{}, false
+	}
+
+	labels := obj.GetLabels()
+
+	chart := labels["helm.sh/chart"]
+	if chart == "" {
+		chart = labels["chart"]
+	}
+	release := labels["app.kubernetes.io/instance"]
+	if release == "" {
+		release = labels["release"]
+	}
+	if chart == "" || release == "" {
+		return labelledObject{}, false
+	}
+
+	return labelledObject{
+		Release:    release,
+		Chart:      chart,
+		AppVersion: labels["app.kubernetes.io/version"],
+		Object:     obj,
+	}, true
+}
+
+// labelledObjectsToLocalCharts groups objects by the release and chart that rendered them. Each
+// subchart becomes a separate chart. Cluster scoped objects are added to the chart with the
+// same release and chart label, if there's only one
+func labelledObjectsToLocalCharts(labelledObjects []labelledObject) ([]*LocalChart, error) {
+	type group struct {
+		release    string
+		chart      string
+		namespace  string
+		appVersion string
+		objects    []unstructured.Unstructured
+	}
+
+	groups := map[string]*group{}
+	clusterScoped := []labelledObject{}
+	for _, labelled := range labelledObjects {
+		if labelled.Object.GetNamespace() == "" {
+			clusterScoped = append(clusterScoped, labelled)
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s/%s", labelled.Object.GetNamespace(), labelled.Release, labelled.Chart)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{
+				release:   labelled.Release,
+				chart:     labelled.Chart,
+				namespace: labelled.Object.GetNamespace(),
+			}
+			groups[key] = g
+		}
+		if g.appVersion == "" {
+			g.appVersion = labelled.AppVersion
+		}
+		g.objects = append(g.objects, labelled.Object)
+	}
+
+	for _, labelled := range clusterScoped {
+		matching := []*group{}
+		for _, g := range groups {
+			if g.release == labelled.Release && g.chart == labelled.Chart {
+				matching = append(matching, g)
+			}
+		}
+
+		if len(matching) == 1 {
+			matching[0].objects = append(matching[0].objects, labelled.Object)
+			continue
+		}
+
+		key := fmt.Sprintf("/%s/%s", labelled.Release, labelled.Chart)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{
+				release: labelled.Release,
+				chart:   labelled.Chart,
+			}
+			groups[key] = g
+		}
+		g.objects = append(g.objects, labelled.Object)
+	}
+
+	keys := []string{}
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	localCharts := []*LocalChart{}
+	for _, key := range keys {
+		g := groups[key]
+
+		chartName, chartVersion, ok := parseChartLabel(g.chart)
+		if !ok {
+			continue
+		}
+
+		manifest, err := labelledManifest(chartName, g.objects)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create manifest for %s", g.release)
+		}
+
+		localCharts = append(localCharts, &LocalChart{
+			HelmName:     g.release,
+			ChartName:    chartName,
+			ChartVersion: chartVersion,
+			AppVersion:   g.appVersion,
+			Manifest:     manifest,
+			Namespace:    g.namespace,
+			FromLabels:   true,
+		})
+	}
+
+	return localCharts, nil
+}
+
+// parseChartLabel splits a chart label, such as nginx-ingress-1.24.4, into the chart name and version
+func parseChartLabel(label string) (string, string, bool) {
+	parts := strings.Split(label, "-")
+	for i := 1; i < len(parts); i++ {
+		version := strings.Join(parts[i:], "-")
+		if !chartLabelVersion.MatchString(version) {
+			continue
+		}
+		if _, err := semver.NewVersion(version); err != nil {
+			continue
+		}
+
+		return strings.Join(parts[:i], "-"), version, true
+	}
+
+	return "", "", false
+}
+
+// labelledManifest creates a manifest like the one helm stores for a release. Each object is
+// the configuration that was last applied with kubectl, or the live object without the fields
+// the api server sets when it wasn't applied with kubectl
+func labelledManifest(chartName string, objects []unstructured.Unstructured) (string, error) {
+	docs := []string{}
+	for _, obj := range objects {
+		content := obj.GetAnnotations()[lastAppliedConfigurationAnnotation]
+		if content == "" {
+			b, err := yaml.Marshal(stripServerFields(obj.Object))
+			if err != nil {
+				return "", errors.Wrap(err, "failed to marshal object")
+			}
+			content = string(b)
+		} else {
+			b, err := yaml.JSONToYAML([]byte(content))
+			if err != nil {
+				return "", errors.Wrap(err, "failed to convert last applied configuration")
+			}
+			content = string(b)
+		}
+
+		source := fmt.Sprintf("# Source: %s/templates/%s-%s.yaml", chartName, strings.ToLower(obj.GetKind()), obj.GetName())
+		docs = append(docs, source+"\n"+content)
+	}
+	sort.Strings(docs)
+
+	return strings.Join(docs, "---\n"), nil
+}
+
+// stripServerFields returns a copy of a live object without status and server populated metadata
+func stripServerFields(obj map[string]interface{}) map[string]interface{} {
+	stripped := (&unstructured.Unstructured{Object: obj}).DeepCopy()
+
+	unstructured.RemoveNestedField(stripped.Object, "status")
+	for _, field := range serverPopulatedMetadata {
+		unstructured.RemoveNestedField(stripped.Object, "metadata", field)
+	}
+
+	annotations := stripped.GetAnnotations()
+	for _, ignored := range ignoredDriftAnnotations {
+		delete(annotations, ignored)
+	}
+	if len(annotations) > 0 {
+		stripped.SetAnnotations(annotations)
+	} else {
+		unstructured.RemoveNestedField(stripped.Object, "metadata", "annotations")
+	}
+
+	return stripped.Object
+}
@@ -0,0 +1,98 @@
+package unforker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_parseChartLabel(t *testing.T) {
+	tests := []struct {
+		label           string
+		expectedName    string
+		expectedVersion string
+		expectedOK      bool
+	}{
+		{label: "redis-10.5.7", expectedName: "redis", expectedVersion: "10.5.7", expectedOK: true},
+		{label: "nginx-ingress-1.24.4", expectedName: "nginx-ingress", expectedVersion: "1.24.4", expectedOK: true},
+		{label: "cert-manager-v0.11.0", expectedName: "cert-manager", expectedVersion: "v0.11.0", expectedOK: true},
+		{label: "app-1.0.0-rc.1", expectedName: "app", expectedVersion: "1.0.0-rc.1", expectedOK: true},
+		{label: "redis", expectedOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			name, version, ok := parseChartLabel(test.label)
+			assert.Equal(t, test.expectedOK, ok)
+			assert.Equal(t, test.expectedName, name)
+			assert.Equal(t, test.expectedVersion, version)
+		})
+	}
+}
+
+func Test_labelledObjectsToLocalCharts(t *testing.T) {
+	object := func(kind string, name string, namespace string, labels map[string]string, annotations map[string]string) unstructured.Unstructured {
+		obj := unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion("v1")
+		obj.SetKind(kind)
+		obj.SetName(name)
+		obj.SetNamespace(namespace)
+		obj.SetLabels(labels)
+		obj.SetUID("1234")
+		if annotations != nil {
+			obj.SetAnnotations(annotations)
+		}
+		return obj
+	}
+
+	labels := map[string]string{
+		"helm.sh/chart":                "redis-10.5.7",
+		"app.kubernetes.io/instance":   "cache",
+		"app.kubernetes.io/version":    "5.0.7",
+		"app.kubernetes.io/managed-by": "Helm",
+	}
+
+	objects := []labelledObject{}
+	for _, obj := range []unstructured.Unstructured{
+		object("Service", "cache-redis", "data", labels, map[string]string{
+			lastAppliedConfigurationAnnotation: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"cache-redis"}}`,
+		}),
+		object("ClusterRole", "cache-redis", "", labels, nil),
+		object("Pod", "cache-redis-0", "data", labels, nil),
+	} {
+		if obj.GetKind() == "Pod" {
+			obj.SetOwnerReferences([]metav1.OwnerReference{{Name: "cache-redis"}})
+		}
+		labelled, ok := chartLabels(obj)
+		if ok {
+			objects = append(objects, labelled)
+		}
+	}
+	require.Len(t, objects, 2)
+
+	// a helm release with the same name in another namespace only hides the cluster scoped objects
+	unmanaged := unmanagedObjects(objects, []*LocalChart{{HelmName: "cache", Namespace: "web"}})
+	require.Len(t, unmanaged, 1)
+	assert.Equal(t, "Service", unmanaged[0].Object.GetKind())
+	assert.Empty(t, unmanagedObjects(objects, []*LocalChart{{HelmName: "cache", Namespace: "data"}}))
+
+	localCharts, err := labelledObjectsToLocalCharts(objects)
+	require.NoError(t, err)
+	require.Len(t, localCharts, 1)
+
+	localChart := localCharts[0]
+	assert.Equal(t, "cache", localChart.HelmName)
+	assert.Equal(t, "data", localChart.Namespace)
+	assert.Equal(t, "redis", localChart.ChartName)
+	assert.Equal(t, "10.5.7", localChart.ChartVersion)
+	assert.Equal(t, "5.0.7", localChart.AppVersion)
+	assert.True(t, localChart.FromLabels)
+
+	files := splitManifest(localChart.Manifest)
+	assert.Equal(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: cache-redis\n", files["service-cache-redis-0.yaml"][len("# Source: redis/templates/service-cache-redis.yaml\n"):])
+	assert.Contains(t, files, "clusterrole-cache-redis-0.yaml")
+	assert.NotContains(t, files["clusterrole-cache-redis-0.yaml"], "uid")
+}
@@ -0,0 +1,50 @@
+package unforker
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// LoadLocalChart reads a chart directory or packaged .tgz from disk, without a cluster.
+// valuesFile is optional and holds the values that the chart is deployed with
+func LoadLocalChart(chartPath string, valuesFile string, helmName string, namespace string) (*LocalChart, error) {
+	c, err := chartutil.Load(chartPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load chart")
+	}
+
+	config := &chart.Config{Raw: ""}
+	if valuesFile != "" {
+		b, err := ioutil.ReadFile(valuesFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read values file")
+		}
+		if _, err := chartutil.ReadValues(b); err != nil {
+			return nil, errors.Wrap(err, "failed to parse values file")
+		}
+		config.Raw = string(b)
+	}
+
+	if helmName == "" {
+		helmName = c.GetMetadata().GetName()
+	}
+
+	localChart := LocalChart{
+		IsTiller:     false,
+		HelmName:     helmName,
+		ChartName:    c.GetMetadata().GetName(),
+		ChartVersion: c.GetMetadata().GetVersion(),
+		AppVersion:   c.GetMetadata().GetAppVersion(),
+		Keywords:     c.GetMetadata().GetKeywords(),
+		Templates:    c.GetTemplates(),
+		Values:       c.GetValues().GetValues(),
+		Chart:        c,
+		Config:       config,
+		Namespace:    namespace,
+	}
+
+	return &localChart, nil
+}
@@ -0,0 +1,80 @@
+package unforker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	manifestSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+	manifestSource    = regexp.MustCompile(`(?m)^# Source: (.+)$`)
+)
+
+// splitManifest splits the manifest that helm stored for a release into a file for each document,
+// named for the template that rendered it and the document's index in that template, the same as
+// renderChart names its output
+func splitManifest(manifest string) map[string]string {
+	sources := map[string][]string{}
+
+	for i, doc := range manifestSeparator.Split(manifest, -1) {
+		if isEmptyDocument(doc) {
+			continue
+		}
+
+		source := fmt.Sprintf("manifest-%d.yaml", i)
+		if match := manifestSource.FindStringSubmatch(doc); match != nil {
+			source = strings.TrimSpace(match[1])
+		}
+
+		sources[source] = append(sources[source], strings.TrimSpace(doc)+"\n")
+	}
+
+	return removeCommonPrefix(documentFiles(sources))
+}
+
+// splitRenderedTemplates splits each rendered template into a file for each document, named the
+// same as splitManifest names the documents in a stored manifest
+func splitRenderedTemplates(rendered map[string]string) map[string]string {
+	sources := map[string][]string{}
+
+	for source, content := range rendered {
+		for _, doc := range manifestSeparator.Split(content, -1) {
+			if isEmptyDocument(doc) {
+				continue
+			}
+
+			sources[source] = append(sources[source], strings.TrimSpace(doc)+"\n")
+		}
+	}
+
+	return documentFiles(sources)
+}
+
+// documentFiles names each document <source>-<index>.yaml. Every document has an index, even the
+// only one in its source, so a document can't have the same name as one from another template
+func documentFiles(sources map[string][]string) map[string]string {
+	files := map[string]string{}
+
+	for source, docs := range sources {
+		ext := path.Ext(source)
+		for i, doc := range docs {
+			files[fmt.Sprintf("%s-%d%s", strings.TrimSuffix(source, ext), i, ext)] = doc
+		}
+	}
+
+	return files
+}
+
+// isEmptyDocument returns true if doc has nothing but comments, such as a template that rendered
+// nothing. Helm leaves these out of the manifest it stores
+func isEmptyDocument(doc string) bool {
+	for _, line := range strings.Split(doc, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
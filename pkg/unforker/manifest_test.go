@@ -0,0 +1,123 @@
+package unforker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitManifest(t *testing.T) {
+	manifest := `
+---
+# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis
+---
+# Source: redis/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-redis
+---
+# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-headless
+---
+# Source: redis/templates/svc-1.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-metrics
+`
+
+	expected := map[string]string{
+		"svc-0.yaml": `# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis
+`,
+		// each document from a template with more than one has its own file
+		"svc-1.yaml": `# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-headless
+`,
+		// which can't be confused with a template that has the same name
+		"svc-1-0.yaml": `# Source: redis/templates/svc-1.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-metrics
+`,
+		"deployment-0.yaml": `# Source: redis/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-redis
+`,
+	}
+
+	assert.Equal(t, expected, splitManifest(manifest))
+}
+
+func Test_splitRenderedTemplatesMatchesManifest(t *testing.T) {
+	rendered := map[string]string{
+		"redis/templates/svc.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-headless
+`,
+		"redis/templates/deployment.yaml": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-redis
+`,
+		// a template that's disabled by its values renders nothing
+		"redis/templates/metrics.yaml": "\n# metrics are disabled\n",
+	}
+
+	manifest := `---
+# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis
+---
+# Source: redis/templates/svc.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: my-redis-headless
+---
+# Source: redis/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-redis
+`
+
+	renderedFiles := removeCommonPrefix(splitRenderedTemplates(rendered))
+	manifestFiles := splitManifest(manifest)
+
+	filenames := func(files map[string]string) map[string]bool {
+		names := map[string]bool{}
+		for name := range files {
+			names[name] = true
+		}
+		return names
+	}
+	assert.Equal(t, filenames(manifestFiles), filenames(renderedFiles))
+	assert.Equal(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: my-redis-headless\n", renderedFiles["svc-1.yaml"])
+}
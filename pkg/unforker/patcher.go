@@ -1,6 +1,7 @@
 package unforker
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
@@ -106,6 +107,9 @@ func createPatches(forkedPath string, upstreamPath string) (map[string][]byte, m
 			// Helm templates. You know?
 			// return nil, errors.Wrap(err, "failed to create patch")
 		}
+		if patch == nil {
+			continue
+		}
 
 		include, err := containsNonGVK(patch)
 		if err != nil {
@@ -185,12 +189,17 @@ func createTwoWayMergePatch(original []byte, modified []byte) ([]byte, error) {
 		return nil, errors.Wrap(err, "failed to create two way merge patch")
 	}
 
-	// modifiedPatchJSON, err := p.writeHeaderToPatch(originalJSON, patchBytes)
-	// if err != nil {
-	// 	return nil, errors.Wrap(err, "write original header to patch")
-	// }
+	// an empty patch means there's nothing to change
+	if string(patchBytes) == "{}" {
+		return nil, nil
+	}
 
-	patch, err := yaml.JSONToYAML(patchBytes)
+	modifiedPatchJSON, err := writeHeaderToPatch(originalJSON, patchBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "write original header to patch")
+	}
+
+	patch, err := yaml.JSONToYAML(modifiedPatchJSON)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to convert patch to yaml")
 	}
@@ -198,6 +207,40 @@ func createTwoWayMergePatch(original []byte, modified []byte) ([]byte, error) {
 	return patch, nil
 }
 
+// writeHeaderToPatch copies the apiVersion, kind, name and namespace from the original
+// into the patch, so kustomize knows which resource to apply it to
+func writeHeaderToPatch(originalJSON []byte, patchJSON []byte) ([]byte, error) {
+	original := map[string]interface{}{}
+	if err := json.Unmarshal(originalJSON, &original); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal original")
+	}
+
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(patchJSON, &patch); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal patch")
+	}
+
+	patch["apiVersion"] = original["apiVersion"]
+	patch["kind"] = original["kind"]
+
+	originalMetadata, ok := original["metadata"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("original does not have metadata")
+	}
+
+	patchMetadata, ok := patch["metadata"].(map[string]interface{})
+	if !ok {
+		patchMetadata = map[string]interface{}{}
+	}
+	patchMetadata["name"] = originalMetadata["name"]
+	if namespace, ok := originalMetadata["namespace"]; ok {
+		patchMetadata["namespace"] = namespace
+	}
+	patch["metadata"] = patchMetadata
+
+	return json.Marshal(patch)
+}
+
 func containsNonGVK(data []byte) (bool, error) {
 	gvk := []string{
 		"apiVersion",
@@ -216,9 +259,9 @@ func containsNonGVK(data []byte) (bool, error) {
 		keys = append(keys, k)
 	}
 
-	for key := range keys {
+	for _, key := range keys {
 		isGvk := false
-		for gvkKey := range gvk {
+		for _, gvkKey := range gvk {
 			if key == gvkKey {
 				isGvk = true
 			}
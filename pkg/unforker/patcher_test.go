@@ -75,3 +75,73 @@ metadata:
 		})
 	}
 }
+
+func Test_createTwoWayMergePatch(t *testing.T) {
+	tests := []struct {
+		name            string
+		original        []byte
+		modified        []byte
+		expected        string
+		expectNonGVK    bool
+		expectNoChanges bool
+	}{
+		{
+			name:     "changed replicas",
+			original: upstreamFilesFixture["deployment.yaml"],
+			modified: []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx-deployment
+spec:
+  replicas: 5
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+        - name: nginx
+          image: nginx:1.7.9
+          ports:
+           - containerPort: 80
+`),
+			expected: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: nginx-deployment
+spec:
+  replicas: 5
+`,
+			expectNonGVK: true,
+		},
+		{
+			name:            "unchanged",
+			original:        upstreamFilesFixture["deployment.yaml"],
+			modified:        upstreamFilesFixture["deployment.yaml"],
+			expectNoChanges: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			patch, err := createTwoWayMergePatch(test.original, test.modified)
+			req.NoError(err)
+
+			if test.expectNoChanges {
+				assert.Nil(t, patch)
+				return
+			}
+
+			assert.Equal(t, test.expected, string(patch))
+
+			nonGVK, err := containsNonGVK(patch)
+			req.NoError(err)
+			assert.Equal(t, test.expectNonGVK, nonGVK)
+		})
+	}
+}
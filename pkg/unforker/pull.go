@@ -0,0 +1,166 @@
+package unforker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/kots/pkg/base"
+	"github.com/replicatedhq/kots/pkg/downstream"
+	"github.com/replicatedhq/kots/pkg/midstream"
+	"github.com/replicatedhq/kots/pkg/upstream"
+	"k8s.io/helm/pkg/chartutil"
+)
+
+// writeChartArchive writes a chart archive to unforkPath with the same upstream, base and
+// unforked downstream that kots pull writes for a helm:// upstream. kots can only pull
+// anonymously, so charts are downloaded by unfork and written with this instead
+func writeChartArchive(unforkPath string, chartName string, chartVersion string, archive []byte) error {
+	files, err := readChartArchive(archive)
+	if err != nil {
+		return errors.Wrap(err, "failed to read chart archive")
+	}
+
+	u := &upstream.Upstream{
+		URI:          "helm://" + chartName + "@" + chartVersion,
+		Name:         chartName,
+		Type:         "helm",
+		Files:        files,
+		UpdateCursor: chartVersion,
+	}
+
+	writeUpstreamOptions := upstream.WriteOptions{
+		RootDir:      unforkPath,
+		CreateAppDir: false,
+	}
+	if err := u.WriteUpstream(writeUpstreamOptions); err != nil {
+		return errors.Wrap(err, "failed to write upstream")
+	}
+
+	b, err := base.RenderUpstream(u, &base.RenderOptions{
+		SplitMultiDocYAML: true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to render upstream")
+	}
+
+	writeBaseOptions := base.WriteOptions{
+		BaseDir:          u.GetBaseDir(writeUpstreamOptions),
+		Overwrite:        true,
+		ExcludeKotsKinds: true,
+	}
+	if err := b.WriteBase(writeBaseOptions); err != nil {
+		return errors.Wrap(err, "failed to write base")
+	}
+
+	m, err := midstream.CreateMidstream(b)
+	if err != nil {
+		return errors.Wrap(err, "failed to create midstream")
+	}
+
+	writeMidstreamOptions := midstream.WriteOptions{
+		MidstreamDir: path.Join(b.GetOverlaysDir(writeBaseOptions), "midstream"),
+		BaseDir:      u.GetBaseDir(writeUpstreamOptions),
+	}
+	if err := m.WriteMidstream(writeMidstreamOptions); err != nil {
+		return errors.Wrap(err, "failed to write midstream")
+	}
+
+	d, err := downstream.CreateDownstream(m, "unforked")
+	if err != nil {
+		return errors.Wrap(err, "failed to create downstream")
+	}
+
+	writeDownstreamOptions := downstream.WriteOptions{
+		DownstreamDir: path.Join(b.GetOverlaysDir(writeBaseOptions), "downstreams", "unforked"),
+		MidstreamDir:  writeMidstreamOptions.MidstreamDir,
+	}
+	if err := d.WriteDownstream(writeDownstreamOptions); err != nil {
+		return errors.Wrap(err, "failed to write downstream")
+	}
+
+	return nil
+}
+
+// readChartPath returns the archive of a chart directory or .tgz on disk
+func readChartPath(chartPath string) ([]byte, error) {
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat chart")
+	}
+	if !info.IsDir() {
+		return ioutil.ReadFile(chartPath)
+	}
+
+	c, err := chartutil.Load(chartPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load chart")
+	}
+
+	archiveDir, err := ioutil.TempDir("", "unfork-chart")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(archiveDir)
+
+	archivePath, err := chartutil.Save(c, archiveDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to package chart")
+	}
+
+	return ioutil.ReadFile(archivePath)
+}
+
+// readChartArchive returns the files in a chart archive, without the chart's directory
+func readChartArchive(archive []byte) ([]upstream.UpstreamFile, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gzip reader")
+	}
+	defer gzipReader.Close()
+
+	files := map[string]string{}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to advance in tar archive")
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read file from tar archive")
+		}
+		files[header.Name] = string(content)
+	}
+
+	filenames := []string{}
+	upstreamFiles := []upstream.UpstreamFile{}
+	files = removeCommonPrefix(files)
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		upstreamFiles = append(upstreamFiles, upstream.UpstreamFile{
+			Path:    filename,
+			Content: []byte(files[filename]),
+		})
+	}
+
+	return upstreamFiles, nil
+}
@@ -0,0 +1,66 @@
+package unforker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/replicatedhq/unfork/pkg/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readChartArchive(t *testing.T) {
+	archive := testutil.ChartArchive(t, map[string]string{
+		"my-chart/Chart.yaml": `apiVersion: v1
+name: my-chart
+version: 1.2.3
+`,
+		"my-chart/values.yaml": `replicas: 2
+`,
+		"my-chart/templates/configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-chart
+data:
+  replicas: "{{ .Values.replicas }}"
+`,
+	})
+
+	files, err := readChartArchive(archive)
+	require.NoError(t, err)
+	filenames := []string{}
+	for _, file := range files {
+		filenames = append(filenames, file.Path)
+	}
+	assert.Equal(t, []string{"Chart.yaml", "templates/configmap.yaml", "values.yaml"}, filenames)
+}
+
+func Test_readChartPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unfork-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	chartDir := filepath.Join(dir, "my-chart")
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: my-chart\nversion: 1.2.3\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "templates", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\n"), 0644))
+
+	archive, err := readChartPath(chartDir)
+	require.NoError(t, err)
+	files, err := readChartArchive(archive)
+	require.NoError(t, err)
+	filenames := []string{}
+	for _, file := range files {
+		filenames = append(filenames, file.Path)
+	}
+	assert.Equal(t, []string{"Chart.yaml", "templates/configmap.yaml"}, filenames)
+
+	// a packaged chart is used as is
+	archivePath := filepath.Join(dir, "my-chart-1.2.3.tgz")
+	require.NoError(t, ioutil.WriteFile(archivePath, archive, 0644))
+	packaged, err := readChartPath(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, archive, packaged)
+}
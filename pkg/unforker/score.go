@@ -0,0 +1,178 @@
+package unforker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+)
+
+// UpstreamScore is how much of a fork would be left as patches and unmatched resources
+// if it was unforked from an upstream. The upstream with the lowest score is the best
+type UpstreamScore struct {
+	Match chartindex.ChartMatch
+
+	Patches    int // resources in both that need a patch
+	PatchLines int
+	// Unmatched are resources that are only in the fork, which are added by the overlay,
+	// or only in the upstream, which the fork removed
+	Unmatched      int
+	UnmatchedLines int
+
+	Err error // the upstream couldn't be pulled or compared, and is ranked last
+}
+
+// Score is the number of lines in the patches and unmatched resources
+func (s UpstreamScore) Score() int {
+	return s.PatchLines + s.UnmatchedLines
+}
+
+// String describes the score, for showing next to the upstream
+func (s UpstreamScore) String() string {
+	if s.Err != nil {
+		return "failed"
+	}
+	return fmt.Sprintf("%d lines, %d unmatched", s.Score(), s.Unmatched)
+}
+
+// ScoreUpstreams unforks localChart from each of upstreamMatches in a temp dir, and returns
+// their scores, best first. It stops before the next upstream when ctx is cancelled
+func ScoreUpstreams(ctx context.Context, localChart *LocalChart, upstreamMatches []chartindex.ChartMatch, unforkOptions UnforkOptions) ([]UpstreamScore, error) {
+	workDir, err := ioutil.TempDir("", "unfork-score")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create work dir")
+	}
+	defer os.RemoveAll(workDir)
+
+	scores := []UpstreamScore{}
+	for i, upstreamMatch := range upstreamMatches {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		unforkPath := path.Join(workDir, fmt.Sprintf("%d", i), localChart.HelmName)
+		score, err := scoreUpstream(unforkPath, localChart, upstreamMatch, unforkOptions)
+		if err != nil {
+			score = UpstreamScore{Err: err}
+		}
+		score.Match = upstreamMatch
+		scores = append(scores, score)
+	}
+
+	sortScores(scores)
+	return scores, nil
+}
+
+func scoreUpstream(unforkPath string, localChart *LocalChart, upstreamMatch chartindex.ChartMatch, unforkOptions UnforkOptions) (UpstreamScore, error) {
+	localChart, _, err := pullUpstream(unforkPath, localChart, upstreamMatch, unforkOptions.RepoConfigs)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to pull upstream")
+	}
+
+	forkedManifests, err := forkedChartManifests(localChart, unforkOptions)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to get forked manifests")
+	}
+
+	forkedRoot, err := writeForkedManifests(forkedManifests)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to write forked manifests")
+	}
+	defer os.RemoveAll(forkedRoot)
+
+	return diffScore(forkedRoot, path.Join(unforkPath, "base"))
+}
+
+// diffScore scores the patches that createPatches makes to turn the upstream in basePath into the fork in forkedPath
+func diffScore(forkedPath string, basePath string) (UpstreamScore, error) {
+	resources, patches, err := createPatches(forkedPath, basePath)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to create patches")
+	}
+
+	score := UpstreamScore{}
+	for _, patch := range patches {
+		score.Patches++
+		score.PatchLines += countLines(patch)
+	}
+	for _, resource := range resources {
+		score.Unmatched++
+		score.UnmatchedLines += countLines(resource)
+	}
+
+	forkedObjects, err := readObjects(forkedPath)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to read forked objects")
+	}
+	upstreamObjects, err := readObjects(basePath)
+	if err != nil {
+		return UpstreamScore{}, errors.Wrap(err, "failed to read upstream objects")
+	}
+	for key, content := range upstreamObjects {
+		if _, ok := forkedObjects[key]; !ok {
+			score.Unmatched++
+			score.UnmatchedLines += countLines(content)
+		}
+	}
+
+	return score, nil
+}
+
+// readObjects reads the kubernetes objects in the files under root, keyed by kind/name
+func readObjects(root string) (map[string][]byte, error) {
+	objects := map[string][]byte{}
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return errors.Wrap(err, "failed to read file")
+		}
+		if key := objectKey(content); key != "" {
+			objects[key] = content
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func countLines(content []byte) int {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return 0
+	}
+	return bytes.Count(content, []byte("\n")) + 1
+}
+
+// sortScores puts the lowest scores first, with fewer unmatched resources breaking ties.
+// Upstreams that couldn't be scored are last, in the order they were found
+func sortScores(scores []UpstreamScore) {
+	sort.SliceStable(scores, func(i, j int) bool {
+		if (scores[i].Err == nil) != (scores[j].Err == nil) {
+			return scores[i].Err == nil
+		}
+		if scores[i].Err != nil {
+			return false
+		}
+		if scores[i].Score() != scores[j].Score() {
+			return scores[i].Score() < scores[j].Score()
+		}
+		return scores[i].Unmatched < scores[j].Unmatched
+	})
+}
@@ -0,0 +1,128 @@
+package unforker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_diffScore(t *testing.T) {
+	forked := map[string]string{
+		"deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+`,
+		"configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: extra
+data:
+  key: value
+`,
+		"service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  type: ClusterIP
+`,
+	}
+
+	tests := []struct {
+		name     string
+		upstream map[string]string
+		expected UpstreamScore
+	}{
+		{
+			name: "the same as the fork",
+			upstream: map[string]string{
+				"deployment.yaml": forked["deployment.yaml"],
+				"configmap.yaml":  forked["configmap.yaml"],
+				"service.yaml":    forked["service.yaml"],
+			},
+			expected: UpstreamScore{},
+		},
+		{
+			name: "a patch, a resource only in the fork and a resource only in the upstream",
+			upstream: map[string]string{
+				"deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+`,
+				"service.yaml": forked["service.yaml"],
+				"secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: web
+`,
+				"kustomization.yaml": `kind: Kustomization
+resources:
+- deployment.yaml
+`,
+			},
+			expected: UpstreamScore{
+				Patches:        1,
+				PatchLines:     6,
+				Unmatched:      2,
+				UnmatchedLines: 10,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := require.New(t)
+
+			forkedPath := writeTestFiles(t, forked)
+			defer os.RemoveAll(forkedPath)
+			basePath := writeTestFiles(t, test.upstream)
+			defer os.RemoveAll(basePath)
+
+			actual, err := diffScore(forkedPath, basePath)
+			req.NoError(err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_sortScores(t *testing.T) {
+	scores := []UpstreamScore{
+		{Match: chartindex.ChartMatch{Repo: "failed"}, Err: errors.New("failed to pull upstream")},
+		{Match: chartindex.ChartMatch{Repo: "mirror"}, PatchLines: 10, Unmatched: 1, UnmatchedLines: 5},
+		{Match: chartindex.ChartMatch{Repo: "stable"}, PatchLines: 3},
+		// the same score, with fewer unmatched resources
+		{Match: chartindex.ChartMatch{Repo: "bitnami"}, PatchLines: 15},
+	}
+
+	sortScores(scores)
+
+	repos := []string{}
+	for _, score := range scores {
+		repos = append(repos, score.Match.Repo)
+	}
+	assert.Equal(t, []string{"stable", "bitnami", "mirror", "failed"}, repos)
+	assert.Equal(t, "3 lines, 0 unmatched", scores[0].String())
+	assert.Equal(t, "failed", scores[3].String())
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "unfork-test")
+	require.NoError(t, err)
+
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
@@ -1,82 +1,243 @@
 package unforker
 
 import (
-	"fmt"
-	"math/rand"
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/replicatedhq/unfork/pkg/k8sutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/helm/pkg/helm"
 	"k8s.io/helm/pkg/proto/hapi/release"
+	storageerrors "k8s.io/helm/pkg/storage/errors"
+	"k8s.io/helm/pkg/tlsutil"
 )
 
-func getTillerPodName(client *kubernetes.Clientset) (string, string, error) {
-	selector := labels.Set{"app": "helm", "name": "tiller"}
-	pods, err := client.CoreV1().Pods("kube-system").List(metav1.ListOptions{LabelSelector: selector.AsSelector().String()})
-	if err != nil {
-		return "", "", err
-	}
+const (
+	DefaultTillerNamespace = "kube-system"
+	DefaultTillerSelector  = "app=helm,name=tiller"
+
+	tillerPort    = 44134
+	tunnelTimeout = 30 * time.Second
+)
 
-	if len(pods.Items) < 1 {
-		return "", "", nil
+type tillerPod struct {
+	Name      string
+	Namespace string
+}
+
+// getTillerPods returns the ready tiller pods matching the selector, in one or all namespaces
+func getTillerPods(client *kubernetes.Clientset, tillerOptions TillerOptions) ([]tillerPod, error) {
+	pods, err := client.CoreV1().Pods(tillerOptions.namespace()).List(metav1.ListOptions{LabelSelector: tillerOptions.selector()})
+	if err != nil {
+		return nil, err
 	}
 
+	tillerPods := []tillerPod{}
 	for _, pod := range pods.Items {
 		for _, condition := range pod.Status.Conditions {
-			if condition.Type == corev1.PodReady {
-				return pod.Name, pod.Namespace, nil
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				tillerPods = append(tillerPods, tillerPod{
+					Name:      pod.Name,
+					Namespace: pod.Namespace,
+				})
+				break
 			}
 		}
 	}
 
-	return "", "", nil
+	return tillerPods, nil
+}
+
+// tillerListStatuses are the release statuses that discovery lists. Failed and pending
+// upgrades are included because their resources may still be running in the cluster
+var tillerListStatuses = []release.Status_Code{
+	release.Status_DEPLOYED,
+	release.Status_FAILED,
+	release.Status_PENDING_UPGRADE,
+}
+
+// maxReleaseHistory is the most revisions read for a single release
+const maxReleaseHistory = 256
+
+func (u *Unforker) queryTillerPodForCharts(pod tillerPod) ([]*LocalChart, error) {
+	var tillerCharts []*LocalChart
+	err := u.withTillerPod(pod, func(tillerHost string) error {
+		charts, err := u.queryTillerForCharts(tillerHost)
+		if err != nil {
+			return err
+		}
+		tillerCharts = charts
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tillerCharts, nil
 }
 
-func (u *Unforker) queryTillerForCharts(tillerPodName string, tillerNamespace string) ([]*LocalChart, error) {
-	// Pick a random port for local forward. this will explode sometimes
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	localPort := 30000 + r.Intn(999)
+func (u *Unforker) queryTillerPodForHistory(pod tillerPod, helmName string) ([]*LocalChart, error) {
+	var history []*LocalChart
+	err := u.withTillerPod(pod, func(tillerHost string) error {
+		revisions, err := u.queryTillerForHistory(tillerHost, helmName)
+		if err != nil {
+			return err
+		}
+		history = revisions
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
 
+// withTillerPod port-forwards to pod and runs query with the forwarded address. The
+// tunnel can drop if tiller or the api server restarts, so a query that couldn't reach
+// tiller is retried once on a fresh one
+func (u *Unforker) withTillerPod(pod tillerPod, query func(tillerHost string) error) error {
 	config, err := u.configFlags.ToRESTConfig()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to convert kube flags to rest config")
+		return errors.Wrap(err, "failed to convert kube flags to rest config")
+	}
+
+	tunnel := k8sutil.NewTunnel(config, pod.Namespace, pod.Name, tillerPort)
+	if err := tunnel.ForwardPort(tunnelTimeout); err != nil {
+		return errors.Wrap(err, "failed to port forward")
+	}
+	defer tunnel.Close()
+
+	err = query(tunnel.Address())
+	if err == nil || !isTillerConnectionError(err) {
+		return err
+	}
+
+	// the query's error says more about what went wrong than a failed reconnect would
+	if reconnectErr := tunnel.Reconnect(tunnelTimeout); reconnectErr != nil {
+		return err
+	}
+
+	return query(tunnel.Address())
+}
+
+// isTillerConnectionError returns true if err is from failing to reach tiller, rather than an error
+// that tiller returned, such as a tls or auth error or a release that doesn't exist
+func isTillerConnectionError(err error) bool {
+	err = errors.Cause(err)
+
+	// the helm client blocks until it connects, or the connect timeout expires
+	if err == context.DeadlineExceeded {
+		return true
+	}
+
+	return status.Code(err) == codes.Unavailable
+}
+
+// isReleaseNotFound returns true if tiller couldn't find the release in its storage. Tiller
+// returns storage errors with an unknown code, so the message is compared
+func isReleaseNotFound(err error, helmName string) bool {
+	s := status.Convert(errors.Cause(err))
+	if s.Code() == codes.NotFound {
+		return true
+	}
+
+	return s.Message() == storageerrors.ErrReleaseNotFound(helmName).Error()
+}
+
+func (u *Unforker) tillerClient(tillerHost string) (*helm.Client, error) {
+	helmOptions := []helm.Option{helm.Host(tillerHost), helm.ConnectTimeout(5)}
+
+	if u.tillerOptions.TLSEnable || u.tillerOptions.TLSVerify {
+		tlsOptions := tlsutil.Options{
+			ServerName:         u.tillerOptions.TLSHostname,
+			CertFile:           u.tillerOptions.TLSCert,
+			KeyFile:            u.tillerOptions.TLSKey,
+			InsecureSkipVerify: true,
+		}
+		if u.tillerOptions.TLSVerify {
+			tlsOptions.CaCertFile = u.tillerOptions.TLSCACert
+			tlsOptions.InsecureSkipVerify = false
+		}
+
+		if tlsOptions.CertFile == "" || tlsOptions.KeyFile == "" {
+			return nil, errors.New("a tls cert and key are required to connect to tiller with tls")
+		}
+
+		tlsConfig, err := tlsutil.ClientConfig(tlsOptions)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create tls config")
+		}
+		helmOptions = append(helmOptions, helm.WithTLS(tlsConfig))
 	}
 
-	_, err = k8sutil.PortForward(config, localPort, 44134, tillerNamespace, tillerPodName)
+	return helm.NewClient(helmOptions...), nil
+}
+
+func (u *Unforker) queryTillerForCharts(tillerHost string) ([]*LocalChart, error) {
+	helmClient, err := u.tillerClient(tillerHost)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to port forward")
+		return nil, errors.Wrap(err, "failed to create tiller client")
 	}
 
-	helmOptions := []helm.Option{helm.Host(fmt.Sprintf("localhost:%d", localPort)), helm.ConnectTimeout(5)}
-	helmClient := helm.NewClient(helmOptions...)
-	listReleaseOptions := helm.ReleaseListStatuses([]release.Status_Code{release.Status_DEPLOYED})
+	listReleaseOptions := helm.ReleaseListStatuses(tillerListStatuses)
 	response, err := helmClient.ListReleases(listReleaseOptions)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to list releases")
 	}
 
 	tillerCharts := make([]*LocalChart, 0)
-	for _, tillerRelease := range response.Releases {
-		chart := LocalChart{
-			IsTiller:     true,
-			HelmName:     tillerRelease.Name,
-			ChartName:    tillerRelease.GetChart().GetMetadata().Name,
-			ChartVersion: tillerRelease.GetChart().GetMetadata().Version,
-			AppVersion:   tillerRelease.GetChart().GetMetadata().GetAppVersion(),
-			Keywords:     tillerRelease.GetChart().GetMetadata().GetKeywords(),
-			Templates:    tillerRelease.GetChart().GetTemplates(),
-			Values:       tillerRelease.GetChart().GetValues().GetValues(),
-			Chart:        tillerRelease.GetChart(),
-			Namespace:    "todo",
+	for _, tillerRelease := range response.GetReleases() {
+		tillerCharts = append(tillerCharts, tillerReleaseToLocalChart(tillerRelease))
+	}
+
+	return latestRevisions(tillerCharts), nil
+}
+
+func (u *Unforker) queryTillerForHistory(tillerHost string, helmName string) ([]*LocalChart, error) {
+	helmClient, err := u.tillerClient(tillerHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create tiller client")
+	}
+
+	response, err := helmClient.ReleaseHistory(helmName, helm.WithMaxHistory(maxReleaseHistory))
+	if err != nil {
+		if isReleaseNotFound(err, helmName) {
+			return []*LocalChart{}, nil
 		}
+		return nil, errors.Wrap(err, "failed to get release history")
+	}
 
-		tillerCharts = append(tillerCharts, &chart)
+	history := make([]*LocalChart, 0)
+	for _, tillerRelease := range response.GetReleases() {
+		history = append(history, tillerReleaseToLocalChart(tillerRelease))
 	}
 
-	return tillerCharts, nil
+	return history, nil
+}
+
+func tillerReleaseToLocalChart(tillerRelease *release.Release) *LocalChart {
+	chart := LocalChart{
+		IsTiller:     true,
+		HelmName:     tillerRelease.Name,
+		ChartName:    tillerRelease.GetChart().GetMetadata().Name,
+		ChartVersion: tillerRelease.GetChart().GetMetadata().Version,
+		AppVersion:   tillerRelease.GetChart().GetMetadata().GetAppVersion(),
+		Keywords:     tillerRelease.GetChart().GetMetadata().GetKeywords(),
+		Templates:    tillerRelease.GetChart().GetTemplates(),
+		Values:       tillerRelease.GetChart().GetValues().GetValues(),
+		Chart:        tillerRelease.GetChart(),
+		Config:       tillerRelease.GetConfig(),
+		Manifest:     tillerRelease.GetManifest(),
+		Namespace:    tillerRelease.GetNamespace(),
+		Revision:     tillerRelease.GetVersion(),
+		Status:       normalizeStatus(tillerRelease.GetInfo().GetStatus().GetCode().String()),
+	}
+
+	return &chart
 }
@@ -0,0 +1,86 @@
+package unforker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_isTillerConnectionError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{
+			name:   "tunnel dropped",
+			err:    errors.Wrap(status.Error(codes.Unavailable, "transport is closing"), "failed to list releases"),
+			expect: true,
+		},
+		{
+			name:   "connect timed out",
+			err:    errors.Wrap(context.DeadlineExceeded, "failed to list releases"),
+			expect: true,
+		},
+		{
+			name:   "release not found",
+			err:    errors.Wrap(status.Error(codes.Unknown, `release: "my-redis" not found`), "failed to get release history"),
+			expect: false,
+		},
+		{
+			name:   "not authorized",
+			err:    errors.Wrap(status.Error(codes.PermissionDenied, "forbidden"), "failed to list releases"),
+			expect: false,
+		},
+		{
+			name:   "tls",
+			err:    errors.Wrap(errors.New("a tls cert and key are required to connect to tiller with tls"), "failed to create tiller client"),
+			expect: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, isTillerConnectionError(test.err))
+		})
+	}
+}
+
+func Test_isReleaseNotFound(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{
+			name:   "release not found",
+			err:    errors.Wrap(status.Error(codes.Unknown, `release: "my-redis" not found`), "failed to get release history"),
+			expect: true,
+		},
+		{
+			name:   "another release not found",
+			err:    status.Error(codes.Unknown, `release: "my-redis-2" not found`),
+			expect: false,
+		},
+		{
+			name:   "configmap not found",
+			err:    status.Error(codes.Unknown, `configmaps "my-redis.v1" is forbidden: not found in cache`),
+			expect: false,
+		},
+		{
+			name:   "not found code",
+			err:    status.Error(codes.NotFound, "my-redis"),
+			expect: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expect, isReleaseNotFound(test.err, "my-redis"))
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package unforker
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const (
+	TillerStorageConfigMap = "configmap"
+	TillerStorageSecret    = "secret"
+)
+
+// tillerStorageSelector matches the releases that discovery lists from tiller's configmap and secret drivers
+func tillerStorageSelector() string {
+	return "OWNER=TILLER,STATUS in (DEPLOYED,FAILED,PENDING_UPGRADE)"
+}
+
+// tillerStorageHistorySelector matches every revision of a release in tiller's storage
+func tillerStorageHistorySelector(helmName string) string {
+	return labels.Set{"OWNER": "TILLER", "NAME": helmName}.AsSelector().String()
+}
+
+// listTillerStorage returns the encoded release records that tiller persisted in its namespace
+func listTillerStorage(client *kubernetes.Clientset, tillerNamespace string, storage string, selector string, limit int64) ([]string, error) {
+	listOptions := metav1.ListOptions{LabelSelector: selector, Limit: limit}
+
+	encodedReleases := []string{}
+
+	switch storage {
+	case TillerStorageConfigMap:
+		configMaps, err := client.CoreV1().ConfigMaps(tillerNamespace).List(listOptions)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list tiller configmaps")
+		}
+		for _, configMap := range configMaps.Items {
+			encodedReleases = append(encodedReleases, configMap.Data["release"])
+		}
+	case TillerStorageSecret:
+		secrets, err := client.CoreV1().Secrets(tillerNamespace).List(listOptions)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list tiller secrets")
+		}
+		for _, secret := range secrets.Items {
+			encodedReleases = append(encodedReleases, string(secret.Data["release"]))
+		}
+	default:
+		return nil, errors.Errorf("unknown tiller storage %q", storage)
+	}
+
+	return encodedReleases, nil
+}
+
+func hasTillerStorage(client *kubernetes.Clientset, tillerNamespace string, storage string) (bool, error) {
+	encodedReleases, err := listTillerStorage(client, tillerNamespace, storage, tillerStorageSelector(), 1)
+	if err != nil {
+		return false, err
+	}
+
+	return len(encodedReleases) > 0, nil
+}
+
+func (u *Unforker) queryTillerStorageForCharts(tillerNamespace string, storage string) ([]*LocalChart, error) {
+	tillerCharts, err := u.queryTillerStorage(tillerNamespace, storage, tillerStorageSelector())
+	if err != nil {
+		return nil, err
+	}
+
+	return latestRevisions(tillerCharts), nil
+}
+
+func (u *Unforker) queryTillerStorageForHistory(tillerNamespace string, storage string, helmName string) ([]*LocalChart, error) {
+	return u.queryTillerStorage(tillerNamespace, storage, tillerStorageHistorySelector(helmName))
+}
+
+func (u *Unforker) queryTillerStorage(tillerNamespace string, storage string, selector string) ([]*LocalChart, error) {
+	encodedReleases, err := listTillerStorage(u.client, tillerNamespace, storage, selector, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list tiller storage")
+	}
+
+	tillerCharts := make([]*LocalChart, 0)
+	for _, encodedRelease := range encodedReleases {
+		tillerRelease, err := decodeTillerRelease(encodedRelease)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode tiller release")
+		}
+
+		tillerCharts = append(tillerCharts, tillerReleaseToLocalChart(tillerRelease))
+	}
+
+	return tillerCharts, nil
+}
+
+// decodeTillerRelease decodes the base64 encoded, gzipped protobuf that tiller's
+// configmap and secret storage drivers write to the "release" key
+func decodeTillerRelease(data string) (*release.Release, error) {
+	b, err := decodeReleaseData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rls := release.Release{}
+	if err := proto.Unmarshal(b, &rls); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal release")
+	}
+
+	return &rls, nil
+}
@@ -0,0 +1,52 @@
+package unforker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func Test_decodeTillerRelease(t *testing.T) {
+	req := require.New(t)
+
+	tillerRelease := release.Release{
+		Name:      "my-nginx",
+		Namespace: "web",
+		Version:   2,
+		Chart: &chart.Chart{
+			Metadata: &chart.Metadata{
+				Name:       "nginx-ingress",
+				Version:    "1.6.0",
+				AppVersion: "0.24.1",
+			},
+		},
+	}
+
+	b, err := proto.Marshal(&tillerRelease)
+	req.NoError(err)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(b)
+	req.NoError(err)
+	req.NoError(w.Close())
+
+	decoded, err := decodeTillerRelease(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	req.NoError(err)
+
+	localChart := tillerReleaseToLocalChart(decoded)
+	assert.Equal(t, "my-nginx", localChart.HelmName)
+	assert.Equal(t, "nginx-ingress", localChart.ChartName)
+	assert.Equal(t, "1.6.0", localChart.ChartVersion)
+	assert.Equal(t, "0.24.1", localChart.AppVersion)
+	assert.Equal(t, "web", localChart.Namespace)
+	assert.Equal(t, int32(2), localChart.Revision)
+	assert.True(t, localChart.IsTiller)
+}
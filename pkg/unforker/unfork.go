@@ -5,24 +5,55 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
+	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	kotsk8sutil "github.com/replicatedhq/kots/pkg/k8sutil"
 	"github.com/replicatedhq/kots/pkg/pull"
 	kotsutil "github.com/replicatedhq/kots/pkg/util"
 	"github.com/replicatedhq/unfork/pkg/chartindex"
+	"github.com/replicatedhq/unfork/pkg/chartrepo"
 	"github.com/replicatedhq/unfork/pkg/util"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/renderutil"
+	"k8s.io/helm/pkg/repo"
 	"k8s.io/helm/pkg/timeconv"
 	kustomizetypes "sigs.k8s.io/kustomize/v3/pkg/types"
 )
 
+// UnforkResult describes what Unfork wrote, splitting the changes in the fork into
+// those that could be expressed as values and those that need kustomize patches
+type UnforkResult struct {
+	Dir        string
+	ValuesFile string
+	ValuesKeys []string
+	Patches    []string
+	Resources  []string
+	Drift      *DriftResult
+}
+
+// UnforkOptions changes how a fork is compared to its upstream
+type UnforkOptions struct {
+	// Rerender renders the forked chart instead of using the manifest that helm stored
+	// for the release. Charts without a stored manifest are always rendered.
+	Rerender bool
+
+	// CaptureDrift compares what helm applied with the live objects in the cluster, and
+	// writes any changes made since as patches in a separate downstream
+	CaptureDrift bool
+	ConfigFlags  *genericclioptions.ConfigFlags
+
+	// RepoConfigs are the credentials and tls settings used to download the upstream chart
+	RepoConfigs chartrepo.Configs
+}
+
 // Unfork creates a kustomize overlay that generates localChart when applied to upstreamChart
-// returns the directory that was unforked to and an error
-func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch) (string, error) {
+// returns a description of what was unforked and an error
+func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch, unforkOptions UnforkOptions) (*UnforkResult, error) {
 	// write this out to a replicatedhq/kots compatible structure
 	unforkPath := path.Join(util.HomeDir(), localChart.HelmName)
 	_, err := os.Stat(unforkPath)
@@ -42,51 +73,47 @@ func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch) (s
 		}
 
 		if !foundWorkingPath {
-			return "", errors.Errorf("path %q and suffixes ('-1', '-2' ... '-99') already exist or cannot open", unforkPath)
+			return nil, errors.Errorf("path %q and suffixes ('-1', '-2' ... '-99') already exist or cannot open", unforkPath)
 		}
 	}
 
-	pullOptions := pull.PullOptions{
-		Downstreams:         []string{"unforked"},
-		ExcludeKotsKinds:    true,
-		RootDir:             unforkPath,
-		ExcludeAdminConsole: true,
-		CreateAppDir:        false,
-		Silent:              true,
+	result := UnforkResult{
+		Dir: unforkPath,
 	}
 
-	if _, err := pull.Pull(fmt.Sprintf("helm://%s/%s@%s", upstreamChartMatch.Repo, upstreamChartMatch.Name, upstreamChartMatch.ChartVersion), pullOptions); err != nil {
-		return "", errors.Wrap(err, "failed to pull upstream")
+	localChart, valuesOverlay, err := pullUpstream(unforkPath, localChart, upstreamChartMatch, unforkOptions.RepoConfigs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to pull upstream")
 	}
+	if len(valuesOverlay) > 0 {
+		b, err := yaml.Marshal(valuesOverlay)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal values overlay")
+		}
 
-	forkedRoot, err := ioutil.TempDir("", "unfork")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to create forked root")
+		result.ValuesFile = path.Join(unforkPath, "unforked-values.yaml")
+		if err := ioutil.WriteFile(result.ValuesFile, b, 0644); err != nil {
+			return nil, errors.Wrap(err, "failed to write values overlay")
+		}
+		result.ValuesKeys = valuesKeys(valuesOverlay)
 	}
-	defer os.RemoveAll(forkedRoot)
 
-	forkedManifests, err := renderChart(localChart.HelmName, localChart.Namespace, localChart.Chart, localChart.Templates, localChart.Values)
+	forkedManifests, err := forkedChartManifests(localChart, unforkOptions)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to render forked chart")
+		return nil, errors.Wrap(err, "failed to get forked manifests")
 	}
-	for name, content := range forkedManifests {
-		f := path.Join(forkedRoot, name)
-		d, _ := path.Split(f)
-		if _, err := os.Stat(d); os.IsNotExist(err) {
-			if err := os.MkdirAll(d, 0755); err != nil {
-				return "", errors.Wrap(err, "failed to create forked file dir")
-			}
-		}
-		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
-			return "", errors.Wrap(err, "failed to write file")
-		}
+
+	forkedRoot, err := writeForkedManifests(forkedManifests)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write forked manifests")
 	}
+	defer os.RemoveAll(forkedRoot)
 
 	// Unfork the content in forkedRoot from the base in the pull.  this will extract patches
 	// write them to downstreams/unforked
 	resources, patches, err := createPatches(forkedRoot, path.Join(unforkPath, "base"))
 	if err != nil {
-		return "", errors.Wrap(err, "faield to create patches")
+		return nil, errors.Wrap(err, "faield to create patches")
 	}
 
 	unforkPatchDir := path.Join(unforkPath, "overlays", "downstreams", "unforked")
@@ -98,15 +125,16 @@ func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch) (s
 		d, f := path.Split(filePath)
 		if _, err := os.Stat(d); os.IsNotExist(err) {
 			if err := os.MkdirAll(d, 0755); err != nil {
-				return "", errors.Wrap(err, "failed to make dir")
+				return nil, errors.Wrap(err, "failed to make dir")
 			}
 		}
 
 		if err := ioutil.WriteFile(path.Join(unforkPatchDir, filename), content, 0644); err != nil {
-			return "", errors.Wrap(err, "failed to write resource")
+			return nil, errors.Wrap(err, "failed to write resource")
 		}
 
 		resourcesForKustomization = append(resourcesForKustomization, f)
+		result.Resources = append(result.Resources, f)
 	}
 
 	for filename, content := range patches {
@@ -114,20 +142,21 @@ func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch) (s
 		d, f := path.Split(filePath)
 		if _, err := os.Stat(d); os.IsNotExist(err) {
 			if err := os.MkdirAll(d, 0755); err != nil {
-				return "", errors.Wrap(err, "failed to make dir")
+				return nil, errors.Wrap(err, "failed to make dir")
 			}
 		}
 
 		if err := ioutil.WriteFile(path.Join(unforkPatchDir, filename), content, 0644); err != nil {
-			return "", errors.Wrap(err, "failed to write patch")
+			return nil, errors.Wrap(err, "failed to write patch")
 		}
 
 		patchesForKustomization = append(patchesForKustomization, f)
+		result.Patches = append(result.Patches, f)
 	}
 
 	k, err := kotsk8sutil.ReadKustomizationFromFile(path.Join(unforkPatchDir, "kustomization.yaml"))
 	if err != nil {
-		return "", errors.Wrap(err, "failed to read kustomization")
+		return nil, errors.Wrap(err, "failed to read kustomization")
 	}
 
 	for _, f := range patchesForKustomization {
@@ -137,15 +166,194 @@ func Unfork(localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch) (s
 		k.Resources = append(k.Resources, r)
 	}
 	if err := kotsk8sutil.WriteKustomizationToFile(k, path.Join(unforkPatchDir, "kustomization.yaml")); err != nil {
-		return "", errors.Wrap(err, "failed to write kustomization")
+		return nil, errors.Wrap(err, "failed to write kustomization")
+	}
+
+	sort.Strings(result.Resources)
+	sort.Strings(result.Patches)
+
+	if unforkOptions.CaptureDrift {
+		driftDir := path.Join(unforkPath, "overlays", "downstreams", "drift")
+		driftResult, err := captureDrift(unforkOptions.ConfigFlags, localChart.Namespace, forkedManifests, driftDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to capture drift")
+		}
+		result.Drift = driftResult
+	}
+
+	return &result, nil
+}
+
+// pullUpstream writes upstreamChartMatch to unforkPath, and renders its base with the values that
+// localChart was deployed with. Returns the chart to compare with the upstream, which is localChart
+// unless its chart is only known to be the upstream, and the changes to the fork's default values,
+// which are passed to the upstream as values instead of becoming patches
+func pullUpstream(unforkPath string, localChart *LocalChart, upstreamChartMatch chartindex.ChartMatch, repoConfigs chartrepo.Configs) (*LocalChart, map[string]interface{}, error) {
+	if upstreamChartMatch.Path != "" {
+		archive, err := readChartPath(upstreamChartMatch.Path)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read upstream chart")
+		}
+		if err := writeChartArchive(unforkPath, upstreamChartMatch.Name, upstreamChartMatch.ChartVersion, archive); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to write upstream chart")
+		}
+	} else if upstreamChartMatch.URI != "" {
+		// the repository may need credentials, which kots can't send
+		repoConfig := repoConfigs.ForURL(upstreamChartMatch.URI)
+		var archive []byte
+		var err error
+		if upstreamChartMatch.ChartURL != "" {
+			archive, err = repoConfig.DownloadChartVersion(&repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: upstreamChartMatch.Name, Version: upstreamChartMatch.ChartVersion},
+				URLs:     []string{upstreamChartMatch.ChartURL},
+			})
+		} else {
+			archive, err = repoConfig.DownloadChart(upstreamChartMatch.Name, upstreamChartMatch.ChartVersion)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to download upstream chart")
+		}
+		if err := writeChartArchive(unforkPath, upstreamChartMatch.Name, upstreamChartMatch.ChartVersion, archive); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to write upstream chart")
+		}
+	} else {
+		pullOptions := pull.PullOptions{
+			Downstreams:         []string{"unforked"},
+			ExcludeKotsKinds:    true,
+			RootDir:             unforkPath,
+			ExcludeAdminConsole: true,
+			CreateAppDir:        false,
+			Silent:              true,
+		}
+
+		if _, err := pull.Pull(fmt.Sprintf("helm://%s/%s@%s", upstreamChartMatch.Repo, upstreamChartMatch.Name, upstreamChartMatch.ChartVersion), pullOptions); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to pull upstream")
+		}
+	}
+
+	upstreamChart, err := chartutil.Load(path.Join(unforkPath, "upstream"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load upstream chart")
+	}
+
+	if localChart.Chart == nil {
+		localChart = localChart.withChart(upstreamChart)
+	}
+	if len(localChart.ValueFiles) > 0 {
+		localChart, err = localChart.withValueFiles(upstreamChart)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read value files")
+		}
+	}
+
+	valuesOverlay, err := forkValuesOverlay(localChart.Chart, upstreamChart)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to diff values")
+	}
+
+	upstreamConfig, err := upstreamRenderConfig(valuesOverlay, localChart.Config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create upstream values")
 	}
 
-	return unforkPath, nil
+	if err := renderUpstreamBase(unforkPath, upstreamChart, localChart, upstreamConfig); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to render upstream with values")
+	}
+
+	return localChart, valuesOverlay, nil
 }
 
-func renderChart(helmName string, namespace string, c *chart.Chart, templates []*chart.Template, values map[string]*chart.Value) (map[string]string, error) {
-	config := &chart.Config{Raw: string(""), Values: values}
+// UpstreamMatches returns the possible upstreams of localChart. The upstream in the mapping file is
+// used first, then the upstream that's already known for charts deployed from a chart repo, instead
+// of searching the index. Charts with the same name come first, followed by charts with similar
+// templates, which finds the upstream of a fork that's been renamed. Mirrors of the same chart are
+// collapsed into one match, and charts from deprecated repos point to their maintained successor
+func UpstreamMatches(index *chartindex.ChartIndex, mapping *chartindex.Mapping, localChart *LocalChart) ([]chartindex.ChartMatch, error) {
+	upstreamMatches, err := findUpstreamMatches(index, mapping, localChart)
+	if err != nil {
+		return nil, err
+	}
+
+	return index.Canonicalize(upstreamMatches, mapping.MovedCharts()), nil
+}
+
+func findUpstreamMatches(index *chartindex.ChartIndex, mapping *chartindex.Mapping, localChart *LocalChart) ([]chartindex.ChartMatch, error) {
+	if mappedUpstream := mapping.Find(localChart.Namespace, localChart.HelmName, localChart.ChartName); mappedUpstream != nil {
+		upstreamMatch, err := index.ResolveMappedUpstream(*mappedUpstream, localChart.ChartName, localChart.ChartVersion, localChart.AppVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve mapped upstream")
+		}
+		return []chartindex.ChartMatch{*upstreamMatch}, nil
+	}
+
+	if localChart.Upstream != nil {
+		upstreamMatch := *localChart.Upstream
+		// argo cd deploys the newest version in a targetRevision range
+		if version, ok := index.ResolveVersionRange(upstreamMatch.URI, upstreamMatch.Name, upstreamMatch.ChartVersion); ok {
+			upstreamMatch.ChartVersion = version.ChartVersion
+			upstreamMatch.AppVersion = version.AppVersion
+			upstreamMatch.ChartURL = version.URL
+		}
+		return []chartindex.ChartMatch{upstreamMatch}, nil
+	}
 
+	upstreamMatches, err := index.FindBestUpstreamMatches(localChart.ChartName, localChart.ChartVersion, localChart.AppVersion, chartindex.DefaultMatchesPerRepo)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find upstreams by name")
+	}
+
+	// a fork that's been renamed has no upstream with its name, so it's found by its templates
+	if len(upstreamMatches) > 0 || len(localChart.Templates) == 0 {
+		return upstreamMatches, nil
+	}
+
+	fingerprint := chartindex.FingerprintTemplates(localChart.Templates)
+	return index.FindUpstreamMatchesByContent(fingerprint, chartindex.DefaultMinSimilarity, chartindex.DefaultContentMatches), nil
+}
+
+// writeForkedManifests writes manifests to a new temp dir, which the caller should remove
+func writeForkedManifests(manifests map[string]string) (string, error) {
+	forkedRoot, err := ioutil.TempDir("", "unfork")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create forked root")
+	}
+
+	for name, content := range manifests {
+		f := path.Join(forkedRoot, name)
+		d, _ := path.Split(f)
+		if _, err := os.Stat(d); os.IsNotExist(err) {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				os.RemoveAll(forkedRoot)
+				return "", errors.Wrap(err, "failed to create forked file dir")
+			}
+		}
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			os.RemoveAll(forkedRoot)
+			return "", errors.Wrap(err, "failed to write file")
+		}
+	}
+
+	return forkedRoot, nil
+}
+
+// forkedChartManifests returns what the fork deployed. The manifest stored with the release is
+// exactly what was applied, while rendering again can differ in capabilities, random values
+// and the release time
+func forkedChartManifests(localChart *LocalChart, unforkOptions UnforkOptions) (map[string]string, error) {
+	// charts from labels can't be rendered again, there's no record of their values
+	if localChart.Manifest != "" && (!unforkOptions.Rerender || localChart.FromLabels) {
+		return splitManifest(localChart.Manifest), nil
+	}
+
+	rendered, err := renderChart(localChart.HelmName, localChart.Namespace, localChart.Chart, localChart.Templates, localChart.renderConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render forked chart")
+	}
+
+	return rendered, nil
+}
+
+func renderChart(helmName string, namespace string, c *chart.Chart, templates []*chart.Template, config *chart.Config) (map[string]string, error) {
 	renderOpts := renderutil.Options{
 		ReleaseOptions: chartutil.ReleaseOptions{
 			Name:      helmName,
@@ -162,10 +370,14 @@ func renderChart(helmName string, namespace string, c *chart.Chart, templates []
 		return nil, errors.Wrap(err, "failed to render chart")
 	}
 
-	// Remove common prefixes from these files to make it easier to manage later
+	return removeCommonPrefix(splitRenderedTemplates(rendered)), nil
+}
+
+// removeCommonPrefix removes the directories that all files share, to make it easier to manage later
+func removeCommonPrefix(files map[string]string) map[string]string {
 	var commonPrefix []string
 
-	for filename, _ := range rendered {
+	for filename, _ := range files {
 		d, _ := path.Split(filename)
 		dirs := strings.Split(d, string(os.PathSeparator))
 		if commonPrefix == nil {
@@ -174,14 +386,14 @@ func renderChart(helmName string, namespace string, c *chart.Chart, templates []
 		commonPrefix = kotsutil.CommonSlicePrefix(commonPrefix, dirs)
 	}
 
-	cleanedRendered := map[string]string{}
-	for filename, content := range rendered {
+	cleanedFiles := map[string]string{}
+	for filename, content := range files {
 		d, f := path.Split(filename)
 		d2 := strings.Split(d, string(os.PathSeparator))
 
 		d2 = d2[len(commonPrefix):]
-		cleanedRendered[path.Join(path.Join(d2...), f)] = content
+		cleanedFiles[path.Join(path.Join(d2...), f)] = content
 	}
 
-	return cleanedRendered, nil
+	return cleanedFiles
 }
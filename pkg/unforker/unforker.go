@@ -1,18 +1,88 @@
 package unforker
 
 import (
+	"sort"
+	"time"
+
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 type Unforker struct {
-	configFlags *genericclioptions.ConfigFlags
-	client      *kubernetes.Clientset
-	uiCh        chan UIEvent
+	configFlags      *genericclioptions.ConfigFlags
+	tillerOptions    TillerOptions
+	discoveryOptions DiscoveryOptions
+	client           *kubernetes.Clientset
+	dynamicClient    dynamic.Interface
+	restMapper       meta.RESTMapper
+	uiCh             chan UIEvent
+
+	// labelledObjects are cached between polls, and listed again after labelDiscoveryInterval
+	labelledObjects []labelledObject
+	labelledAt      time.Time
+}
+
+// DiscoveryOptions controls which releases are listed
+type DiscoveryOptions struct {
+	// Namespace only lists releases in this namespace. An empty namespace lists releases in every namespace
+	Namespace string
+	// Interval is how often releases are listed again to find new, upgraded and removed
+	// releases. An interval of 0 or less uses DefaultDiscoveryInterval
+	Interval time.Duration
+	// FromLabels also creates charts from live objects with helm's chart labels that don't
+	// belong to any release, such as charts installed with helm template and kubectl apply
+	FromLabels bool
+}
+
+const DefaultDiscoveryInterval = 15 * time.Second
+
+// TillerOptions controls how Helm 2 releases are discovered
+type TillerOptions struct {
+	// Namespace is where tiller runs. An empty namespace uses DefaultTillerNamespace
+	Namespace string
+	// AllNamespaces looks for tillers in every namespace, for clusters that run more than one
+	AllNamespaces bool
+	// Selector is the label selector for tiller pods. An empty selector uses DefaultTillerSelector
+	Selector string
+	// Host connects to tiller at this address instead of finding a pod and port-forwarding to it
+	Host string
+
+	// Storage is the tiller storage driver, either "configmap" or "secret"
+	Storage string
+	// ReadStorage reads releases directly from tiller's storage instead of
+	// port-forwarding to the tiller api. Storage is always read when there
+	// is no ready tiller pod.
+	ReadStorage bool
+
+	TLSEnable   bool
+	TLSVerify   bool
+	TLSCACert   string
+	TLSCert     string
+	TLSKey      string
+	TLSHostname string
+}
+
+func (t TillerOptions) namespace() string {
+	if t.AllNamespaces {
+		return ""
+	}
+	if t.Namespace == "" {
+		return DefaultTillerNamespace
+	}
+	return t.Namespace
+}
+
+func (t TillerOptions) selector() string {
+	if t.Selector == "" {
+		return DefaultTillerSelector
+	}
+	return t.Selector
 }
 
-func NewUnforker(configFlags *genericclioptions.ConfigFlags, uiCh chan UIEvent) (*Unforker, error) {
+func NewUnforker(configFlags *genericclioptions.ConfigFlags, tillerOptions TillerOptions, discoveryOptions DiscoveryOptions, uiCh chan UIEvent) (*Unforker, error) {
 	config, err := configFlags.ToRESTConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read kubeconfig")
@@ -21,17 +91,33 @@ func NewUnforker(configFlags *genericclioptions.ConfigFlags, uiCh chan UIEvent)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create clientset")
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	restMapper, err := configFlags.ToRESTMapper()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create rest mapper")
+	}
 
 	u := &Unforker{
-		configFlags: configFlags,
-		client:      client,
-		uiCh:        uiCh,
+		configFlags:      configFlags,
+		tillerOptions:    tillerOptions,
+		discoveryOptions: discoveryOptions,
+		client:           client,
+		dynamicClient:    dynamicClient,
+		restMapper:       restMapper,
+		uiCh:             uiCh,
 	}
 
 	return u, nil
 }
 
-func HasTiller(configFlags *genericclioptions.ConfigFlags) (bool, error) {
+func HasTiller(configFlags *genericclioptions.ConfigFlags, tillerOptions TillerOptions) (bool, error) {
+	if tillerOptions.Host != "" {
+		return true, nil
+	}
+
 	config, err := configFlags.ToRESTConfig()
 	if err != nil {
 		return false, errors.Wrap(err, "failed to read kubeconfig")
@@ -41,42 +127,250 @@ func HasTiller(configFlags *genericclioptions.ConfigFlags) (bool, error) {
 		return false, errors.Wrap(err, "failed to create clientset")
 	}
 
-	tillerPodName, _, err := getTillerPodName(client)
+	tillerPods, err := getTillerPods(client, tillerOptions)
 	if err != nil {
 		return false, nil
 	}
 
-	return tillerPodName != "", nil
+	return len(tillerPods) > 0, nil
+}
+
+// HasTillerStorage returns true if tiller has persisted any deployed releases,
+// even if tiller itself is not running
+func HasTillerStorage(configFlags *genericclioptions.ConfigFlags, tillerOptions TillerOptions) (bool, error) {
+	config, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read kubeconfig")
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create clientset")
+	}
+
+	hasReleases, err := hasTillerStorage(client, tillerOptions.namespace(), tillerOptions.Storage)
+	if err != nil {
+		return false, nil
+	}
+
+	return hasReleases, nil
+}
+
+// HasHelm3Releases returns true if there are any helm 3 releases in the namespace that discovery lists
+func HasHelm3Releases(configFlags *genericclioptions.ConfigFlags, discoveryOptions DiscoveryOptions) (bool, error) {
+	config, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read kubeconfig")
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create clientset")
+	}
+
+	hasReleases, err := hasHelm3Releases(client, discoveryOptions.Namespace)
+	if err != nil {
+		return false, nil
+	}
+
+	return hasReleases, nil
+}
+
+// HasGitOpsReleases returns true if there are any flux or argo cd resources that deploy charts
+func HasGitOpsReleases(configFlags *genericclioptions.ConfigFlags) (bool, error) {
+	config, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read kubeconfig")
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create dynamic client")
+	}
+
+	restMapper, err := configFlags.ToRESTMapper()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create rest mapper")
+	}
+
+	return hasGitOpsResources(dynamicClient, restMapper), nil
 }
 
+// StartDiscovery lists releases, and keeps listing them until the process exits, sending
+// new_chart, updated_chart and removed_chart events as releases are installed, upgraded and deleted.
+// It only returns if the first list fails.
 func (u *Unforker) StartDiscovery() error {
-	if err := u.findAndListChartsSync(); err != nil {
+	localCharts, err := u.findCharts()
+	if err != nil {
 		return errors.Wrap(err, "failed to find charts")
 	}
+	known := u.sendChanges(map[string]*LocalChart{}, localCharts)
+
+	interval := u.discoveryOptions.Interval
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		localCharts, err := u.findCharts()
+		if err != nil {
+			// tiller or the api server can be unavailable for a moment, keep showing what we last found
+			continue
+		}
+		known = u.sendChanges(known, localCharts)
+	}
 
 	return nil
 }
 
-func (u *Unforker) findAndListChartsSync() error {
-	tillerPodName, tillerNamespace, err := getTillerPodName(u.client)
+func (u *Unforker) findCharts() ([]*LocalChart, error) {
+	tillerCharts, err := u.findTillerCharts()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find tiller charts")
+	}
+	localCharts := tillerCharts
+
+	// not being allowed to list helm 3 storage is the same as not having any helm 3 releases
+	hasHelm3, err := hasHelm3Releases(u.client, u.discoveryOptions.Namespace)
+	if err == nil && hasHelm3 {
+		helm3Charts, err := u.queryHelm3ForCharts(u.discoveryOptions.Namespace)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to query helm 3 releases")
+		}
+
+		localCharts = append(localCharts, helm3Charts...)
+	}
+
+	gitOpsCharts, err := u.queryGitOpsForCharts()
 	if err != nil {
-		return errors.Wrap(err, "failed to get tiller pod")
+		return nil, errors.Wrap(err, "failed to query gitops releases")
 	}
 
-	if tillerPodName != "" {
-		tillerCharts, err := u.queryTillerForCharts(tillerPodName, tillerNamespace)
+	localCharts = mergeGitOpsCharts(localCharts, gitOpsCharts)
+
+	if u.discoveryOptions.FromLabels {
+		labelCharts, err := u.queryLabelsForCharts(localCharts)
 		if err != nil {
-			return errors.Wrap(err, "failed to query tiller")
+			return nil, errors.Wrap(err, "failed to find charts from labels")
 		}
+		localCharts = append(localCharts, labelCharts...)
+	}
+
+	return u.filterNamespace(localCharts), nil
+}
 
-		for _, localChart := range tillerCharts {
-			uiEvent := UIEvent{
-				EventName: "new_chart",
-				Payload:   localChart,
-			}
-			u.uiCh <- uiEvent
+func (u *Unforker) findTillerCharts() ([]*LocalChart, error) {
+	if u.tillerOptions.Host != "" {
+		tillerCharts, err := u.queryTillerForCharts(u.tillerOptions.Host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query tiller at %s", u.tillerOptions.Host)
 		}
+		return tillerCharts, nil
 	}
 
-	return nil
+	tillerPods, err := getTillerPods(u.client, u.tillerOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get tiller pods")
+	}
+
+	if len(tillerPods) == 0 || u.tillerOptions.ReadStorage {
+		// tiller is down, scaled to zero, or we were asked to skip it
+		hasStorage, err := hasTillerStorage(u.client, u.tillerOptions.namespace(), u.tillerOptions.Storage)
+		if err != nil || !hasStorage {
+			return []*LocalChart{}, nil
+		}
+
+		tillerCharts, err := u.queryTillerStorageForCharts(u.tillerOptions.namespace(), u.tillerOptions.Storage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read tiller storage")
+		}
+		return tillerCharts, nil
+	}
+
+	tillerCharts := []*LocalChart{}
+	for _, pod := range tillerPods {
+		podCharts, err := u.queryTillerPodForCharts(pod)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query tiller %s/%s", pod.Namespace, pod.Name)
+		}
+		tillerCharts = append(tillerCharts, podCharts...)
+	}
+
+	return tillerCharts, nil
+}
+
+// filterNamespace removes the releases that aren't in the namespace being discovered. Tiller and
+// gitops controllers list releases from every namespace, so they can only be filtered after listing
+func (u *Unforker) filterNamespace(localCharts []*LocalChart) []*LocalChart {
+	if u.discoveryOptions.Namespace == "" {
+		return localCharts
+	}
+
+	filtered := []*LocalChart{}
+	for _, localChart := range localCharts {
+		if localChart.Namespace == u.discoveryOptions.Namespace {
+			filtered = append(filtered, localChart)
+		}
+	}
+
+	return filtered
+}
+
+// sendChanges sends an event for each release that changed since known was listed, and
+// returns the releases in found, keyed by release
+func (u *Unforker) sendChanges(known map[string]*LocalChart, found []*LocalChart) map[string]*LocalChart {
+	added, updated, removed := diffCharts(known, found)
+
+	u.sendCharts("new_chart", added)
+	u.sendCharts("updated_chart", updated)
+	u.sendCharts("removed_chart", removed)
+
+	current := map[string]*LocalChart{}
+	for _, localChart := range found {
+		current[localChart.ReleaseKey()] = localChart
+	}
+
+	return current
+}
+
+// diffCharts compares the releases in found with those in known. A release is updated
+// when its revision or status changes
+func diffCharts(known map[string]*LocalChart, found []*LocalChart) ([]*LocalChart, []*LocalChart, []*LocalChart) {
+	added := []*LocalChart{}
+	updated := []*LocalChart{}
+	removed := []*LocalChart{}
+
+	foundKeys := map[string]bool{}
+	for _, localChart := range found {
+		key := localChart.ReleaseKey()
+		foundKeys[key] = true
+
+		existing, ok := known[key]
+		if !ok {
+			added = append(added, localChart)
+		} else if existing.Revision != localChart.Revision || existing.Status != localChart.Status {
+			updated = append(updated, localChart)
+		}
+	}
+
+	for key, localChart := range known {
+		if !foundKeys[key] {
+			removed = append(removed, localChart)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].ReleaseKey() < removed[j].ReleaseKey()
+	})
+
+	return added, updated, removed
+}
+
+func (u *Unforker) sendCharts(eventName string, localCharts []*LocalChart) {
+	for _, localChart := range localCharts {
+		uiEvent := UIEvent{
+			EventName: eventName,
+			Payload:   localChart,
+		}
+		u.uiCh <- uiEvent
+	}
 }
@@ -0,0 +1,64 @@
+package unforker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diffCharts(t *testing.T) {
+	web := &LocalChart{HelmName: "web", Namespace: "default", Revision: 1, Status: "deployed"}
+	webUpgraded := &LocalChart{HelmName: "web", Namespace: "default", Revision: 2, Status: "deployed"}
+	cache := &LocalChart{HelmName: "cache", Namespace: "default", Revision: 4, Status: "deployed"}
+	cacheFailed := &LocalChart{HelmName: "cache", Namespace: "default", Revision: 4, Status: "failed"}
+	tillerWeb := &LocalChart{HelmName: "web", Namespace: "default", Revision: 1, Status: "deployed", IsTiller: true}
+
+	tests := []struct {
+		name            string
+		known           []*LocalChart
+		found           []*LocalChart
+		expectedAdded   []*LocalChart
+		expectedUpdated []*LocalChart
+		expectedRemoved []*LocalChart
+	}{
+		{
+			name:            "first list",
+			known:           []*LocalChart{},
+			found:           []*LocalChart{web, cache},
+			expectedAdded:   []*LocalChart{web, cache},
+			expectedUpdated: []*LocalChart{},
+			expectedRemoved: []*LocalChart{},
+		},
+		{
+			name:            "upgraded and status changed",
+			known:           []*LocalChart{web, cache},
+			found:           []*LocalChart{webUpgraded, cacheFailed},
+			expectedAdded:   []*LocalChart{},
+			expectedUpdated: []*LocalChart{webUpgraded, cacheFailed},
+			expectedRemoved: []*LocalChart{},
+		},
+		{
+			name:            "removed, and the same name installed with tiller",
+			known:           []*LocalChart{web, cache},
+			found:           []*LocalChart{cache, tillerWeb},
+			expectedAdded:   []*LocalChart{tillerWeb},
+			expectedUpdated: []*LocalChart{},
+			expectedRemoved: []*LocalChart{web},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			known := map[string]*LocalChart{}
+			for _, localChart := range test.known {
+				known[localChart.ReleaseKey()] = localChart
+			}
+
+			added, updated, removed := diffCharts(known, test.found)
+
+			assert.Equal(t, test.expectedAdded, added)
+			assert.Equal(t, test.expectedUpdated, updated)
+			assert.Equal(t, test.expectedRemoved, removed)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package unforker
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/replicatedhq/kots/pkg/base"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// renderUpstreamBase replaces the base that was pulled with the upstream chart's defaults with
+// one rendered using the same release name and namespace as the fork, and the given values.
+// This keeps values overrides out of the patches, leaving only changes to the templates.
+func renderUpstreamBase(unforkPath string, upstreamChart *chart.Chart, localChart *LocalChart, config *chart.Config) error {
+	rendered, err := renderChart(localChart.HelmName, localChart.Namespace, upstreamChart, upstreamChart.GetTemplates(), config)
+	if err != nil {
+		return errors.Wrap(err, "failed to render upstream chart")
+	}
+
+	b := base.Base{}
+	for filename, content := range rendered {
+		b.Files = append(b.Files, base.BaseFile{
+			Path:    filename,
+			Content: []byte(content),
+		})
+	}
+
+	writeBaseOptions := base.WriteOptions{
+		BaseDir:          path.Join(unforkPath, "base"),
+		Overwrite:        true,
+		ExcludeKotsKinds: true,
+	}
+	if err := b.WriteBase(writeBaseOptions); err != nil {
+		return errors.Wrap(err, "failed to write base")
+	}
+
+	return nil
+}
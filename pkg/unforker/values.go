@@ -0,0 +1,129 @@
+package unforker
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// forkValuesOverlay returns the default values in the forked chart that are changed from,
+// or missing in, the upstream chart's defaults. Passing these to the upstream chart
+// reproduces every part of the fork that was only a change to values.yaml
+func forkValuesOverlay(forkedChart *chart.Chart, upstreamChart *chart.Chart) (map[string]interface{}, error) {
+	forkedValues, err := chartutil.ReadValues([]byte(forkedChart.GetValues().GetRaw()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read forked values")
+	}
+
+	upstreamValues, err := chartutil.ReadValues([]byte(upstreamChart.GetValues().GetRaw()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read upstream values")
+	}
+
+	return diffValues(upstreamValues, forkedValues), nil
+}
+
+// diffValues returns the keys in modified that have a different value in original.
+// Keys that were removed in modified are not included, they can't be expressed as values
+func diffValues(original map[string]interface{}, modified map[string]interface{}) map[string]interface{} {
+	diff := map[string]interface{}{}
+
+	for key, modifiedValue := range modified {
+		originalValue, ok := original[key]
+		if !ok {
+			diff[key] = modifiedValue
+			continue
+		}
+
+		originalMap, originalIsMap := asValuesMap(originalValue)
+		modifiedMap, modifiedIsMap := asValuesMap(modifiedValue)
+		if originalIsMap && modifiedIsMap {
+			nested := diffValues(originalMap, modifiedMap)
+			if len(nested) > 0 {
+				diff[key] = nested
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(originalValue, modifiedValue) {
+			diff[key] = modifiedValue
+		}
+	}
+
+	return diff
+}
+
+// mergeValues returns a copy of dest with src merged on top, recursing into maps
+func mergeValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range dest {
+		merged[key] = value
+	}
+
+	for key, srcValue := range src {
+		srcMap, srcIsMap := asValuesMap(srcValue)
+		destMap, destIsMap := asValuesMap(merged[key])
+		if srcIsMap && destIsMap {
+			merged[key] = mergeValues(destMap, srcMap)
+			continue
+		}
+
+		merged[key] = srcValue
+	}
+
+	return merged
+}
+
+// valuesKeys returns the dotted path to every leaf in values, sorted
+func valuesKeys(values map[string]interface{}) []string {
+	keys := []string{}
+	for key, value := range values {
+		if nested, ok := asValuesMap(value); ok && len(nested) > 0 {
+			for _, nestedKey := range valuesKeys(nested) {
+				keys = append(keys, key+"."+nestedKey)
+			}
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// upstreamRenderConfig combines the fork's values overlay with the values the release was
+// deployed with. The release values win, the same as they do over the fork's own defaults
+func upstreamRenderConfig(valuesOverlay map[string]interface{}, releaseConfig *chart.Config) (*chart.Config, error) {
+	releaseValues, err := chartutil.ReadValues([]byte(releaseConfig.GetRaw()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read release values")
+	}
+
+	merged := mergeValues(valuesOverlay, releaseValues)
+	if len(merged) == 0 {
+		return &chart.Config{Raw: ""}, nil
+	}
+
+	raw, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal values")
+	}
+
+	return &chart.Config{Raw: string(raw)}, nil
+}
+
+func asValuesMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case chartutil.Values:
+		return v, true
+	}
+
+	return nil, false
+}
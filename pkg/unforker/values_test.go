@@ -0,0 +1,141 @@
+package unforker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+func Test_diffValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		original map[string]interface{}
+		modified map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "unchanged",
+			original: map[string]interface{}{"replicas": 1},
+			modified: map[string]interface{}{"replicas": 1},
+			expected: map[string]interface{}{},
+		},
+		{
+			name: "changed nested value",
+			original: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "nginx", "tag": "1.15"},
+			},
+			modified: map[string]interface{}{
+				"image": map[string]interface{}{"repository": "nginx", "tag": "1.17"},
+			},
+			expected: map[string]interface{}{
+				"image": map[string]interface{}{"tag": "1.17"},
+			},
+		},
+		{
+			name:     "added and removed keys",
+			original: map[string]interface{}{"removed": true},
+			modified: map[string]interface{}{"added": []interface{}{"a"}},
+			expected: map[string]interface{}{"added": []interface{}{"a"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := diffValues(test.original, test.modified)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_valuesKeys(t *testing.T) {
+	values := map[string]interface{}{
+		"replicas": 2,
+		"image":    map[string]interface{}{"tag": "1.17", "pullPolicy": "Always"},
+	}
+
+	assert.Equal(t, []string{"image.pullPolicy", "image.tag", "replicas"}, valuesKeys(values))
+}
+
+func Test_valuesAndPatchesSplit(t *testing.T) {
+	req := require.New(t)
+
+	dir, err := ioutil.TempDir("", "unfork-test")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	configMap := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  replicas: "{{ .Values.replicas }}"
+  tag: "{{ .Values.image.tag }}"
+`
+	writeChart := func(name string, values string, configMap string) string {
+		chartDir := filepath.Join(dir, name)
+		req.NoError(os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+		req.NoError(ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v1\nname: my-chart\nversion: 1.2.3\n"), 0644))
+		req.NoError(ioutil.WriteFile(filepath.Join(chartDir, "values.yaml"), []byte(values), 0644))
+		req.NoError(ioutil.WriteFile(filepath.Join(chartDir, "templates", "configmap.yaml"), []byte(configMap), 0644))
+		return chartDir
+	}
+
+	upstreamDir := writeChart("upstream", "replicas: 1\nimage:\n  tag: \"1.15\"\n", configMap)
+	// the fork changed a default value, and added a key that no value sets
+	forkedDir := writeChart("fork", "replicas: 3\nimage:\n  tag: \"1.15\"\n", configMap+"  forked: \"true\"\n")
+
+	forkedChart, err := chartutil.Load(forkedDir)
+	req.NoError(err)
+	localChart := &LocalChart{
+		HelmName:  "my-release",
+		Namespace: "default",
+		Chart:     forkedChart,
+		Templates: forkedChart.GetTemplates(),
+		Config:    &chart.Config{Raw: "image:\n  tag: \"1.17\"\n"},
+	}
+
+	upstreamChart, err := chartutil.Load(upstreamDir)
+	req.NoError(err)
+
+	// the same steps as pullUpstream, which can't pull in a test
+	valuesOverlay, err := forkValuesOverlay(localChart.Chart, upstreamChart)
+	req.NoError(err)
+	assert.Equal(t, map[string]interface{}{"replicas": float64(3)}, valuesOverlay)
+
+	upstreamConfig, err := upstreamRenderConfig(valuesOverlay, localChart.Config)
+	req.NoError(err)
+	unforkPath := filepath.Join(dir, "unforked")
+	req.NoError(renderUpstreamBase(unforkPath, upstreamChart, localChart, upstreamConfig))
+
+	// the values the release was deployed with still win over the fork's defaults
+	base, err := ioutil.ReadFile(filepath.Join(unforkPath, "base", "configmap-0.yaml"))
+	req.NoError(err)
+	assert.Contains(t, string(base), `replicas: "3"`)
+	assert.Contains(t, string(base), `tag: "1.17"`)
+
+	forkedManifests, err := forkedChartManifests(localChart, UnforkOptions{})
+	req.NoError(err)
+	forkedRoot, err := writeForkedManifests(forkedManifests)
+	req.NoError(err)
+	defer os.RemoveAll(forkedRoot)
+
+	// the base is rendered with the values, so only the change to the template is left as a patch
+	_, patches, err := createPatches(forkedRoot, filepath.Join(unforkPath, "base"))
+	req.NoError(err)
+	req.Len(patches, 1)
+	for _, patch := range patches {
+		assert.Equal(t, `apiVersion: v1
+data:
+  forked: "true"
+kind: ConfigMap
+metadata:
+  name: my-release
+`, string(patch))
+	}
+}
@@ -2,6 +2,8 @@ package util
 
 import (
 	"os"
+	"path/filepath"
+	"runtime"
 )
 
 func HomeDir() string {
@@ -10,3 +12,28 @@ func HomeDir() string {
 	}
 	return os.Getenv("USERPROFILE") // windows
 }
+
+// CacheDir returns the user's cache dir, such as $XDG_CACHE_HOME or ~/.cache on linux
+func CacheDir() string {
+	if d, err := os.UserCacheDir(); err == nil {
+		return d
+	}
+	return filepath.Join(HomeDir(), ".cache")
+}
+
+// ConfigDir returns the user's config dir, in the same place that the helm 3 client looks
+func ConfigDir() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(HomeDir(), "Library", "Preferences")
+	case "windows":
+		if d := os.Getenv("APPDATA"); d != "" {
+			return d
+		}
+	default:
+		if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+			return d
+		}
+	}
+	return filepath.Join(HomeDir(), ".config")
+}